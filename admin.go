@@ -0,0 +1,387 @@
+package raven
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ravenbox/raven-prototype/pkg/recording"
+	"github.com/ravenbox/raven-prototype/pkg/rtpcapture"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/utils"
+)
+
+// Admin serves a token-protected JSON API for inspecting and
+// controlling live sessions of a Raven instance.
+//
+//	GET  /users               connected users
+//	GET  /rooms               rooms and their members
+//	GET  /peers               PeerConnections registered with the SFU
+//	GET  /tracks              inbound tracks of the SFU
+//	GET  /subscriptions       subscribed peers per track
+//	GET  /stats?peer=ID       GetStats() report of a peer
+//	GET  /runtime             goroutines and CPU time of the process
+//	POST /kick                {"user": "", "reason": ""}
+//	POST /unsubscribe         {"peer": "", "track": ""}
+//	POST /mute                {"track": "", "muted": true}
+//	GET  /recordings          names of running recordings
+//	POST /recordings/start    {"room": ""}
+//	POST /recordings/stop     {"room": ""}
+//	POST /replay              {"file": "", "owner": ""}
+//
+// Replayed files are named relative to Raven.CaptureDir.
+type Admin struct {
+	Raven *Raven
+	// Token is compared against the bearer token of each request.
+	// An empty Token rejects every request.
+	Token string
+}
+
+func NewAdmin(raven *Raven, token string) *Admin {
+	return &Admin{
+		Raven: raven,
+		Token: token,
+	}
+}
+
+var (
+	errUserNotFound    = errors.New("user not found")
+	errBadAdminRequest = errors.New("malformed request body")
+	errReplayDisabled  = errors.New("replay is disabled")
+	errBadCaptureName  = errors.New("capture must be named relative to the capture directory")
+)
+
+type AdminUser struct {
+	Name string `json:"name"`
+	Room string `json:"room"`
+	Peer bool   `json:"peer"`
+}
+
+type AdminRoom struct {
+	Name      string   `json:"name"`
+	Users     []string `json:"users"`
+	AudioOnly bool     `json:"audio_only,omitempty"`
+}
+
+type AdminPeer struct {
+	ID              string `json:"id"`
+	ConnectionState string `json:"connection_state"`
+}
+
+// AdminRuntime describes the resource usage of the process.
+type AdminRuntime struct {
+	Goroutines int     `json:"goroutines"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	HeapBytes  uint64  `json:"heap_bytes"`
+	Peers      int     `json:"peers"`
+	Tracks     int     `json:"tracks"`
+}
+
+type AdminSubscription struct {
+	Track string `json:"track"`
+	Peer  string `json:"peer"`
+}
+
+type adminKickRequest struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+type adminUnsubscribeRequest struct {
+	Peer  string `json:"peer"`
+	Track string `json:"track"`
+}
+
+type adminRecordingRequest struct {
+	Room string `json:"room"`
+}
+
+type adminReplayRequest struct {
+	// File is an rtpcapture file in Raven.CaptureDir.
+	File  string `json:"file"`
+	Owner string `json:"owner"`
+}
+
+type AdminReplay struct {
+	Track string `json:"track"`
+}
+
+type adminMuteRequest struct {
+	Track string `json:"track"`
+	Muted bool   `json:"muted"`
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		v   any
+		err error
+	)
+	switch route := r.Method + " " + r.URL.Path; route {
+	case "GET /users":
+		v = a.users()
+	case "GET /rooms":
+		v = a.rooms()
+	case "GET /peers":
+		v = a.peers()
+	case "GET /tracks":
+		v = a.tracks()
+	case "GET /subscriptions":
+		v = a.subscriptions()
+	case "GET /stats":
+		v, err = a.stats(r.URL.Query().Get("peer"))
+	case "GET /runtime":
+		v = a.runtime()
+	case "POST /kick":
+		var req adminKickRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			err = a.kick(req)
+		}
+	case "POST /unsubscribe":
+		var req adminUnsubscribeRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			err = a.unsubscribe(req)
+		}
+	case "POST /mute":
+		var req adminMuteRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			err = a.Raven.SFU.SetMuted(req.Track, req.Muted)
+		}
+	case "GET /recordings":
+		v, err = a.recordings()
+	case "POST /recordings/start":
+		var req adminRecordingRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			err = a.startRecording(req)
+		}
+	case "POST /recordings/stop":
+		var req adminRecordingRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			v, err = a.stopRecording(req)
+		}
+	case "POST /replay":
+		var req adminReplayRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			v, err = a.replay(req)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.Token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *Admin) users() []AdminUser {
+	ra := a.Raven
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	users := make([]AdminUser, 0, len(ra.users))
+	for name, u := range ra.users {
+		users = append(users, AdminUser{
+			Name: name,
+			Room: u.room.name,
+			Peer: u.peer() != nil,
+		})
+	}
+	return users
+}
+
+func (a *Admin) rooms() []AdminRoom {
+	ra := a.Raven
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	rooms := make([]AdminRoom, 0, len(ra.rooms))
+	for name, r := range ra.rooms {
+		rooms = append(rooms, AdminRoom{
+			Name:      name,
+			Users:     r.userNames(),
+			AudioOnly: r.audioOnly,
+		})
+	}
+	return rooms
+}
+
+func (a *Admin) peers() []AdminPeer {
+	s := a.Raven.SFU
+	peers := []AdminPeer{}
+	for _, pc := range s.Peers() {
+		id, _ := s.PeerID(pc)
+		peers = append(peers, AdminPeer{
+			ID:              id,
+			ConnectionState: pc.ConnectionState().String(),
+		})
+	}
+	return peers
+}
+
+func (a *Admin) tracks() []sfu.TrackInfo {
+	return a.Raven.SFU.TrackInfos()
+}
+
+func (a *Admin) subscriptions() []AdminSubscription {
+	subs := []AdminSubscription{}
+	for track, peers := range a.Raven.SFU.Subscriptions() {
+		for _, peer := range peers {
+			subs = append(subs, AdminSubscription{Track: track, Peer: peer})
+		}
+	}
+	return subs
+}
+
+func (a *Admin) stats(peerID string) (any, error) {
+	pc, ok := a.Raven.SFU.Peer(peerID)
+	if !ok {
+		return nil, sfu.ErrPeerNotRegistered
+	}
+	return pc.GetStats(), nil
+}
+
+func (a *Admin) runtime() AdminRuntime {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return AdminRuntime{
+		Goroutines: runtime.NumGoroutine(),
+		CPUSeconds: utils.CPUTime().Seconds(),
+		HeapBytes:  mem.HeapAlloc,
+		Peers:      len(a.Raven.SFU.Peers()),
+		Tracks:     len(a.Raven.SFU.Tracks()),
+	}
+}
+
+func (a *Admin) kick(req adminKickRequest) error {
+	u, ok := a.Raven.user(req.User)
+	if !ok {
+		return errUserNotFound
+	}
+	u.kick(req.Reason)
+	return nil
+}
+
+func (a *Admin) unsubscribe(req adminUnsubscribeRequest) error {
+	pc, ok := a.Raven.SFU.Peer(req.Peer)
+	if !ok {
+		return sfu.ErrPeerNotRegistered
+	}
+	return a.Raven.SFU.Unsubscribe(pc, req.Track)
+}
+
+func (a *Admin) recordings() ([]string, error) {
+	if a.Raven.Recorder == nil {
+		return nil, errRecordingDisabled
+	}
+	return a.Raven.Recorder.Active(), nil
+}
+
+func (a *Admin) startRecording(req adminRecordingRequest) error {
+	r, ok := a.Raven.room(req.Room)
+	if !ok {
+		return errRoomNotFound
+	}
+	return a.Raven.startRecording(r, "")
+}
+
+func (a *Admin) stopRecording(req adminRecordingRequest) (any, error) {
+	r, ok := a.Raven.room(req.Room)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	return a.Raven.stopRecording(r, "")
+}
+
+// replay publishes a captured track into the SFU.
+func (a *Admin) replay(req adminReplayRequest) (any, error) {
+	path, err := a.capturePath(req.File)
+	if err != nil {
+		return nil, err
+	}
+	c, err := rtpcapture.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	owner := req.Owner
+	if owner == "" {
+		owner = "replay"
+	}
+	// Admins may replay under any name, which is not a user.
+	var trackID string
+	a.Raven.withTrust(owner, func() {
+		trackID, err = c.Publish(context.Background(), a.Raven.SFU, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return AdminReplay{Track: trackID}, nil
+}
+
+// capturePath resolves name within Raven.CaptureDir, refusing
+// absolute names and names leaving the directory.
+func (a *Admin) capturePath(name string) (string, error) {
+	dir := a.Raven.CaptureDir
+	if dir == "" {
+		return "", errReplayDisabled
+	}
+	name = filepath.Clean(name)
+	if name == "." || !filepath.IsLocal(name) {
+		return "", errBadCaptureName
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func decodeAdminRequest(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadAdminRequest
+	}
+	return nil
+}
+
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBadAdminRequest),
+		errors.Is(err, errBadCaptureName):
+		return http.StatusBadRequest
+	case errors.Is(err, errRecordingDisabled),
+		errors.Is(err, errReplayDisabled):
+		return http.StatusNotImplemented
+	case errors.Is(err, recording.ErrAlreadyRecording),
+		errors.Is(err, sfu.ErrAlreadySubscribed),
+		errors.Is(err, sfu.ErrTrackExists):
+		return http.StatusConflict
+	case errors.Is(err, errUserNotFound),
+		errors.Is(err, errRoomNotFound),
+		errors.Is(err, recording.ErrNotRecording),
+		errors.Is(err, fs.ErrNotExist),
+		errors.Is(err, sfu.ErrPeerNotRegistered),
+		errors.Is(err, sfu.ErrTrackNotFound),
+		errors.Is(err, sfu.ErrNotSubscribed):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
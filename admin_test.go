@@ -0,0 +1,226 @@
+package raven_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype"
+	"github.com/ravenbox/raven-prototype/pkg/client"
+	"github.com/ravenbox/raven-prototype/pkg/recording"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+const adminToken = "secret"
+
+// newAdmin starts a server with an admin API, and returns the Raven,
+// the websocket URL of the server and the URL of the admin API.
+func newAdmin(t *testing.T) (*raven.Raven, string, string) {
+	t.Helper()
+	ra := raven.NewRaven(sfu.NewSFU())
+	srv := httptest.NewServer(ra)
+	t.Cleanup(srv.Close)
+	admin := httptest.NewServer(raven.NewAdmin(ra, adminToken))
+	t.Cleanup(admin.Close)
+	return ra, "ws" + strings.TrimPrefix(srv.URL, "http"), admin.URL
+}
+
+// adminDo sends a request to the admin API, and decodes the response
+// into v if it is not nil. It returns the status code.
+func adminDo(t *testing.T, url, token, method, path string, body, v any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func Test_AdminUnauthorized(t *testing.T) {
+	ra, _, url := newAdmin(t)
+	for _, token := range []string{"", "wrong"} {
+		if got := adminDo(t, url, token, "GET", "/users", nil, nil); got != http.StatusUnauthorized {
+			t.Errorf("Got status %d with token %q, want %d", got, token, http.StatusUnauthorized)
+		}
+	}
+
+	// An admin API without a token is closed.
+	open := httptest.NewServer(raven.NewAdmin(ra, ""))
+	defer open.Close()
+	if got := adminDo(t, open.URL, "", "GET", "/users", nil, nil); got != http.StatusUnauthorized {
+		t.Errorf("Got status %d without a token, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func Test_AdminRoutes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, wsURL, url := newAdmin(t)
+
+	alice := dial(t, ctx, wsURL, "alice", "admin")
+	bob := dial(t, ctx, wsURL, "bob", "admin")
+	audio, err := alice.Publish(ctx, client.Opus, "audio", sfu.SourceMicrophone,
+		&client.CounterFrames{Size: 80, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish audio:", err)
+	}
+	defer audio.Stop()
+	info, err := bob.WaitTrack(ctx, byOwner("alice", sfu.SourceMicrophone))
+	if err != nil {
+		t.Fatal("Track not announced:", err)
+	}
+	if _, err := bob.Subscribe(ctx, info.ID); err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	get := func(path string, v any) {
+		t.Helper()
+		if got := adminDo(t, url, adminToken, "GET", path, nil, v); got != http.StatusOK {
+			t.Fatalf("GET %s: got status %d", path, got)
+		}
+	}
+
+	var users []raven.AdminUser
+	get("/users", &users)
+	slices.SortFunc(users, func(a, b raven.AdminUser) int { return strings.Compare(a.Name, b.Name) })
+	want := []raven.AdminUser{{"alice", "admin", true}, {"bob", "admin", true}}
+	if !slices.Equal(users, want) {
+		t.Errorf("Got users %+v, want %+v", users, want)
+	}
+
+	var rooms []raven.AdminRoom
+	get("/rooms", &rooms)
+	if len(rooms) != 1 || rooms[0].Name != "admin" || len(rooms[0].Users) != 2 {
+		t.Errorf("Got rooms %+v", rooms)
+	}
+
+	var peers []raven.AdminPeer
+	get("/peers", &peers)
+	if len(peers) != 2 {
+		t.Errorf("Got peers %+v, want alice and bob", peers)
+	}
+
+	var tracks []sfu.TrackInfo
+	get("/tracks", &tracks)
+	if len(tracks) != 1 || tracks[0].ID != info.ID {
+		t.Errorf("Got tracks %+v, want %s", tracks, info.ID)
+	}
+
+	var subs []raven.AdminSubscription
+	get("/subscriptions", &subs)
+	wantSubs := []raven.AdminSubscription{{Track: info.ID, Peer: "bob"}}
+	if !slices.Equal(subs, wantSubs) {
+		t.Errorf("Got subscriptions %+v, want %+v", subs, wantSubs)
+	}
+
+	var stats map[string]any
+	get("/stats?peer=bob", &stats)
+	if len(stats) == 0 {
+		t.Error("Got empty stats")
+	}
+
+	var rt raven.AdminRuntime
+	get("/runtime", &rt)
+	if rt.Goroutines == 0 || rt.Peers != 2 || rt.Tracks != 1 {
+		t.Errorf("Got runtime %+v", rt)
+	}
+
+	post := func(path string, body any, want int) {
+		t.Helper()
+		if got := adminDo(t, url, adminToken, "POST", path, body, nil); got != want {
+			t.Fatalf("POST %s: got status %d, want %d", path, got, want)
+		}
+	}
+
+	post("/mute", map[string]any{"track": info.ID, "muted": true}, http.StatusNoContent)
+	if _, err := bob.WaitTrack(ctx, func(i sfu.TrackInfo) bool { return i.ID == info.ID && i.ServerMuted }); err != nil {
+		t.Error("Mute not announced:", err)
+	}
+
+	unsubscribe := map[string]any{"peer": "bob", "track": info.ID}
+	post("/unsubscribe", unsubscribe, http.StatusNoContent)
+	get("/subscriptions", &subs)
+	if len(subs) != 0 {
+		t.Errorf("Got subscriptions %+v after unsubscribing", subs)
+	}
+	post("/unsubscribe", unsubscribe, http.StatusNotFound)
+
+	post("/kick", map[string]any{"user": "bob", "reason": "test"}, http.StatusNoContent)
+	select {
+	case <-bob.Done():
+	case <-ctx.Done():
+		t.Fatal("Kicked user not disconnected")
+	}
+	post("/kick", map[string]any{"user": "bob"}, http.StatusNotFound)
+}
+
+func Test_AdminErrorStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	ra, wsURL, url := newAdmin(t)
+	dial(t, ctx, wsURL, "alice", "admin")
+
+	for _, tc := range []struct {
+		name         string
+		method, path string
+		body         any
+		want         int
+	}{
+		{"unknown route", "GET", "/nope", nil, http.StatusNotFound},
+		{"malformed body", "POST", "/kick", "{", http.StatusBadRequest},
+		{"unknown user", "POST", "/kick", map[string]any{"user": "nobody"}, http.StatusNotFound},
+		{"unknown peer", "GET", "/stats?peer=nobody", nil, http.StatusNotFound},
+		{"unknown track", "POST", "/mute", map[string]any{"track": "nope"}, http.StatusNotFound},
+		{"recording disabled", "GET", "/recordings", nil, http.StatusNotImplemented},
+		{"replay disabled", "POST", "/replay", map[string]any{"file": "capture"}, http.StatusNotImplemented},
+	} {
+		if got := adminDo(t, url, adminToken, tc.method, tc.path, tc.body, nil); got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	ra.Recorder = recording.NewRecorder(ra.SFU, t.TempDir())
+	ra.CaptureDir = t.TempDir()
+	for _, tc := range []struct {
+		name         string
+		method, path string
+		body         any
+		want         int
+	}{
+		{"unknown room", "POST", "/recordings/start", map[string]any{"room": "nope"}, http.StatusNotFound},
+		{"recording", "POST", "/recordings/start", map[string]any{"room": "admin"}, http.StatusNoContent},
+		{"already recording", "POST", "/recordings/start", map[string]any{"room": "admin"}, http.StatusConflict},
+		{"missing capture", "POST", "/replay", map[string]any{"file": "capture"}, http.StatusNotFound},
+		{"capture outside", "POST", "/replay", map[string]any{"file": "../capture"}, http.StatusBadRequest},
+		{"absolute capture", "POST", "/replay", map[string]any{"file": "/etc/passwd"}, http.StatusBadRequest},
+	} {
+		if got := adminDo(t, url, adminToken, tc.method, tc.path, tc.body, nil); got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	adminDo(t, url, adminToken, "POST", "/recordings/stop", map[string]any{"room": "admin"}, nil)
+}
@@ -0,0 +1,481 @@
+package raven
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+	"github.com/ravenbox/raven-prototype/pkg/negotiation"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// roomsTopic carries the messages broadcast to rooms, so that users of
+// a room connected to different nodes all receive them.
+const roomsTopic = "raven.rooms"
+
+// How long a node has to take over the PeerConnection of a user.
+const peerRequestTimeout = 5 * time.Second
+
+var (
+	errNoBus           = errors.New("not connected to other nodes")
+	errNodeUnavailable = errors.New("node unavailable")
+)
+
+// peersTopic carries the requests for PeerConnections on node, see
+// peerRequest.
+func peersTopic(node string) string {
+	return "raven.peers." + node
+}
+
+// userTopic carries the errors, forwarding updates and tracks of user
+// from the node hosting its PeerConnection to the node of its
+// websocket.
+func userTopic(user string) string {
+	return "raven.users." + user
+}
+
+// signalsTopic carries the signals of the PeerConnection of user
+// hosted on another node, to the node of its websocket if toClient.
+func signalsTopic(user string, toClient bool) string {
+	if toClient {
+		return "raven.signals." + user + ".client"
+	}
+	return "raven.signals." + user + ".peer"
+}
+
+// roomMessage is a message for the users of Room on every node.
+type roomMessage struct {
+	Room    string           `json:"room"`
+	Message WebsocketMessage `json:"message"`
+}
+
+// msgPresence tells the users of a room that User came or left.
+type msgPresence struct {
+	User   string `json:"user"`
+	Online bool   `json:"online"`
+}
+
+func (msgPresence) MessageType() string { return "presence" }
+
+// ConnectBus shares chat, presence, active speakers and tracks of the rooms of ra
+// with the other nodes on b. If ra has a NodeID, it also hosts the PeerConnections
+// of users connected to other nodes which ask for it.
+func (ra *Raven) ConnectBus(b bus.Bus) error {
+	if _, err := b.Subscribe(roomsTopic, ra.onRoomMessage); err != nil {
+		return err
+	}
+	if ra.NodeID != "" {
+		if _, err := b.Subscribe(peersTopic(ra.NodeID), ra.onPeerRequest); err != nil {
+			return err
+		}
+	}
+	ra.mu.Lock()
+	ra.bus = b
+	ra.mu.Unlock()
+	return nil
+}
+
+// broadcast sends msg to the users of room on all nodes.
+func (ra *Raven) broadcast(room string, msg WebsocketMessagePayload) {
+	ra.mu.Lock()
+	b := ra.bus
+	r, exists := ra.rooms[room]
+	ra.mu.Unlock()
+	if b == nil {
+		if exists {
+			r.broadcast(msg)
+		}
+		return
+	}
+	wsMsg, err := EncodeWebsocketMessage(msg)
+	if err != nil {
+		log.Println("error:", err)
+		return
+	}
+	buf, err := json.Marshal(roomMessage{Room: room, Message: wsMsg})
+	if err == nil {
+		err = b.Publish(context.Background(), roomsTopic, buf)
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// onRoomMessage delivers a message of the bus to the local users of
+// its room. This node's own messages come back this way too.
+func (ra *Raven) onRoomMessage(_ string, data []byte) {
+	var msg roomMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Println("error:", err)
+		return
+	}
+	r, exists := ra.room(msg.Room)
+	if !exists {
+		return
+	}
+	if err := Match(msg.Message, func(m msgChatMessage) { r.broadcast(m) }); err != nil {
+		log.Println("error:", err)
+	}
+	if err := Match(msg.Message, func(m msgPresence) { r.broadcast(m) }); err != nil {
+		log.Println("error:", err)
+	}
+	if err := Match(msg.Message, func(m msgActiveSpeaker) { r.broadcast(m) }); err != nil {
+		log.Println("error:", err)
+	}
+	if err := Match(msg.Message, func(m msgTrackInfo) { r.broadcast(m) }); err != nil {
+		log.Println("error:", err)
+	}
+	if err := Match(msg.Message, func(m msgTrackEnded) { r.broadcast(m) }); err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// peerRequest asks a node to host the PeerConnection of User, whose
+// websocket is connected to another node. The node answers on Reply
+// once it handles the signals of User. Close closes it again.
+//
+// The node authorizes the PeerConnection with the Permissions of User
+// in Room, which Update replaces. Command is a websocket message of
+// User for its PeerConnection, such as subscribe.
+type peerRequest struct {
+	User            string            `json:"user"`
+	Room            string            `json:"room"`
+	AudioOnly       bool              `json:"audio_only"`
+	MaxScreenShares int               `json:"max_screen_shares"`
+	Permissions     Permissions       `json:"permissions"`
+	InBand          bool              `json:"in_band"`
+	Reply           string            `json:"reply"`
+	Close           bool              `json:"close"`
+	Update          bool              `json:"update"`
+	Command         *WebsocketMessage `json:"command,omitempty"`
+}
+
+// grant returns what the user of req may do.
+func (req peerRequest) grant() grant {
+	return grant{
+		room:            req.Room,
+		audioOnly:       req.AudioOnly,
+		maxScreenShares: req.MaxScreenShares,
+		permissions:     req.Permissions,
+	}
+}
+
+// remotePeer is a PeerConnection hosted for a user of another node.
+type remotePeer struct {
+	user     string
+	pc       *webrtc.PeerConnection
+	signaler negotiation.Signaler
+
+	grant grant
+	mu    sync.Mutex // guards grant
+}
+
+func (p *remotePeer) getGrant() grant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.grant
+}
+
+func (p *remotePeer) close(s *sfu.SFU) {
+	s.UnregisterPeer(p.pc)
+	if err := errors.Join(p.pc.Close(), p.signaler.Close()); err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// createRemotePeer has node host the PeerConnection of u, and relays
+// the signals of u's websocket over the bus.
+func (u *user) createRemotePeer(node string, inBand bool) error {
+	u.raven.mu.Lock()
+	b := u.raven.bus
+	u.raven.mu.Unlock()
+	if b == nil {
+		return errNoBus
+	}
+	relay, err := negotiation.NewBusSignaler(b, signalsTopic(u.name, false), signalsTopic(u.name, true))
+	if err != nil {
+		return err
+	}
+	relay.OnMessage(func(s negotiation.SignalBody) { u.send(msgSignal(s)) })
+	relay.OnError(func(err error) { log.Println("error:", err) })
+	u.signaler.OnMessage(func(s negotiation.SignalBody) {
+		if err := relay.Send(s); err != nil {
+			log.Println("error:", err)
+		}
+	})
+	unsubscribeUser, err := b.Subscribe(userTopic(u.name), u.onHostMessage)
+	if err != nil {
+		relay.Close()
+		return err
+	}
+
+	// Signals are only relayed once the node listens to them.
+	reply := signalsTopic(u.name, true) + ".ready"
+	ready := make(chan struct{}, 1)
+	unsubscribe, err := b.Subscribe(reply, func(string, []byte) {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		unsubscribeUser()
+		relay.Close()
+		return err
+	}
+	defer unsubscribe()
+	req := u.peerRequest()
+	req.InBand = inBand
+	req.Reply = reply
+	if err := u.raven.publishPeerRequest(node, req); err != nil {
+		unsubscribeUser()
+		relay.Close()
+		return err
+	}
+	select {
+	case <-ready:
+	case <-time.After(peerRequestTimeout):
+		unsubscribeUser()
+		relay.Close()
+		return errNodeUnavailable
+	}
+	u.mu.Lock()
+	u.relay, u.relayNode, u.unsubscribeHost = relay, node, unsubscribeUser
+	u.mu.Unlock()
+	return nil
+}
+
+// peerRequest returns a request for the PeerConnection of u, carrying
+// what u may do in its room.
+func (u *user) peerRequest() peerRequest {
+	return peerRequest{
+		User:            u.name,
+		Room:            u.room.name,
+		AudioOnly:       u.room.audioOnly,
+		MaxScreenShares: u.room.maxScreenShares,
+		Permissions:     u.permissions(),
+	}
+}
+
+func (ra *Raven) publishPeerRequest(node string, req peerRequest) error {
+	ra.mu.Lock()
+	b := ra.bus
+	ra.mu.Unlock()
+	if b == nil {
+		return errNoBus
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return b.Publish(context.Background(), peersTopic(node), buf)
+}
+
+// updateRemotePeers tells the nodes hosting the PeerConnections of
+// users of r about their current permissions.
+func (ra *Raven) updateRemotePeers(r *room) {
+	for _, u := range r.members() {
+		u.mu.Lock()
+		node := u.relayNode
+		u.mu.Unlock()
+		if node == "" {
+			continue
+		}
+		req := u.peerRequest()
+		req.Update = true
+		if err := ra.publishPeerRequest(node, req); err != nil {
+			log.Println("error:", err)
+		}
+	}
+}
+
+// command has the node hosting the PeerConnection of u handle msg,
+// see handleCommand.
+func (u *user) command(msg WebsocketMessagePayload) {
+	wsMsg, err := EncodeWebsocketMessage(msg)
+	if err == nil {
+		err = u.raven.publishPeerRequest(u.relayNode, peerRequest{User: u.name, Command: &wsMsg})
+	}
+	if err != nil {
+		u.sendError(err)
+	}
+}
+
+// handleCommand handles a websocket message of the user of p as if it
+// came from a websocket of this node.
+func (ra *Raven) handleCommand(p *remotePeer, msg WebsocketMessage) {
+	report := func(err error) {
+		if err != nil {
+			ra.sendRemote(p.user, msgError{Message: err.Error()})
+		}
+	}
+	if err := Match(msg, func(m msgPublishTrack) { report(ra.publishTrack(p.pc, m)) }); err != nil {
+		report(err)
+	}
+	if err := Match(msg, func(m msgSubscribe) { report(ra.subscribe(p.pc, p.getGrant().room, m)) }); err != nil {
+		report(err)
+	}
+	if err := Match(msg, func(m msgUnsubscribe) { report(ra.SFU.Unsubscribe(p.pc, m.Track)) }); err != nil {
+		report(err)
+	}
+	if err := Match(msg, func(m msgSetForwarding) { report(ra.setForwarding(p.pc, m)) }); err != nil {
+		report(err)
+	}
+	if err := Match(msg, func(m msgViewport) { report(ra.setViewport(p.pc, m)) }); err != nil {
+		report(err)
+	}
+}
+
+// sendRemote sends msg to the websocket of user, whose PeerConnection
+// is hosted here.
+func (ra *Raven) sendRemote(user string, msg WebsocketMessagePayload) {
+	ra.mu.Lock()
+	b := ra.bus
+	ra.mu.Unlock()
+	wsMsg, err := EncodeWebsocketMessage(msg)
+	if err != nil {
+		log.Println("error:", err)
+		return
+	}
+	buf, err := json.Marshal(wsMsg)
+	if err == nil {
+		err = b.Publish(context.Background(), userTopic(user), buf)
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// remotePeer looks up the PeerConnection hosted for a user of another
+// node.
+func (ra *Raven) remotePeer(user string) (*remotePeer, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	p, ok := ra.remotePeers[user]
+	return p, ok
+}
+
+// onHostMessage passes the messages of the node hosting the
+// PeerConnection of u on to its websocket.
+func (u *user) onHostMessage(_ string, data []byte) {
+	var msg WebsocketMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Println("error:", err)
+		return
+	}
+	if err := Match(msg, func(m msgError) { u.send(m) }); err != nil {
+		log.Println("error:", err)
+	}
+	if err := Match(msg, func(m msgForwarding) { u.send(m) }); err != nil {
+		log.Println("error:", err)
+	}
+	if err := Match(msg, func(m msgTrackInfo) { u.send(m) }); err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// closeRemotePeer asks the node hosting the PeerConnection of u to
+// close it.
+func (u *user) closeRemotePeer() {
+	u.relay.Close()
+	u.unsubscribeHost()
+	err := u.raven.publishPeerRequest(u.relayNode, peerRequest{User: u.name, Close: true})
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// onPeerRequest hosts or closes the PeerConnection of a user of
+// another node.
+func (ra *Raven) onPeerRequest(_ string, data []byte) {
+	var req peerRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Println("error:", err)
+		return
+	}
+	if req.Command != nil || req.Update {
+		p, exists := ra.remotePeer(req.User)
+		if !exists {
+			return
+		}
+		if req.Update {
+			p.mu.Lock()
+			p.grant = req.grant()
+			p.mu.Unlock()
+		}
+		if req.Command != nil {
+			ra.handleCommand(p, *req.Command)
+		}
+		return
+	}
+	ra.mu.Lock()
+	b := ra.bus
+	previous := ra.remotePeers[req.User]
+	delete(ra.remotePeers, req.User)
+	ra.mu.Unlock()
+	if previous != nil {
+		previous.close(ra.SFU)
+	}
+	if req.Close {
+		return
+	}
+	p, err := ra.newRemotePeer(b, req)
+	if err != nil {
+		log.Println("error:", err)
+		return
+	}
+	ra.mu.Lock()
+	ra.remotePeers[req.User] = p
+	ra.mu.Unlock()
+	if err := b.Publish(context.Background(), req.Reply, nil); err != nil {
+		log.Println("error:", err)
+	}
+	// The tracks this PeerConnection may subscribe to.
+	for _, info := range ra.SFU.TrackInfos() {
+		if room, ok := ra.trackRoom(info.ID); ok && room == req.Room && info.Owner != req.User {
+			ra.sendRemote(req.User, msgTrackInfo(info))
+		}
+	}
+}
+
+func (ra *Raven) newRemotePeer(b bus.Bus, req peerRequest) (*remotePeer, error) {
+	api := ra.SFU.API
+	if req.AudioOnly {
+		api = ra.SFU.AudioAPI
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	busSignaler, err := negotiation.NewBusSignaler(b, signalsTopic(req.User, true), signalsTopic(req.User, false))
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	p := &remotePeer{user: req.User, pc: pc, signaler: busSignaler, grant: req.grant()}
+	if req.InBand {
+		dcSignaler, err := negotiation.NewDataChannelSignaler(pc, busSignaler)
+		if err != nil {
+			pc.Close()
+			busSignaler.Close()
+			return nil, err
+		}
+		p.signaler = dcSignaler
+	}
+	opts := []negotiation.Option{
+		negotiation.Polite,
+		negotiation.Direction(sfu.Direction),
+	}
+	if ra.NegotiatorOptions != nil {
+		opts = append(opts, ra.NegotiatorOptions(req.Room)...)
+	}
+	ra.SFU.RegisterPeer(req.User, pc)
+	negotiation.NewRegisteredNegotiator(pc, p.signaler, opts...)
+	return p, nil
+}
@@ -0,0 +1,98 @@
+package raven
+
+import (
+	"github.com/ravenbox/raven-prototype/pkg/cascade"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// JoinCluster shares the rooms and tracks of ra with the other nodes
+// of node's cluster. Users are told about the tracks of their room on
+// all nodes, and subscribing to a track of another node relays it.
+func (ra *Raven) JoinCluster(node *cascade.Node) {
+	node.Room = func(info sfu.TrackInfo) string {
+		if g, ok := ra.grant(info.Owner); ok {
+			return g.room
+		}
+		return ""
+	}
+	ra.mu.Lock()
+	ra.node = node
+	members := make(map[string]string, len(ra.users)) // name -> room
+	for name, u := range ra.users {
+		members[name] = u.room.name
+	}
+	ra.mu.Unlock()
+	for name, room := range members {
+		node.Join(room, name)
+	}
+	node.Directory.Watch(ra.onClusterEvent)
+}
+
+// onClusterEvent forwards changes of tracks on other nodes to the
+// users of their room.
+func (ra *Raven) onClusterEvent(e cascade.Event) {
+	if e.Type != cascade.EventTrackAdded && e.Type != cascade.EventTrackRemoved {
+		return
+	}
+	ra.mu.Lock()
+	node := ra.node
+	r, exists := ra.rooms[e.Track.Room]
+	ra.mu.Unlock()
+	if !exists || e.Track.Node == node.ID {
+		return
+	}
+	switch e.Type {
+	case cascade.EventTrackAdded:
+		r.broadcast(msgTrackInfo(e.Track.Info))
+	case cascade.EventTrackRemoved:
+		r.broadcast(msgTrackEnded{ID: e.Track.Info.ID, Owner: e.Track.Info.Owner})
+	}
+}
+
+// remoteOwner reports whether owner publishes tracks on another node,
+// which are relayed here under its name.
+func (ra *Raven) remoteOwner(owner string) bool {
+	node, ok := ra.clusterNode()
+	if !ok {
+		return false
+	}
+	for _, t := range node.Directory.Tracks() {
+		if t.Info.Owner == owner && t.Node != node.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterNode returns the node ra is part of, if any.
+func (ra *Raven) clusterNode() (*cascade.Node, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.node, ra.node != nil
+}
+
+// relay makes a track of another node available to subscribe to.
+func (ra *Raven) relay(trackID string) error {
+	node, ok := ra.clusterNode()
+	if !ok {
+		return nil
+	}
+	if _, err := ra.SFU.TrackInfo(trackID); err == nil {
+		return nil
+	}
+	return node.Relay(trackID)
+}
+
+// sendRemoteTrackInfos tells u about the tracks published in its room
+// on other nodes.
+func (u *user) sendRemoteTrackInfos() {
+	node, ok := u.raven.clusterNode()
+	if !ok {
+		return
+	}
+	for _, t := range node.Directory.Tracks() {
+		if t.Node != node.ID && t.Room == u.room.name {
+			u.send(msgTrackInfo(t.Info))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/ravenbox/raven-prototype"
+	"github.com/ravenbox/raven-prototype/pkg/bench"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+const benchUsage = `usage: raven bench [flags] scenario.json
+
+Runs the simulated clients of the scenario against a Raven server.
+Without -url a server is started in-process on localhost; its CPU and
+goroutine numbers then include the clients. An external server is
+sampled through its admin API if -admin is given, using the token in
+RAVEN_ADMIN_TOKEN.
+
+`
+
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	url := flags.String("url", "", "websocket URL of the server, e.g. ws://127.0.0.1:8000/")
+	adminURL := flags.String("admin", "", "admin API URL of the server, e.g. http://127.0.0.1:8001")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), benchUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	sc, err := bench.LoadScenario(flags.Arg(0))
+	if err != nil {
+		log.Fatalln("Error loading scenario:", err)
+	}
+	opts := bench.Options{URL: *url}
+	switch {
+	case *url == "":
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatalln("Error listening:", err)
+		}
+		go http.Serve(ln, raven.NewRaven(sfu.NewSFU()))
+		opts.URL = "ws://" + ln.Addr().String() + "/"
+		opts.Stats = bench.LocalStats
+	case *adminURL != "":
+		opts.Stats = bench.AdminStats(*adminURL, os.Getenv("RAVEN_ADMIN_TOKEN"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := bench.Run(ctx, sc, opts)
+	if err != nil {
+		log.Fatalln("Error running benchmark:", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+}
@@ -3,18 +3,110 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/ravenbox/raven-prototype"
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+	"github.com/ravenbox/raven-prototype/pkg/cascade"
+	"github.com/ravenbox/raven-prototype/pkg/recording"
+	"github.com/ravenbox/raven-prototype/pkg/rtpcapture"
 	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/store"
+	"github.com/ravenbox/raven-prototype/pkg/wish"
 )
 
 func main() {
-	sfu := sfu.NewSFU()
-	raven := raven.NewRaven(sfu)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+
+	s := sfu.NewSFU()
+	ra := raven.NewRaven(s)
+	if dir := os.Getenv("RAVEN_CAPTURE_DIR"); dir != "" {
+		s.Capturer = rtpcapture.Dir(dir)
+		ra.CaptureDir = dir
+	}
+	if dir := os.Getenv("RAVEN_RECORDING_DIR"); dir != "" {
+		ra.Recorder = recording.NewRecorder(s, dir)
+	}
+	if path := os.Getenv("RAVEN_DB"); path != "" {
+		db, err := store.OpenSQLite(path)
+		if err != nil {
+			log.Panicln("Failed to open database:", err)
+		}
+		defer db.Close()
+		ra.Store = db
+	}
+
+	if token := os.Getenv("RAVEN_ADMIN_TOKEN"); token != "" {
+		admin := raven.NewAdmin(ra, token)
+		go func() {
+			log.Println("Starting admin API...")
+			err := http.ListenAndServe("127.0.0.1:8001", admin)
+			if err != nil {
+				log.Panicln("Bruh", err)
+			}
+		}()
+	}
+
+	// Sessions of WHIP and WHEP are authorized by their tokens, and
+	// cascade relays of other nodes come in over WHEP.
+	ra.TrustPeer = func(peerID string) bool {
+		return strings.HasPrefix(peerID, "whip-") || strings.HasPrefix(peerID, "whep-")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", ra)
+	if token := os.Getenv("RAVEN_WHIP_TOKEN"); token != "" {
+		whip := wish.NewWHIP(s)
+		whip.Authorize = wish.BearerToken(token)
+		h := http.StripPrefix("/whip", whip)
+		mux.Handle("/whip", h)
+		mux.Handle("/whip/", h)
+	}
+	if token := os.Getenv("RAVEN_WHEP_TOKEN"); token != "" {
+		whep := wish.NewWHEP(s)
+		whep.Authorize = wish.BearerToken(token)
+		whep.Tracks = func(r *http.Request) ([]string, error) {
+			// Watch a whole room with /whep?room=lobby.
+			if room := r.URL.Query().Get("room"); room != "" {
+				return ra.RoomTracks(room), nil
+			}
+			return r.URL.Query()["track"], nil
+		}
+		h := http.StripPrefix("/whep", whep)
+		mux.Handle("/whep", h)
+		mux.Handle("/whep/", h)
+	}
+
+	if addr := os.Getenv("RAVEN_REDIS_ADDR"); addr != "" {
+		b, err := bus.DialRedis(addr, os.Getenv("RAVEN_REDIS_PASSWORD"))
+		if err != nil {
+			log.Panicln("Failed to connect to Redis:", err)
+		}
+		defer b.Close()
+		ra.NodeID = os.Getenv("RAVEN_NODE_ID")
+		if err := ra.ConnectBus(b); err != nil {
+			log.Panicln("Failed to subscribe:", err)
+		}
+		// Relaying tracks between nodes needs the WHEP endpoint, e.g.
+		// RAVEN_NODE_URL=http://10.0.0.1:8000/whep.
+		if id := os.Getenv("RAVEN_NODE_ID"); id != "" {
+			dir, err := cascade.NewBusDirectory(b, id)
+			if err != nil {
+				log.Panicln("Failed to join the cluster:", err)
+			}
+			node := cascade.NewNode(id, os.Getenv("RAVEN_NODE_URL"), s, dir)
+			node.Token = os.Getenv("RAVEN_WHEP_TOKEN")
+			defer node.Close()
+			ra.JoinCluster(node)
+		}
+	}
 
 	log.Println("Starting server...")
 
-	err := http.ListenAndServe("127.0.0.1:8000", raven)
+	err := http.ListenAndServe("127.0.0.1:8000", mux)
 	if err != nil {
 		log.Panicln("Bruh", err)
 	}
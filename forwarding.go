@@ -0,0 +1,89 @@
+package raven
+
+import (
+	"errors"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// msgSetForwarding limits the video the user receives in large rooms.
+// Pinned are user names, OnScreen the ids of tracks the user displays.
+type msgSetForwarding sfu.ForwardingPolicy
+
+func (msgSetForwarding) MessageType() string { return "set_forwarding" }
+
+func (u *user) wsSetForwarding(msg msgSetForwarding) {
+	if u.relay != nil {
+		u.command(msg)
+		return
+	}
+	if u.webrtc == nil {
+		u.sendError(sfu.ErrPeerNotRegistered)
+		return
+	}
+	if err := u.raven.setForwarding(u.webrtc, msg); err != nil {
+		u.sendError(err)
+	}
+}
+
+func (ra *Raven) setForwarding(pc *webrtc.PeerConnection, msg msgSetForwarding) error {
+	return ra.SFU.SetForwardingPolicy(pc, sfu.ForwardingPolicy(msg))
+}
+
+// msgForwarding tells the user which of its subscriptions are paused,
+// e.g. to show an avatar instead of a frozen picture.
+type msgForwarding struct {
+	Paused []string `json:"paused"`
+}
+
+func (msgForwarding) MessageType() string { return "forwarding" }
+
+func (ra *Raven) onForwarding(peerID string, paused []string) {
+	if u, ok := ra.user(peerID); ok {
+		u.send(msgForwarding{Paused: paused})
+	} else if _, ok := ra.remotePeer(peerID); ok {
+		ra.sendRemote(peerID, msgForwarding{Paused: paused})
+	}
+}
+
+// trackViewport is how the user displays one of its subscriptions.
+type trackViewport struct {
+	ID string `json:"id"`
+	sfu.Viewport
+}
+
+// msgViewport reports how the user displays its subscriptions, so that
+// video is sent at the size it is rendered at, or not at all.
+type msgViewport struct {
+	Tracks []trackViewport `json:"tracks"`
+}
+
+func (msgViewport) MessageType() string { return "viewport" }
+
+func (u *user) wsViewport(msg msgViewport) {
+	if u.relay != nil {
+		u.command(msg)
+		return
+	}
+	if u.webrtc == nil {
+		u.sendError(sfu.ErrPeerNotRegistered)
+		return
+	}
+	if err := u.raven.setViewport(u.webrtc, msg); err != nil {
+		u.sendError(err)
+	}
+}
+
+// setViewport applies the viewports of all tracks of msg, joining the
+// errors of those that fail.
+func (ra *Raven) setViewport(pc *webrtc.PeerConnection, msg msgViewport) error {
+	var errs []error
+	for _, t := range msg.Tracks {
+		if err := ra.SFU.SetViewport(pc, t.ID, t.Viewport); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
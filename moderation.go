@@ -0,0 +1,239 @@
+package raven
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Role of a user within a room. Roles are ordered: an owner outranks
+// moderators, who outrank members.
+type Role string
+
+const (
+	RoleMember    Role = "member"
+	RoleModerator Role = "moderator"
+	RoleOwner     Role = "owner"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 2
+	case RoleModerator:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// canModerate reports whether a user with role r may moderate a user
+// with role target. Whether the user may moderate at all is decided
+// by its Permissions.
+func (r Role) canModerate(target Role) bool {
+	return target == RoleMember || r.rank() > target.rank()
+}
+
+var (
+	errNotPermitted  = errors.New("not permitted")
+	errBanned        = errors.New("banned from room")
+	errUserNotInRoom = errors.New("user not in room")
+)
+
+// Close code sent to kicked users, in the private-use range.
+const closeKicked = 4000
+
+type msgMuteTrack struct {
+	Track string `json:"track"`
+	Muted bool   `json:"muted"`
+}
+
+func (msgMuteTrack) MessageType() string { return "mute_track" }
+
+type msgUnpublishTrack struct {
+	Track string `json:"track"`
+}
+
+func (msgUnpublishTrack) MessageType() string { return "unpublish_track" }
+
+type msgKick struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+func (msgKick) MessageType() string { return "kick" }
+
+type msgBan struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+func (msgBan) MessageType() string { return "ban" }
+
+type msgSetRole struct {
+	User string `json:"user"`
+	Role Role   `json:"role"`
+}
+
+func (msgSetRole) MessageType() string { return "set_role" }
+
+// msgModeration announces a moderation action to the room.
+type msgModeration struct {
+	Action string `json:"action"`
+	Actor  string `json:"actor"`
+	Target string `json:"target,omitempty"`
+	Track  string `json:"track,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Muted  bool   `json:"muted,omitempty"`
+	Role   Role   `json:"role,omitempty"`
+}
+
+func (msgModeration) MessageType() string { return "moderation" }
+
+type msgError struct {
+	Message string `json:"message"`
+}
+
+func (msgError) MessageType() string { return "error" }
+
+// authorizeOn checks that u may moderate the user called target in
+// its room.
+func (u *user) authorizeOn(target string) error {
+	actor := u.room.role(u.name)
+	if !actor.canModerate(u.room.role(target)) {
+		return errNotPermitted
+	}
+	return nil
+}
+
+// authorizeOnTrack checks that u may moderate the publisher of trackID.
+func (u *user) authorizeOnTrack(trackID string) (owner string, err error) {
+	owner, err = u.raven.SFU.TrackOwner(trackID)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := u.roomUser(owner); !ok {
+		return "", errNotPermitted
+	}
+	return owner, u.authorizeOn(owner)
+}
+
+// roomUser looks up the user called name in u's room.
+func (u *user) roomUser(name string) (*user, bool) {
+	target, ok := u.raven.user(name)
+	return target, ok && target.room == u.room
+}
+
+func (u *user) wsMuteTrack(msg msgMuteTrack) {
+	owner, err := u.authorizeOnTrack(msg.Track)
+	if err != nil {
+		u.sendError(err)
+		return
+	}
+	if err := u.raven.SFU.SetMuted(msg.Track, msg.Muted); err != nil {
+		u.sendError(err)
+		return
+	}
+	u.room.broadcast(msgModeration{
+		Action: "mute_track",
+		Actor:  u.name,
+		Target: owner,
+		Track:  msg.Track,
+		Muted:  msg.Muted,
+	})
+}
+
+func (u *user) wsUnpublishTrack(msg msgUnpublishTrack) {
+	owner, err := u.authorizeOnTrack(msg.Track)
+	if err != nil {
+		u.sendError(err)
+		return
+	}
+	if err := u.raven.SFU.Unpublish(msg.Track); err != nil {
+		u.sendError(err)
+		return
+	}
+	u.room.broadcast(msgModeration{
+		Action: "unpublish_track",
+		Actor:  u.name,
+		Target: owner,
+		Track:  msg.Track,
+	})
+}
+
+func (u *user) wsKick(msg msgKick) {
+	if err := u.authorizeOn(msg.User); err != nil {
+		u.sendError(err)
+		return
+	}
+	target, ok := u.roomUser(msg.User)
+	if !ok {
+		u.sendError(errUserNotInRoom)
+		return
+	}
+	u.room.broadcast(msgModeration{
+		Action: "kick",
+		Actor:  u.name,
+		Target: msg.User,
+		Reason: msg.Reason,
+	})
+	target.kick(msg.Reason)
+}
+
+// wsBan bans a user from the room. Users who are not in the room are
+// banned all the same, but only the actor hears of it.
+func (u *user) wsBan(msg msgBan) {
+	if err := u.authorizeOn(msg.User); err != nil {
+		u.sendError(err)
+		return
+	}
+	u.room.ban(msg.User, msg.Reason)
+	ban := msgModeration{
+		Action: "ban",
+		Actor:  u.name,
+		Target: msg.User,
+		Reason: msg.Reason,
+	}
+	target, ok := u.roomUser(msg.User)
+	if !ok {
+		u.send(ban)
+		return
+	}
+	u.room.broadcast(ban)
+	target.kick(msg.Reason)
+}
+
+func (u *user) wsSetRole(msg msgSetRole) {
+	// Only owners hand out roles, and ownership is not transferable.
+	if u.room.role(u.name) != RoleOwner || msg.Role == RoleOwner ||
+		msg.User == u.name {
+		u.sendError(errNotPermitted)
+		return
+	}
+	switch msg.Role {
+	case RoleModerator, RoleMember:
+	default:
+		u.sendError(errors.New("unknown role"))
+		return
+	}
+	u.room.setRole(msg.User, msg.Role)
+	u.raven.updateRemotePeers(u.room)
+	u.room.broadcast(msgModeration{
+		Action: "set_role",
+		Actor:  u.name,
+		Target: msg.User,
+		Role:   msg.Role,
+	})
+}
+
+// kick disconnects the user with a close frame carrying reason.
+func (u *user) kick(reason string) {
+	closeMsg := websocket.FormatCloseMessage(closeKicked, reason)
+	err := u.ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+	if err != nil && err != websocket.ErrCloseSent {
+		log.Println("error:", err)
+	}
+	u.close()
+}
@@ -0,0 +1,23 @@
+package raven
+
+import "testing"
+
+func Test_CanModerate(t *testing.T) {
+	roles := []Role{RoleMember, RoleModerator, RoleOwner}
+	for i, actor := range roles {
+		if got := actor.rank(); got != i {
+			t.Errorf("Got rank %d of %s, want %d", got, actor, i)
+		}
+		for j, target := range roles {
+			// Members can be moderated by anyone permitted to, others
+			// only by a higher role.
+			want := target == RoleMember || i > j
+			if got := actor.canModerate(target); got != want {
+				t.Errorf("%s moderating %s: got %v, want %v", actor, target, got, want)
+			}
+		}
+	}
+	if got := Role("unknown").rank(); got != 0 {
+		t.Errorf("Got rank %d of an unknown role, want 0", got)
+	}
+}
@@ -0,0 +1,292 @@
+package raven
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/store"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Permissions are the capabilities of a user within a room.
+type Permissions struct {
+	CanPublishAudio  bool `json:"can_publish_audio"`
+	CanPublishVideo  bool `json:"can_publish_video"`
+	CanPublishScreen bool `json:"can_publish_screen"`
+	CanSubscribe     bool `json:"can_subscribe"`
+	CanChat          bool `json:"can_chat"`
+	CanModerate      bool `json:"can_moderate"`
+}
+
+var (
+	fullPermissions = Permissions{
+		CanPublishAudio:  true,
+		CanPublishVideo:  true,
+		CanPublishScreen: true,
+		CanSubscribe:     true,
+		CanChat:          true,
+		CanModerate:      true,
+	}
+	memberPermissions = Permissions{
+		CanPublishAudio:  true,
+		CanPublishVideo:  true,
+		CanPublishScreen: true,
+		CanSubscribe:     true,
+		CanChat:          true,
+	}
+)
+
+// capability selects a single permission.
+type capability func(Permissions) bool
+
+var (
+	capSubscribe capability = func(p Permissions) bool { return p.CanSubscribe }
+	capChat      capability = func(p Permissions) bool { return p.CanChat }
+	capModerate  capability = func(p Permissions) bool { return p.CanModerate }
+)
+
+// guard wraps a websocket handler so that it only runs if the user
+// holds capability c.
+func guard[T WebsocketMessagePayload](u *user, c capability, fn func(T)) func(T) {
+	return func(msg T) {
+		if !c(u.permissions()) {
+			u.sendError(errNotPermitted)
+			return
+		}
+		fn(msg)
+	}
+}
+
+func (u *user) permissions() Permissions {
+	return u.room.permissions(u.name)
+}
+
+// grant is what a peer of the SFU may do: what its user may do in
+// its room.
+type grant struct {
+	room            string
+	audioOnly       bool
+	maxScreenShares int
+	permissions     Permissions
+}
+
+// grant looks up the grant of the user peerID, whether its websocket
+// is connected to this node or it is hosted for another one.
+func (ra *Raven) grant(peerID string) (grant, bool) {
+	if u, ok := ra.user(peerID); ok {
+		return grant{
+			room:            u.room.name,
+			audioOnly:       u.room.audioOnly,
+			maxScreenShares: u.room.maxScreenShares,
+			permissions:     u.permissions(),
+		}, true
+	}
+	if p, ok := ra.remotePeer(peerID); ok {
+		return p.getGrant(), true
+	}
+	return grant{}, false
+}
+
+// trusts reports whether peerID, which is not a user, may publish and
+// subscribe to anything: per TrustPeer, withTrust, or because it owns
+// tracks relayed from other nodes, which authorized them.
+func (ra *Raven) trusts(peerID string) bool {
+	if ra.TrustPeer != nil && ra.TrustPeer(peerID) {
+		return true
+	}
+	ra.mu.Lock()
+	trusted := ra.trusted[peerID] > 0
+	ra.mu.Unlock()
+	return trusted || ra.remoteOwner(peerID)
+}
+
+// withTrust runs fn with peerID trusted, e.g. to publish a replay on
+// behalf of an admin.
+func (ra *Raven) withTrust(peerID string, fn func()) {
+	ra.mu.Lock()
+	ra.trusted[peerID]++
+	ra.mu.Unlock()
+	defer func() {
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+		if ra.trusted[peerID]--; ra.trusted[peerID] == 0 {
+			delete(ra.trusted, peerID)
+		}
+	}()
+	fn()
+}
+
+// roomAuthorizer enforces room permissions on the SFU. Peers which do
+// not belong to a user are refused unless Raven trusts them.
+type roomAuthorizer struct {
+	raven *Raven
+}
+
+var _ sfu.Authorizer = roomAuthorizer{}
+
+func (a roomAuthorizer) CanPublish(peerID string, source sfu.TrackSource) bool {
+	g, ok := a.raven.grant(peerID)
+	if !ok {
+		return a.raven.trusts(peerID)
+	}
+	p := g.permissions
+	if g.audioOnly && (source == sfu.SourceCamera || source == sfu.SourceScreen) {
+		return false
+	}
+	switch source {
+	case sfu.SourceMicrophone:
+		return p.CanPublishAudio
+	case sfu.SourceCamera:
+		return p.CanPublishVideo
+	case sfu.SourceScreen:
+		return p.CanPublishScreen && a.screenShares(g.room) < g.maxScreenShares
+	case sfu.SourceScreenAudio:
+		return p.CanPublishScreen
+	default:
+		return false
+	}
+}
+
+// screenShares counts the screen share tracks published in room.
+func (a roomAuthorizer) screenShares(room string) int {
+	n := 0
+	for _, trackID := range a.raven.SFU.TracksBySource(sfu.SourceScreen) {
+		owner, err := a.raven.SFU.TrackOwner(trackID)
+		if err != nil {
+			continue
+		}
+		if g, ok := a.raven.grant(owner); ok && g.room == room {
+			n++
+		}
+	}
+	return n
+}
+
+// CanSubscribe only lets users subscribe to the tracks of their room.
+func (a roomAuthorizer) CanSubscribe(peerID, trackID string) bool {
+	g, ok := a.raven.grant(peerID)
+	if !ok {
+		return a.raven.trusts(peerID)
+	}
+	room, ok := a.raven.trackRoom(trackID)
+	return ok && room == g.room && g.permissions.CanSubscribe
+}
+
+type msgSetPermissions struct {
+	// User whose permissions are set. If empty, the defaults for
+	// members of the room are set instead, e.g. to turn it into a
+	// webinar where only a few speakers may publish.
+	User        string      `json:"user"`
+	Permissions Permissions `json:"permissions"`
+}
+
+func (msgSetPermissions) MessageType() string { return "set_permissions" }
+
+func (u *user) wsSetPermissions(msg msgSetPermissions) {
+	if msg.User == "" {
+		u.room.setMemberPermissions(msg.Permissions)
+	} else {
+		if err := u.authorizeOn(msg.User); err != nil {
+			u.sendError(err)
+			return
+		}
+		u.room.setPermissions(msg.User, msg.Permissions)
+	}
+	u.raven.updateRemotePeers(u.room)
+	u.room.broadcast(msgPermissions(msg))
+}
+
+// msgPermissions announces changed permissions to the room.
+type msgPermissions msgSetPermissions
+
+func (msgPermissions) MessageType() string { return "permissions" }
+
+type msgSubscribe struct {
+	Track string `json:"track"`
+}
+
+func (msgSubscribe) MessageType() string { return "subscribe" }
+
+func (u *user) wsSubscribe(msg msgSubscribe) {
+	if u.relay != nil {
+		u.command(msg)
+		return
+	}
+	if u.webrtc == nil {
+		u.sendError(sfu.ErrPeerNotRegistered)
+		return
+	}
+	if err := u.raven.subscribe(u.webrtc, u.room.name, msg); err != nil {
+		u.sendError(err)
+	}
+}
+
+// subscribe subscribes pc of a user of room to a track.
+func (ra *Raven) subscribe(pc *webrtc.PeerConnection, room string, msg msgSubscribe) error {
+	// Checked ahead of the SFU, so that tracks of other rooms are not
+	// relayed from other nodes.
+	trackRoom, ok := ra.trackRoom(msg.Track)
+	if !ok {
+		return sfu.ErrTrackNotFound
+	}
+	if trackRoom != room {
+		return errNotPermitted
+	}
+	if err := ra.relay(msg.Track); err != nil {
+		return err
+	}
+	return ra.SFU.Subscribe(pc, msg.Track)
+}
+
+type msgUnsubscribe struct {
+	Track string `json:"track"`
+}
+
+func (msgUnsubscribe) MessageType() string { return "unsubscribe" }
+
+func (u *user) wsUnsubscribe(msg msgUnsubscribe) {
+	if u.relay != nil {
+		u.command(msg)
+		return
+	}
+	if u.webrtc == nil {
+		u.sendError(sfu.ErrPeerNotRegistered)
+		return
+	}
+	if err := u.raven.SFU.Unsubscribe(u.webrtc, msg.Track); err != nil {
+		u.sendError(err)
+	}
+}
+
+type msgChat struct {
+	Text string `json:"text"`
+}
+
+func (msgChat) MessageType() string { return "chat" }
+
+// msgChatMessage relays a chat message to the room.
+type msgChatMessage struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+func (msgChatMessage) MessageType() string { return "chat" }
+
+func (u *user) wsChat(msg msgChat) {
+	_, err := u.raven.Store.AddChatMessage(context.Background(), store.ChatMessage{
+		Room:   u.room.name,
+		From:   u.name,
+		Text:   msg.Text,
+		SentAt: time.Now(),
+	})
+	if err != nil {
+		log.Println("error:", err)
+	}
+	u.raven.broadcast(u.room.name, msgChatMessage{
+		From: u.name,
+		Text: msg.Text,
+	})
+}
@@ -0,0 +1,36 @@
+package raven
+
+import (
+	"testing"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func Test_AuthorizeUnknownPeer(t *testing.T) {
+	ra := NewRaven(sfu.NewSFU())
+	a := roomAuthorizer{ra}
+	if a.CanPublish("nobody", sfu.SourceMicrophone) || a.CanSubscribe("nobody", "alice#audio") {
+		t.Error("Unknown peer was authorized")
+	}
+
+	ra.TrustPeer = func(peerID string) bool { return peerID == "whip-1" }
+	if !a.CanPublish("whip-1", sfu.SourceCamera) {
+		t.Error("Trusted peer was refused")
+	}
+	ra.withTrust("replay", func() {
+		if !a.CanPublish("replay", sfu.SourceCamera) {
+			t.Error("Peer was refused within withTrust")
+		}
+	})
+	if a.CanPublish("replay", sfu.SourceCamera) {
+		t.Error("Peer was still trusted after withTrust")
+	}
+
+	ra.remotePeers["carol"] = &remotePeer{user: "carol", grant: grant{
+		room:        "lobby",
+		permissions: Permissions{CanPublishAudio: true},
+	}}
+	if !a.CanPublish("carol", sfu.SourceMicrophone) || a.CanPublish("carol", sfu.SourceCamera) {
+		t.Error("Remote peer was not authorized by its permissions")
+	}
+}
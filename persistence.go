@@ -0,0 +1,177 @@
+package raven
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/store"
+)
+
+// Number of chat messages a joining user is sent.
+const chatHistorySize = 50
+
+// loadRoom restores the room called name from the store, or creates
+// it there if it is new. The mode of a room is chosen by whoever
+// creates it: audioOnly only applies to new rooms.
+func (ra *Raven) loadRoom(name string, audioOnly bool) *room {
+	ctx := context.Background()
+	r := newRoom(name)
+	r.store = ra.Store
+	stored, err := ra.Store.Room(ctx, name)
+	if errors.Is(err, store.ErrNotFound) {
+		r.audioOnly = audioOnly
+		r.mu.Lock()
+		r.saveSettings()
+		r.mu.Unlock()
+		return r
+	}
+	if err != nil {
+		log.Println("error:", err)
+		return r
+	}
+	if stored.MemberPermissions != nil {
+		if err := json.Unmarshal(stored.MemberPermissions, &r.memberPermissions); err != nil {
+			log.Println("error:", err)
+		}
+	}
+	if stored.MaxScreenShares > 0 {
+		r.maxScreenShares = stored.MaxScreenShares
+	}
+	r.audioOnly = stored.AudioOnly
+	memberships, err := ra.Store.Memberships(ctx, name)
+	if err != nil {
+		log.Println("error:", err)
+	}
+	for _, m := range memberships {
+		r.roles[m.User] = Role(m.Role)
+		if m.Permissions != nil {
+			var p Permissions
+			if err := json.Unmarshal(m.Permissions, &p); err != nil {
+				log.Println("error:", err)
+				continue
+			}
+			r.userPermissions[m.User] = p
+		}
+		if m.Banned {
+			r.banned[m.User] = m.BanReason
+		}
+	}
+	return r
+}
+
+// saveSettings stores the settings of r. r.mu must be held.
+func (r *room) saveSettings() {
+	if r.store == nil {
+		return
+	}
+	p, err := json.Marshal(r.memberPermissions)
+	if err == nil {
+		err = r.store.PutRoom(context.Background(), store.Room{
+			Name:              r.name,
+			MemberPermissions: p,
+			MaxScreenShares:   r.maxScreenShares,
+			AudioOnly:         r.audioOnly,
+			CreatedAt:         time.Now(),
+		})
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// saveMember stores what r knows about the user called name.
+// r.mu must be held.
+func (r *room) saveMember(name string) {
+	if r.store == nil {
+		return
+	}
+	m := store.Membership{
+		Room: r.name,
+		User: name,
+		Role: string(RoleMember),
+	}
+	if role, ok := r.roles[name]; ok {
+		m.Role = string(role)
+	}
+	if p, ok := r.userPermissions[name]; ok {
+		encoded, err := json.Marshal(p)
+		if err != nil {
+			log.Println("error:", err)
+			return
+		}
+		m.Permissions = encoded
+	}
+	m.BanReason, m.Banned = r.banned[name]
+	if err := r.store.PutMembership(context.Background(), m); err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// startSession records that u connected.
+func (ra *Raven) startSession(u *user) {
+	ctx := context.Background()
+	now := time.Now()
+	u.session = newSessionID()
+	err := ra.Store.PutUser(ctx, store.User{Name: u.name, CreatedAt: now, LastSeen: now})
+	if err == nil {
+		err = ra.Store.CreateSession(ctx, store.Session{
+			ID:        u.session,
+			User:      u.name,
+			Room:      u.room.name,
+			StartedAt: now,
+		})
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// endSession records that u disconnected.
+func (ra *Raven) endSession(u *user) {
+	ctx := context.Background()
+	now := time.Now()
+	err := ra.Store.EndSession(ctx, u.session, now)
+	if err == nil {
+		err = ra.Store.PutUser(ctx, store.User{Name: u.name, CreatedAt: now, LastSeen: now})
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// msgChatHistory carries the last messages of the room to a joining
+// user, oldest first.
+type msgChatHistory struct {
+	Messages []msgChatMessage `json:"messages"`
+}
+
+func (msgChatHistory) MessageType() string { return "chat_history" }
+
+func (u *user) sendChatHistory() {
+	history, err := u.raven.Store.ChatHistory(context.Background(), u.room.name, chatHistorySize)
+	if err != nil {
+		log.Println("error:", err)
+		return
+	}
+	if len(history) == 0 {
+		return
+	}
+	msg := msgChatHistory{Messages: make([]msgChatMessage, 0, len(history))}
+	for _, m := range history {
+		msg.Messages = append(msg.Messages, msgChatMessage{From: m.From, Text: m.Text})
+	}
+	u.send(msg)
+}
@@ -0,0 +1,318 @@
+// Package bench runs load scenarios of simulated clients against a
+// Raven server and reports how well it kept up.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/client"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/utils"
+)
+
+// ServerStats is the resource usage of the server process, as served
+// by GET /runtime of the admin API.
+type ServerStats struct {
+	Goroutines int     `json:"goroutines"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+}
+
+// StatsFunc samples the ServerStats of the server under test.
+type StatsFunc func(context.Context) (ServerStats, error)
+
+// LocalStats samples the current process, for servers running
+// in-process. Its numbers include the simulated clients.
+func LocalStats(context.Context) (ServerStats, error) {
+	return ServerStats{
+		Goroutines: runtime.NumGoroutine(),
+		CPUSeconds: utils.CPUTime().Seconds(),
+	}, nil
+}
+
+// AdminStats samples the server through its admin API at adminURL.
+func AdminStats(adminURL, token string) StatsFunc {
+	return func(ctx context.Context) (ServerStats, error) {
+		var stats ServerStats
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, adminURL+"/runtime", nil)
+		if err != nil {
+			return stats, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return stats, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return stats, fmt.Errorf("admin API: %s", res.Status)
+		}
+		err = json.NewDecoder(res.Body).Decode(&stats)
+		return stats, err
+	}
+}
+
+// Options of a benchmark run.
+type Options struct {
+	// URL of the Raven websocket endpoint.
+	URL string
+	// Stats samples the server once per second. Server stats are not
+	// reported if nil.
+	Stats StatsFunc
+}
+
+const statsInterval = time.Second
+
+type bench struct {
+	sc      Scenario
+	opts    Options
+	groupOf map[string]string // client name -> group
+
+	report    Report
+	joins     []time.Duration
+	firsts    []time.Duration
+	receivers []*client.Receiver
+	mu        sync.Mutex
+}
+
+// Run runs sc until its duration has passed after the last client
+// joined, or ctx expires.
+func Run(ctx context.Context, sc Scenario, opts Options) (*Report, error) {
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	b := &bench{
+		sc:      sc,
+		opts:    opts,
+		groupOf: make(map[string]string),
+	}
+	for _, g := range sc.Groups {
+		for i := 0; i < g.Count; i++ {
+			b.groupOf[clientName(g, i)] = g.Name
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		b.sampleStats(ctx)
+	}()
+
+	start := time.Now()
+	var (
+		clients []*client.Client
+		joined  int
+		wg      sync.WaitGroup
+	)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+join:
+	for _, g := range sc.Groups {
+		for i := 0; i < g.Count; i++ {
+			if joined > 0 {
+				select {
+				case <-ctx.Done():
+					break join
+				case <-time.After(time.Duration(sc.Ramp)):
+				}
+			}
+			joined++
+			c, err := b.join(ctx, g, i)
+			if err != nil {
+				b.fail(err)
+				continue
+			}
+			clients = append(clients, c)
+			wg.Add(1)
+			go func(g Group) {
+				defer wg.Done()
+				b.run(ctx, c, g)
+			}(g)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(sc.Duration)):
+	}
+	cancel()
+	wg.Wait()
+	<-sampled
+
+	b.report.Elapsed = time.Since(start)
+	b.report.Clients = len(clients)
+	b.summarize()
+	return &b.report, nil
+}
+
+func clientName(g Group, i int) string {
+	return fmt.Sprintf("%s-%d", g.Name, i)
+}
+
+func (b *bench) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.report.Errors++
+	if len(b.report.FirstErrors) < 10 {
+		b.report.FirstErrors = append(b.report.FirstErrors, err.Error())
+	}
+}
+
+func (b *bench) join(ctx context.Context, g Group, i int) (*client.Client, error) {
+	start := time.Now()
+	c, err := client.Dial(ctx, b.opts.URL, clientName(g, i), b.sc.Room)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.joins = append(b.joins, time.Since(start))
+	b.mu.Unlock()
+	return c, nil
+}
+
+// run publishes and subscribes on behalf of a client of g until ctx
+// expires.
+func (b *bench) run(ctx context.Context, c *client.Client, g Group) {
+	for _, spec := range g.Publish {
+		p, err := c.Publish(ctx, spec.capability(), spec.ID, spec.Source, spec.frames())
+		if err != nil {
+			b.fail(err)
+			continue
+		}
+		b.mu.Lock()
+		b.report.Publications++
+		b.mu.Unlock()
+		defer p.Stop()
+	}
+
+	expected := b.expectedTracks(g)
+	subscribed := make(map[string]bool)
+	for len(subscribed) < expected {
+		info, err := c.WaitTrack(ctx, func(info sfu.TrackInfo) bool {
+			return !subscribed[info.ID] && info.Owner != c.Name &&
+				slices.Contains(g.Subscribe, b.groupOf[info.Owner])
+		})
+		if err != nil {
+			break
+		}
+		subscribed[info.ID] = true
+		start := time.Now()
+		tr, err := c.Subscribe(ctx, info.ID)
+		if err != nil {
+			if ctx.Err() == nil {
+				b.fail(fmt.Errorf("%s: subscribe %s: %w", c.Name, info.ID, err))
+			}
+			continue
+		}
+		b.receive(ctx, start, client.Receive(tr))
+	}
+	<-ctx.Done()
+}
+
+// expectedTracks counts the tracks a client of g subscribes to.
+func (b *bench) expectedTracks(g Group) int {
+	n := 0
+	for _, other := range b.sc.Groups {
+		if !slices.Contains(g.Subscribe, other.Name) {
+			continue
+		}
+		n += other.Count * len(other.Publish)
+		if other.Name == g.Name {
+			n -= len(other.Publish)
+		}
+	}
+	return n
+}
+
+// receive keeps track of r and records its time to first packet,
+// counted from start.
+func (b *bench) receive(ctx context.Context, start time.Time, r *client.Receiver) {
+	b.mu.Lock()
+	b.receivers = append(b.receivers, r)
+	b.report.Subscriptions++
+	b.mu.Unlock()
+	go func() {
+		if err := r.WaitPackets(ctx, 1); err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.firsts = append(b.firsts, r.Stats().FirstPacketAt.Sub(start))
+		b.mu.Unlock()
+	}()
+}
+
+func (b *bench) sampleStats(ctx context.Context) {
+	if b.opts.Stats == nil {
+		return
+	}
+	sample := func() (ServerStats, bool) {
+		// The run context may be done by now.
+		sctx, cancel := context.WithTimeout(context.Background(), statsInterval)
+		defer cancel()
+		stats, err := b.opts.Stats(sctx)
+		if err != nil {
+			b.fail(fmt.Errorf("server stats: %w", err))
+			return stats, false
+		}
+		s := &b.report.Server
+		s.Sampled = true
+		s.PeakGoroutines = max(s.PeakGoroutines, stats.Goroutines)
+		return stats, true
+	}
+
+	first, ok := sample()
+	if !ok {
+		return
+	}
+	b.report.Server.StartGoroutines = first.Goroutines
+	start := time.Now()
+	last := first
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if stats, ok := sample(); ok {
+				last = stats
+			}
+			s := &b.report.Server
+			s.EndGoroutines = last.Goroutines
+			s.CPUSeconds = last.CPUSeconds - first.CPUSeconds
+			if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+				s.CPUCores = s.CPUSeconds / elapsed
+			}
+			return
+		case <-ticker.C:
+			if stats, ok := sample(); ok {
+				last = stats
+			}
+		}
+	}
+}
+
+func (b *bench) summarize() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := &b.report
+	r.JoinLatency = distribution(b.joins)
+	r.TimeToFirstPacket = distribution(b.firsts)
+	for _, recv := range b.receivers {
+		stats := recv.Stats()
+		r.PacketsReceived += stats.Packets
+		r.PacketsLost += stats.Lost
+	}
+	if total := r.PacketsReceived + r.PacketsLost; total > 0 {
+		r.LossRate = float64(r.PacketsLost) / float64(total)
+	}
+}
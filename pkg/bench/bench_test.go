@@ -0,0 +1,89 @@
+package bench_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype"
+	"github.com/ravenbox/raven-prototype/pkg/bench"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func Test_Run(t *testing.T) {
+	srv := httptest.NewServer(raven.NewRaven(sfu.NewSFU()))
+	defer srv.Close()
+
+	sc := bench.Scenario{
+		Room:     "bench",
+		Duration: bench.Duration(2 * time.Second),
+		Ramp:     bench.Duration(10 * time.Millisecond),
+		Groups: []bench.Group{
+			{
+				Name:      "speaker",
+				Count:     2,
+				Publish:   []bench.TrackSpec{{Codec: "vp8"}, {Codec: "opus"}},
+				Subscribe: []string{"speaker"},
+			},
+			{Name: "viewer", Count: 3, Subscribe: []string{"speaker"}},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	report, err := bench.Run(ctx, sc, bench.Options{
+		URL:   "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Stats: bench.LocalStats,
+	})
+	if err != nil {
+		t.Fatal("Failed to run scenario:", err)
+	}
+	var out strings.Builder
+	report.WriteText(&out)
+	t.Log("\n" + out.String())
+
+	// Each speaker gets the other's 2 tracks, each viewer all 4.
+	if report.Clients != 5 || report.Publications != 4 || report.Subscriptions != 16 {
+		t.Errorf("Unexpected counts: %+v", report)
+	}
+	if report.Errors > 0 {
+		t.Errorf("Unexpected errors: %v", report.FirstErrors)
+	}
+	if report.JoinLatency.N != 5 || report.TimeToFirstPacket.N != 16 {
+		t.Errorf("Missing samples: join %v, first packet %v",
+			report.JoinLatency, report.TimeToFirstPacket)
+	}
+	if report.PacketsReceived == 0 || !report.Server.Sampled {
+		t.Errorf("Missing stats: %+v", report)
+	}
+}
+
+func Test_ScenarioValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		sc   bench.Scenario
+		ok   bool
+	}{
+		{"no duration", bench.Scenario{}, false},
+		{"unknown group", bench.Scenario{
+			Duration: bench.Duration(time.Second),
+			Groups:   []bench.Group{{Name: "a", Subscribe: []string{"b"}}},
+		}, false},
+		{"unknown codec", bench.Scenario{
+			Duration: bench.Duration(time.Second),
+			Groups:   []bench.Group{{Name: "a", Publish: []bench.TrackSpec{{Codec: "h263"}}}},
+		}, false},
+		{"valid", bench.Scenario{
+			Duration: bench.Duration(time.Second),
+			Groups:   []bench.Group{{Name: "a", Publish: []bench.TrackSpec{{Codec: "opus"}}}},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sc.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// Report is the outcome of a benchmark run.
+type Report struct {
+	Elapsed       time.Duration `json:"elapsed"`
+	Clients       int           `json:"clients"`
+	Publications  int           `json:"publications"`
+	Subscriptions int           `json:"subscriptions"`
+
+	// JoinLatency is the time to complete the websocket handshake.
+	JoinLatency Distribution `json:"join_latency"`
+	// TimeToFirstPacket is counted from the subscribe request.
+	TimeToFirstPacket Distribution `json:"time_to_first_packet"`
+
+	PacketsReceived uint64  `json:"packets_received"`
+	PacketsLost     uint64  `json:"packets_lost"`
+	LossRate        float64 `json:"loss_rate"`
+
+	Server ServerReport `json:"server"`
+
+	Errors      int      `json:"errors"`
+	FirstErrors []string `json:"first_errors,omitempty"`
+}
+
+// ServerReport summarizes the samples of the server's ServerStats.
+type ServerReport struct {
+	Sampled         bool `json:"sampled"`
+	StartGoroutines int  `json:"start_goroutines"`
+	PeakGoroutines  int  `json:"peak_goroutines"`
+	EndGoroutines   int  `json:"end_goroutines"`
+	// CPUSeconds used during the run and the average number of cores
+	// that makes.
+	CPUSeconds float64 `json:"cpu_seconds"`
+	CPUCores   float64 `json:"cpu_cores"`
+}
+
+// Distribution summarizes a set of durations.
+type Distribution struct {
+	N   int           `json:"n"`
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	Max time.Duration `json:"max"`
+}
+
+func distribution(d []time.Duration) Distribution {
+	if len(d) == 0 {
+		return Distribution{}
+	}
+	sorted := slices.Clone(d)
+	slices.Sort(sorted)
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	return Distribution{
+		N:   len(sorted),
+		P50: at(0.5),
+		P95: at(0.95),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+func (d Distribution) String() string {
+	if d.N == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("p50 %v  p95 %v  max %v  (n=%d)",
+		d.P50.Round(time.Millisecond), d.P95.Round(time.Millisecond),
+		d.Max.Round(time.Millisecond), d.N)
+}
+
+// WriteText writes a human readable summary of r to w.
+func (r *Report) WriteText(w io.Writer) error {
+	var err error
+	printf := func(format string, a ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+	printf("elapsed              %v\n", r.Elapsed.Round(time.Millisecond))
+	printf("clients              %d\n", r.Clients)
+	printf("publications         %d\n", r.Publications)
+	printf("subscriptions        %d\n", r.Subscriptions)
+	printf("join latency         %v\n", r.JoinLatency)
+	printf("time to first packet %v\n", r.TimeToFirstPacket)
+	printf("packets              %d received, %d lost (%.2f%%)\n",
+		r.PacketsReceived, r.PacketsLost, 100*r.LossRate)
+	if s := r.Server; s.Sampled {
+		printf("server cpu           %.2fs (%.2f cores)\n", s.CPUSeconds, s.CPUCores)
+		printf("server goroutines    start %d  peak %d  end %d\n",
+			s.StartGoroutines, s.PeakGoroutines, s.EndGoroutines)
+	}
+	printf("errors               %d\n", r.Errors)
+	for _, e := range r.FirstErrors {
+		printf("  %s\n", e)
+	}
+	return err
+}
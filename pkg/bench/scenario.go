@@ -0,0 +1,165 @@
+package bench
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/client"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Scenario describes the simulated clients of a benchmark, e.g.
+//
+//	{
+//	  "room": "bench",
+//	  "duration": "30s",
+//	  "ramp": "50ms",
+//	  "groups": [
+//	    {"name": "speaker", "count": 2,
+//	     "publish": [{"codec": "vp8"}, {"codec": "opus"}],
+//	     "subscribe": ["speaker"]},
+//	    {"name": "viewer", "count": 50, "subscribe": ["speaker"]}
+//	  ]
+//	}
+type Scenario struct {
+	// Room all clients join. Empty joins the default room.
+	Room string `json:"room"`
+	// Duration of the measurement once all clients joined.
+	Duration Duration `json:"duration"`
+	// Ramp is the pause between two clients joining.
+	Ramp   Duration `json:"ramp"`
+	Groups []Group  `json:"groups"`
+}
+
+// Group is a set of clients behaving alike. Its clients are called
+// <name>-<n>.
+type Group struct {
+	Name    string      `json:"name"`
+	Count   int         `json:"count"`
+	Publish []TrackSpec `json:"publish"`
+	// Subscribe lists the groups whose tracks are subscribed to.
+	Subscribe []string `json:"subscribe"`
+}
+
+// TrackSpec describes a synthetic track published by each client of a
+// group.
+type TrackSpec struct {
+	// ID of the track. Defaults to the codec.
+	ID string `json:"id"`
+	// Codec is "vp8" or "opus".
+	Codec  string          `json:"codec"`
+	Source sfu.TrackSource `json:"source"`
+	// FrameSize in bytes and FrameRate in frames per second.
+	FrameSize int `json:"frame_size"`
+	FrameRate int `json:"frame_rate"`
+}
+
+// Duration is a time.Duration written as a string such as "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var ErrInvalidScenario = errors.New("invalid scenario")
+
+// LoadScenario reads a JSON scenario file.
+func LoadScenario(path string) (Scenario, error) {
+	var sc Scenario
+	f, err := os.Open(path)
+	if err != nil {
+		return sc, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&sc); err != nil {
+		return sc, err
+	}
+	return sc, sc.Validate()
+}
+
+// Validate checks the scenario and fills in defaults.
+func (sc *Scenario) Validate() error {
+	if sc.Duration <= 0 {
+		return fmt.Errorf("%w: duration must be positive", ErrInvalidScenario)
+	}
+	names := make(map[string]bool)
+	for _, g := range sc.Groups {
+		if g.Name == "" || g.Count < 0 || names[g.Name] {
+			return fmt.Errorf("%w: group %q", ErrInvalidScenario, g.Name)
+		}
+		names[g.Name] = true
+	}
+	for _, g := range sc.Groups {
+		for _, name := range g.Subscribe {
+			if !names[name] {
+				return fmt.Errorf("%w: group %q subscribes to unknown group %q",
+					ErrInvalidScenario, g.Name, name)
+			}
+		}
+		for i := range g.Publish {
+			if err := g.Publish[i].defaults(); err != nil {
+				return fmt.Errorf("%w: group %q: %v", ErrInvalidScenario, g.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *TrackSpec) defaults() error {
+	switch t.Codec {
+	case "vp8":
+		t.Source = cmpOr(t.Source, sfu.SourceCamera)
+		t.FrameSize = cmpOr(t.FrameSize, 1000)
+		t.FrameRate = cmpOr(t.FrameRate, 30)
+	case "opus":
+		t.Source = cmpOr(t.Source, sfu.SourceMicrophone)
+		t.FrameSize = cmpOr(t.FrameSize, 80)
+		t.FrameRate = cmpOr(t.FrameRate, 50)
+	default:
+		return fmt.Errorf("unknown codec %q", t.Codec)
+	}
+	t.ID = cmpOr(t.ID, t.Codec)
+	if !t.Source.Valid() {
+		return sfu.ErrInvalidSource
+	}
+	return nil
+}
+
+func (t TrackSpec) capability() webrtc.RTPCodecCapability {
+	if t.Codec == "opus" {
+		return client.Opus
+	}
+	return client.VP8
+}
+
+func (t TrackSpec) frames() client.FrameSource {
+	return &client.CounterFrames{
+		Size:     t.FrameSize,
+		Duration: time.Second / time.Duration(t.FrameRate),
+	}
+}
+
+// cmpOr returns v unless it is the zero value, in which case it
+// returns def.
+func cmpOr[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
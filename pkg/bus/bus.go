@@ -0,0 +1,202 @@
+// Package bus is a publish/subscribe message bus between Raven nodes.
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrClosed = errors.New("bus closed")
+
+// Handler is called with the messages published on a topic. Messages
+// of a subscription are handled one at a time, in the order they were
+// published by any one publisher.
+type Handler func(topic string, data []byte)
+
+type Bus interface {
+	Publish(ctx context.Context, topic string, data []byte) error
+	// Subscribe calls fn for every message published on topic until
+	// the returned function is called.
+	Subscribe(topic string, fn Handler) (unsubscribe func(), err error)
+	Close() error
+}
+
+// queue hands messages to a Handler on its own goroutine, so that a
+// slow handler does not hold up the publisher or other subscribers.
+type queue struct {
+	fn      Handler
+	pending []message
+	wake    chan struct{}
+	done    chan struct{}
+	stop    sync.Once
+	mu      sync.Mutex
+}
+
+type message struct {
+	topic string
+	data  []byte
+}
+
+func newQueue(fn Handler) *queue {
+	q := &queue{
+		fn:   fn,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *queue) push(topic string, data []byte) {
+	q.mu.Lock()
+	q.pending = append(q.pending, message{topic, data})
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) close() {
+	q.stop.Do(func() { close(q.done) })
+}
+
+func (q *queue) run() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+		q.mu.Lock()
+		pending := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+		for _, m := range pending {
+			select {
+			case <-q.done:
+				return
+			default:
+			}
+			q.fn(m.topic, m.data)
+		}
+	}
+}
+
+// subscriptions tracks the queues subscribed to each topic.
+type subscriptions struct {
+	topics map[string]map[*queue]struct{}
+	mu     sync.Mutex
+}
+
+// add returns whether q is the first subscriber of topic.
+func (s *subscriptions) add(topic string, q *queue) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.topics == nil {
+		s.topics = make(map[string]map[*queue]struct{})
+	}
+	queues, exists := s.topics[topic]
+	if !exists {
+		queues = make(map[*queue]struct{})
+		s.topics[topic] = queues
+	}
+	queues[q] = struct{}{}
+	return !exists
+}
+
+// remove returns whether q was the last subscriber of topic.
+func (s *subscriptions) remove(topic string, q *queue) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queues, exists := s.topics[topic]
+	if !exists {
+		return false
+	}
+	if _, ok := queues[q]; !ok {
+		return false
+	}
+	delete(queues, q)
+	if len(queues) == 0 {
+		delete(s.topics, topic)
+		return true
+	}
+	return false
+}
+
+func (s *subscriptions) deliver(topic string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for q := range s.topics[topic] {
+		q.push(topic, data)
+	}
+}
+
+func (s *subscriptions) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (s *subscriptions) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, queues := range s.topics {
+		for q := range queues {
+			q.close()
+		}
+	}
+	s.topics = nil
+}
+
+// Local is a Bus within one process, e.g. for tests or for several
+// nodes run side by side.
+type Local struct {
+	subs   subscriptions
+	closed bool
+	mu     sync.Mutex
+}
+
+var _ Bus = (*Local)(nil)
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+func (b *Local) Publish(_ context.Context, topic string, data []byte) error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	b.subs.deliver(topic, append([]byte(nil), data...))
+	return nil
+}
+
+func (b *Local) Subscribe(topic string, fn Handler) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	q := newQueue(fn)
+	b.subs.add(topic, q)
+	return func() {
+		b.subs.remove(topic, q)
+		q.close()
+	}, nil
+}
+
+func (b *Local) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.subs.closeAll()
+	return nil
+}
@@ -0,0 +1,230 @@
+package bus_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+)
+
+// fakeRedis implements the pub/sub commands of a Redis server.
+type fakeRedis struct {
+	ln    net.Listener
+	conns map[net.Conn]map[string]bool // subscribed channels
+	mu    sync.Mutex
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, conns: make(map[net.Conn]map[string]bool)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = make(map[string]bool)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// dropAll disconnects all clients.
+func (s *fakeRedis) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[1] == "secret" {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case "PUBLISH":
+			n := 0
+			for c, channels := range s.conns {
+				if channels[args[1]] {
+					fmt.Fprintf(c, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+						len(args[1]), args[1], len(args[2]), args[2])
+					n++
+				}
+			}
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			kind := strings.ToLower(args[0])
+			for _, channel := range args[1:] {
+				s.conns[conn][channel] = kind == "subscribe"
+				fmt.Fprintf(conn, "*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:1\r\n",
+					len(kind), kind, len(channel), channel)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.mu.Unlock()
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// expectMessage subscribes to topic on sub and publishes want on pub
+// until it arrives.
+func expectMessage(t *testing.T, sub, pub bus.Bus, topic, want string) {
+	t.Helper()
+	received := make(chan string, 16)
+	unsubscribe, err := sub.Subscribe(topic, func(_ string, data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	// Subscribing may take a moment to reach a server.
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("Expected %q, got %q", want, got)
+			}
+			return
+		case <-ticker.C:
+			pub.Publish(context.Background(), topic, []byte(want))
+		case <-timeout:
+			t.Fatalf("Did not receive %q on %s", want, topic)
+		}
+	}
+}
+
+func Test_Local(t *testing.T) {
+	b := bus.NewLocal()
+	defer b.Close()
+	expectMessage(t, b, b, "chat", "hello")
+
+	var got []string
+	done := make(chan struct{})
+	unsubscribe, _ := b.Subscribe("ordered", func(_ string, data []byte) {
+		got = append(got, string(data))
+		if len(got) == 100 {
+			close(done)
+		}
+	})
+	defer unsubscribe()
+	for i := 0; i < 100; i++ {
+		b.Publish(context.Background(), "ordered", []byte(strconv.Itoa(i)))
+	}
+	<-done
+	for i, s := range got {
+		if s != strconv.Itoa(i) {
+			t.Fatalf("Messages out of order: %v", got)
+		}
+	}
+
+	b.Close()
+	if err := b.Publish(context.Background(), "chat", nil); err != bus.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func Test_Redis(t *testing.T) {
+	server := newFakeRedis(t)
+	addr := server.ln.Addr().String()
+	if _, err := bus.DialRedis(addr, "wrong"); err == nil {
+		t.Error("Expected authentication to fail")
+	}
+	sub, err := bus.DialRedis(addr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub, err := bus.DialRedis(addr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	expectMessage(t, sub, pub, "chat", "hello\r\nworld")
+
+	// Subscriptions are restored after reconnecting.
+	received := make(chan string, 16)
+	unsubscribe, _ := sub.Subscribe("presence", func(_ string, data []byte) {
+		received <- string(data)
+	})
+	defer unsubscribe()
+	server.dropAll()
+	timeout := time.After(5 * time.Second)
+	for {
+		pub.Publish(context.Background(), "presence", []byte("online"))
+		select {
+		case got := <-received:
+			if got != "online" {
+				t.Fatalf("Expected online, got %q", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Subscription was not restored")
+		}
+	}
+}
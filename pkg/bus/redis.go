@@ -0,0 +1,285 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// Delay before reconnecting the subscriber connection.
+	redisRetryDelay = time.Second
+)
+
+// RedisError is an error reply of the server.
+type RedisError string
+
+func (e RedisError) Error() string { return "redis: " + string(e) }
+
+// Redis is a Bus using Redis pub/sub. It keeps one connection for
+// publishing and one for subscriptions, which is reconnected and
+// resubscribed when it breaks. Messages published while it is down
+// are lost, as with Redis pub/sub in general.
+type Redis struct {
+	addr     string
+	password string
+
+	pub   *redisConn
+	pubMu sync.Mutex
+
+	subs  subscriptions
+	sub   *redisConn
+	subMu sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Bus = (*Redis)(nil)
+
+// DialRedis connects to the Redis server at addr, authenticating with
+// password unless it is empty.
+func DialRedis(addr, password string) (*Redis, error) {
+	r := &Redis{
+		addr:     addr,
+		password: password,
+		done:     make(chan struct{}),
+	}
+	pub, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	sub, err := r.dial()
+	if err != nil {
+		pub.Close()
+		return nil, err
+	}
+	r.pub, r.sub = pub, sub
+	go r.readSubscriptions(sub)
+	return r, nil
+}
+
+func (r *Redis) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := c.do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *Redis) Publish(ctx context.Context, topic string, data []byte) error {
+	r.pubMu.Lock()
+	defer r.pubMu.Unlock()
+	select {
+	case <-r.done:
+		return ErrClosed
+	default:
+	}
+	if r.pub == nil {
+		pub, err := r.dial()
+		if err != nil {
+			return err
+		}
+		r.pub = pub
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		r.pub.SetDeadline(deadline)
+		defer r.pub.SetDeadline(time.Time{})
+	}
+	_, err := r.pub.do("PUBLISH", topic, string(data))
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// Reconnect on the next publish.
+		r.pub.Close()
+		r.pub = nil
+	}
+	return err
+}
+
+func (r *Redis) Subscribe(topic string, fn Handler) (func(), error) {
+	select {
+	case <-r.done:
+		return nil, ErrClosed
+	default:
+	}
+	q := newQueue(fn)
+	if r.subs.add(topic, q) {
+		r.subscriptionCommand("SUBSCRIBE", topic)
+	}
+	return func() {
+		if r.subs.remove(topic, q) {
+			r.subscriptionCommand("UNSUBSCRIBE", topic)
+		}
+		q.close()
+	}, nil
+}
+
+// subscriptionCommand sends a command on the subscriber connection.
+// Its reply is consumed by readSubscriptions. If the connection is
+// down, the subscriptions are restored once it is back.
+func (r *Redis) subscriptionCommand(args ...string) {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	if r.sub == nil {
+		return
+	}
+	if err := r.sub.write(args...); err != nil {
+		r.sub.Close()
+	}
+}
+
+// readSubscriptions delivers messages until c breaks, then reconnects.
+func (r *Redis) readSubscriptions(c *redisConn) {
+	for {
+		err := r.readMessages(c)
+		r.subMu.Lock()
+		r.sub = nil
+		r.subMu.Unlock()
+		c.Close()
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		log.Println("Redis subscriber connection lost:", err)
+		for c = nil; c == nil; {
+			select {
+			case <-r.done:
+				return
+			case <-time.After(redisRetryDelay):
+			}
+			if c, err = r.dial(); err != nil {
+				log.Println("error:", err)
+			}
+		}
+		r.subMu.Lock()
+		r.sub = c
+		topics := r.subs.list()
+		if len(topics) > 0 {
+			if err := c.write(append([]string{"SUBSCRIBE"}, topics...)...); err != nil {
+				c.Close()
+			}
+		}
+		r.subMu.Unlock()
+	}
+}
+
+func (r *Redis) readMessages(c *redisConn) error {
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return err
+		}
+		push, ok := reply.([]any)
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].(string)
+		topic, _ := push[1].(string)
+		data, _ := push[2].(string)
+		if kind == "message" {
+			r.subs.deliver(topic, []byte(data))
+		}
+	}
+}
+
+func (r *Redis) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.pubMu.Lock()
+		if r.pub != nil {
+			r.pub.Close()
+		}
+		r.pubMu.Unlock()
+		r.subMu.Lock()
+		if r.sub != nil {
+			r.sub.Close()
+		}
+		r.subMu.Unlock()
+		r.subs.closeAll()
+	})
+	return nil
+}
+
+// redisConn speaks RESP, the Redis serialization protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) write(args ...string) error {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// read returns the next reply: a string, an int64, nil, or a []any of
+// those. Error replies are returned as RedisError.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
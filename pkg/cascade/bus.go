@@ -0,0 +1,165 @@
+package cascade
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+)
+
+const directoryTopic = "cascade.directory"
+
+// directoryOp is a change of the Directory published on the bus.
+type directoryOp struct {
+	Origin  string     `json:"origin"`
+	Op      string     `json:"op"`
+	Node    string     `json:"node,omitempty"`
+	URL     string     `json:"url,omitempty"`
+	Track   TrackEntry `json:"track,omitempty"`
+	TrackID string     `json:"track_id,omitempty"`
+	Room    string     `json:"room,omitempty"`
+	Member  Member     `json:"member,omitempty"`
+}
+
+const (
+	opSetNode     = "set_node"
+	opAddTrack    = "add_track"
+	opRemoveTrack = "remove_track"
+	opJoin        = "join"
+	opLeave       = "leave"
+	// opSync asks all nodes to publish their state again, e.g. when a
+	// node starts.
+	opSync = "sync"
+)
+
+// BusDirectory is a Directory shared between processes over a bus.
+// Every node keeps a replica of the whole Directory and publishes the
+// changes it makes.
+type BusDirectory struct {
+	node        string
+	bus         bus.Bus
+	replica     *MemoryDirectory
+	unsubscribe func()
+}
+
+var _ Directory = (*BusDirectory)(nil)
+
+// NewBusDirectory joins the Directory shared on b as node and asks the
+// other nodes for their state.
+func NewBusDirectory(b bus.Bus, node string) (*BusDirectory, error) {
+	d := &BusDirectory{
+		node:    node,
+		bus:     b,
+		replica: NewMemoryDirectory(),
+	}
+	unsubscribe, err := b.Subscribe(directoryTopic, d.onMessage)
+	if err != nil {
+		return nil, err
+	}
+	d.unsubscribe = unsubscribe
+	d.publish(directoryOp{Op: opSync})
+	return d, nil
+}
+
+// Close stops following changes of other nodes.
+func (d *BusDirectory) Close() {
+	d.unsubscribe()
+}
+
+func (d *BusDirectory) publish(op directoryOp) {
+	op.Origin = d.node
+	buf, err := json.Marshal(op)
+	if err == nil {
+		err = d.bus.Publish(context.Background(), directoryTopic, buf)
+	}
+	if err != nil {
+		log.Println("error:", err)
+	}
+}
+
+func (d *BusDirectory) onMessage(_ string, data []byte) {
+	var op directoryOp
+	if err := json.Unmarshal(data, &op); err != nil {
+		log.Println("error:", err)
+		return
+	}
+	if op.Origin == d.node {
+		return
+	}
+	switch op.Op {
+	case opSetNode:
+		d.replica.SetNode(op.Node, op.URL)
+	case opAddTrack:
+		d.replica.AddTrack(op.Track)
+	case opRemoveTrack:
+		d.replica.RemoveTrack(op.TrackID)
+	case opJoin:
+		d.replica.Join(op.Room, op.Member)
+	case opLeave:
+		d.replica.Leave(op.Room, op.Member.Name)
+	case opSync:
+		d.publishState()
+	}
+}
+
+// publishState publishes everything this node owns.
+func (d *BusDirectory) publishState() {
+	url, tracks, members := d.replica.owned(d.node)
+	if url != "" {
+		d.publish(directoryOp{Op: opSetNode, Node: d.node, URL: url})
+	}
+	for _, t := range tracks {
+		d.publish(directoryOp{Op: opAddTrack, Track: t})
+	}
+	for room, ms := range members {
+		for _, m := range ms {
+			d.publish(directoryOp{Op: opJoin, Room: room, Member: m})
+		}
+	}
+}
+
+func (d *BusDirectory) SetNode(node, url string) {
+	d.replica.SetNode(node, url)
+	d.publish(directoryOp{Op: opSetNode, Node: node, URL: url})
+}
+
+func (d *BusDirectory) NodeURL(node string) (string, bool) {
+	return d.replica.NodeURL(node)
+}
+
+func (d *BusDirectory) AddTrack(t TrackEntry) {
+	d.replica.AddTrack(t)
+	d.publish(directoryOp{Op: opAddTrack, Track: t})
+}
+
+func (d *BusDirectory) RemoveTrack(trackID string) {
+	d.replica.RemoveTrack(trackID)
+	d.publish(directoryOp{Op: opRemoveTrack, TrackID: trackID})
+}
+
+func (d *BusDirectory) Track(trackID string) (TrackEntry, bool) {
+	return d.replica.Track(trackID)
+}
+
+func (d *BusDirectory) Tracks() []TrackEntry {
+	return d.replica.Tracks()
+}
+
+func (d *BusDirectory) Join(room string, m Member) {
+	d.replica.Join(room, m)
+	d.publish(directoryOp{Op: opJoin, Room: room, Member: m})
+}
+
+func (d *BusDirectory) Leave(room, name string) {
+	d.replica.Leave(room, name)
+	d.publish(directoryOp{Op: opLeave, Room: room, Member: Member{Name: name}})
+}
+
+func (d *BusDirectory) Members(room string) []Member {
+	return d.replica.Members(room)
+}
+
+func (d *BusDirectory) Watch(fn func(Event)) func() {
+	return d.replica.Watch(fn)
+}
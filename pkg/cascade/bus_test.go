@@ -0,0 +1,77 @@
+package cascade_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+	"github.com/ravenbox/raven-prototype/pkg/cascade"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_BusDirectory(t *testing.T) {
+	b := bus.NewLocal()
+	defer b.Close()
+
+	d1, err := cascade.NewBusDirectory(b, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d1.Close()
+	d2, err := cascade.NewBusDirectory(b, "node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+
+	events := make(chan cascade.Event, 16)
+	stop := d2.Watch(func(e cascade.Event) { events <- e })
+	defer stop()
+
+	track := cascade.TrackEntry{Node: "node1", Room: "lobby", Info: sfu.TrackInfo{ID: "video"}}
+	d1.SetNode("node1", "http://node1/whep")
+	d1.AddTrack(track)
+	d1.Join("lobby", cascade.Member{Name: "alice", Node: "node1"})
+
+	select {
+	case e := <-events:
+		if e.Type != cascade.EventTrackAdded || e.Track.Info.ID != "video" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for track event")
+	}
+	waitFor(t, "member", func() bool { return len(d2.Members("lobby")) == 1 })
+	if url, _ := d2.NodeURL("node1"); url != "http://node1/whep" {
+		t.Fatalf("unexpected node URL %q", url)
+	}
+
+	// A node started later learns the state of the others.
+	d3, err := cascade.NewBusDirectory(b, "node3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d3.Close()
+	waitFor(t, "sync", func() bool {
+		_, ok := d3.Track("video")
+		return ok && len(d3.Members("lobby")) == 1
+	})
+
+	d1.RemoveTrack("video")
+	d1.Leave("lobby", "alice")
+	waitFor(t, "removal", func() bool {
+		_, ok := d3.Track("video")
+		return !ok && len(d2.Members("lobby")) == 0 && len(d3.Members("lobby")) == 0
+	})
+}
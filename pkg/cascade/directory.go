@@ -0,0 +1,217 @@
+// Package cascade connects several SFU nodes into a cluster. Nodes
+// share a Directory of rooms and tracks, and relay tracks published
+// on another node over a server-to-server PeerConnection.
+package cascade
+
+import (
+	"sync"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// TrackEntry is a track published on a node of the cluster.
+type TrackEntry struct {
+	Node string `json:"node"`
+	// Room the owner of the track is in, if any.
+	Room string        `json:"room,omitempty"`
+	Info sfu.TrackInfo `json:"info"`
+}
+
+// Member is a user of a room connected to one of the nodes.
+type Member struct {
+	Name string `json:"name"`
+	Node string `json:"node"`
+}
+
+type EventType string
+
+const (
+	EventTrackAdded   EventType = "track_added"
+	EventTrackRemoved EventType = "track_removed"
+	EventJoined       EventType = "joined"
+	EventLeft         EventType = "left"
+)
+
+// Event reports a change of the Directory. Track is set for track
+// events, Room and Member for membership events.
+type Event struct {
+	Type   EventType  `json:"type"`
+	Track  TrackEntry `json:"track,omitempty"`
+	Room   string     `json:"room,omitempty"`
+	Member Member     `json:"member,omitempty"`
+}
+
+// Directory is the state shared by the nodes of a cluster.
+type Directory interface {
+	// SetNode announces the WHEP endpoint of node. An empty url
+	// removes the node.
+	SetNode(node, url string)
+	NodeURL(node string) (string, bool)
+
+	// AddTrack adds or updates a track.
+	AddTrack(TrackEntry)
+	RemoveTrack(trackID string)
+	Track(trackID string) (TrackEntry, bool)
+	Tracks() []TrackEntry
+
+	Join(room string, m Member)
+	Leave(room, name string)
+	Members(room string) []Member
+
+	// Watch calls fn for every change until stop is called.
+	Watch(fn func(Event)) (stop func())
+}
+
+// MemoryDirectory is a Directory for nodes running in one process.
+type MemoryDirectory struct {
+	nodes    map[string]string
+	tracks   map[string]TrackEntry
+	rooms    map[string]map[string]Member
+	watchers map[int]func(Event)
+	nextID   int
+	mu       sync.Mutex
+}
+
+var _ Directory = (*MemoryDirectory)(nil)
+
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{
+		nodes:    make(map[string]string),
+		tracks:   make(map[string]TrackEntry),
+		rooms:    make(map[string]map[string]Member),
+		watchers: make(map[int]func(Event)),
+	}
+}
+
+func (d *MemoryDirectory) SetNode(node, url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if url == "" {
+		delete(d.nodes, node)
+		return
+	}
+	d.nodes[node] = url
+}
+
+func (d *MemoryDirectory) NodeURL(node string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	url, ok := d.nodes[node]
+	return url, ok
+}
+
+func (d *MemoryDirectory) AddTrack(t TrackEntry) {
+	d.mu.Lock()
+	d.tracks[t.Info.ID] = t
+	d.mu.Unlock()
+	d.emit(Event{Type: EventTrackAdded, Track: t})
+}
+
+func (d *MemoryDirectory) RemoveTrack(trackID string) {
+	d.mu.Lock()
+	t, exists := d.tracks[trackID]
+	delete(d.tracks, trackID)
+	d.mu.Unlock()
+	if exists {
+		d.emit(Event{Type: EventTrackRemoved, Track: t})
+	}
+}
+
+func (d *MemoryDirectory) Track(trackID string) (TrackEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.tracks[trackID]
+	return t, ok
+}
+
+func (d *MemoryDirectory) Tracks() []TrackEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tracks := make([]TrackEntry, 0, len(d.tracks))
+	for _, t := range d.tracks {
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+func (d *MemoryDirectory) Join(room string, m Member) {
+	d.mu.Lock()
+	members, exists := d.rooms[room]
+	if !exists {
+		members = make(map[string]Member)
+		d.rooms[room] = members
+	}
+	members[m.Name] = m
+	d.mu.Unlock()
+	d.emit(Event{Type: EventJoined, Room: room, Member: m})
+}
+
+func (d *MemoryDirectory) Leave(room, name string) {
+	d.mu.Lock()
+	m, exists := d.rooms[room][name]
+	delete(d.rooms[room], name)
+	if len(d.rooms[room]) == 0 {
+		delete(d.rooms, room)
+	}
+	d.mu.Unlock()
+	if exists {
+		d.emit(Event{Type: EventLeft, Room: room, Member: m})
+	}
+}
+
+func (d *MemoryDirectory) Members(room string) []Member {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	members := make([]Member, 0, len(d.rooms[room]))
+	for _, m := range d.rooms[room] {
+		members = append(members, m)
+	}
+	return members
+}
+
+func (d *MemoryDirectory) Watch(fn func(Event)) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextID
+	d.nextID++
+	d.watchers[id] = fn
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.watchers, id)
+	}
+}
+
+func (d *MemoryDirectory) emit(e Event) {
+	d.mu.Lock()
+	watchers := make([]func(Event), 0, len(d.watchers))
+	for _, fn := range d.watchers {
+		watchers = append(watchers, fn)
+	}
+	d.mu.Unlock()
+	for _, fn := range watchers {
+		fn(e)
+	}
+}
+
+// owned returns the state of node: its URL, its tracks and its
+// members by room.
+func (d *MemoryDirectory) owned(node string) (string, []TrackEntry, map[string][]Member) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var tracks []TrackEntry
+	for _, t := range d.tracks {
+		if t.Node == node {
+			tracks = append(tracks, t)
+		}
+	}
+	members := make(map[string][]Member)
+	for room, ms := range d.rooms {
+		for _, m := range ms {
+			if m.Node == node {
+				members[room] = append(members[room], m)
+			}
+		}
+	}
+	return d.nodes[node], tracks, members
+}
@@ -0,0 +1,192 @@
+package cascade
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrNodeNotFound = errors.New("node not found")
+	ErrRelayFailed  = errors.New("relay failed")
+)
+
+// Node is an SFU taking part in a cluster. It announces the tracks
+// of its SFU in the Directory and relays tracks of other nodes on
+// request, pulling them from the WHEP endpoint of their node.
+type Node struct {
+	ID        string
+	SFU       *sfu.SFU
+	Directory Directory
+	// Room returns the room of the owner of a local track, if any.
+	Room func(sfu.TrackInfo) string
+	// Token is sent as bearer token to the WHEP endpoints of other
+	// nodes.
+	Token string
+	// Client is used for requests to other nodes.
+	Client *http.Client
+	// Config is used for the PeerConnections of relays.
+	Config webrtc.Configuration
+
+	relays      map[string]*relay // by track id
+	stopWatch   func()
+	onTrackInfo func(sfu.TrackInfo)
+	onEnded     func(sfu.TrackInfo)
+	mu          sync.Mutex
+}
+
+// NewNode joins s to the cluster of dir as node id, reachable by other
+// nodes under the WHEP endpoint url. It hooks into the track callbacks
+// of s, so it must be created after they are set.
+func NewNode(id, url string, s *sfu.SFU, dir Directory) *Node {
+	n := &Node{
+		ID:          id,
+		SFU:         s,
+		Directory:   dir,
+		Client:      http.DefaultClient,
+		relays:      make(map[string]*relay),
+		onTrackInfo: s.OnTrackInfo,
+		onEnded:     s.OnTrackEnded,
+	}
+	s.OnTrackInfo = n.trackInfo
+	s.OnTrackEnded = n.trackEnded
+	dir.SetNode(id, url)
+	n.stopWatch = dir.Watch(n.onEvent)
+	for _, info := range s.TrackInfos() {
+		n.announce(info)
+	}
+	return n
+}
+
+// Join adds the user name of this node to room.
+func (n *Node) Join(room, name string) {
+	n.Directory.Join(room, Member{Name: name, Node: n.ID})
+}
+
+func (n *Node) Leave(room, name string) {
+	n.Directory.Leave(room, name)
+}
+
+// Local reports whether trackID is published on this node.
+func (n *Node) Local(trackID string) bool {
+	t, ok := n.Directory.Track(trackID)
+	return ok && t.Node == n.ID
+}
+
+// Close stops all relays and removes the node and its tracks from
+// the Directory.
+func (n *Node) Close() {
+	n.stopWatch()
+	n.mu.Lock()
+	relays := make([]*relay, 0, len(n.relays))
+	for _, r := range n.relays {
+		relays = append(relays, r)
+	}
+	n.mu.Unlock()
+	for _, r := range relays {
+		r.close()
+	}
+	for _, t := range n.Directory.Tracks() {
+		if t.Node == n.ID {
+			n.Directory.RemoveTrack(t.Info.ID)
+		}
+	}
+	n.Directory.SetNode(n.ID, "")
+}
+
+func (n *Node) relayed(trackID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.relays[trackID]
+	return ok
+}
+
+// announce publishes a local track in the Directory. Relayed tracks
+// are already announced by the node they come from.
+func (n *Node) announce(info sfu.TrackInfo) {
+	if n.relayed(info.ID) {
+		return
+	}
+	entry := TrackEntry{Node: n.ID, Info: info}
+	if n.Room != nil {
+		entry.Room = n.Room(info)
+	}
+	n.Directory.AddTrack(entry)
+}
+
+func (n *Node) trackInfo(info sfu.TrackInfo) {
+	if n.onTrackInfo != nil {
+		n.onTrackInfo(info)
+	}
+	n.announce(info)
+}
+
+func (n *Node) trackEnded(info sfu.TrackInfo) {
+	if n.onEnded != nil {
+		n.onEnded(info)
+	}
+	n.mu.Lock()
+	r, relayed := n.relays[info.ID]
+	delete(n.relays, info.ID)
+	n.mu.Unlock()
+	if relayed {
+		r.close()
+		return
+	}
+	if n.Local(info.ID) {
+		n.Directory.RemoveTrack(info.ID)
+	}
+}
+
+// onEvent ends relays of tracks which ended on their node.
+func (n *Node) onEvent(e Event) {
+	if e.Type != EventTrackRemoved || e.Track.Node == n.ID {
+		return
+	}
+	n.mu.Lock()
+	r, relayed := n.relays[e.Track.Info.ID]
+	n.mu.Unlock()
+	if relayed {
+		r.close()
+	}
+}
+
+// Relay makes trackID of another node available on this node's SFU
+// under the same id, so that it can be subscribed to like a local
+// track. Relaying a local or already relayed track does nothing.
+func (n *Node) Relay(trackID string) error {
+	entry, ok := n.Directory.Track(trackID)
+	if !ok {
+		return sfu.ErrTrackNotFound
+	}
+	if entry.Node == n.ID {
+		return nil
+	}
+	n.mu.Lock()
+	r, exists := n.relays[trackID]
+	if !exists {
+		r = newRelay()
+		n.relays[trackID] = r
+	}
+	n.mu.Unlock()
+	if exists {
+		<-r.ready
+		return r.err
+	}
+
+	r.err = n.startRelay(r, entry)
+	close(r.ready)
+	if r.err != nil {
+		n.mu.Lock()
+		if n.relays[trackID] == r {
+			delete(n.relays, trackID)
+		}
+		n.mu.Unlock()
+		r.close()
+	}
+	return r.err
+}
@@ -0,0 +1,220 @@
+package cascade
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Time allowed to gather the candidates of a relay offer.
+	gatherTimeout = 10 * time.Second
+
+	relayQueueSize = 64
+)
+
+// relay receives a track of another node over a PeerConnection to
+// its WHEP endpoint.
+type relay struct {
+	ready chan struct{} // closed once started, err is set then
+	err   error
+
+	done      chan struct{}
+	closeOnce sync.Once
+	pc        *webrtc.PeerConnection
+	session   string // URL of the WHEP session
+	client    *http.Client
+	token     string
+	mu        sync.Mutex
+}
+
+func newRelay() *relay {
+	return &relay{
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// close ends the relay, which in turn ends the relayed track.
+func (r *relay) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.mu.Lock()
+		pc, session := r.pc, r.session
+		r.mu.Unlock()
+		if pc != nil {
+			if err := pc.Close(); err != nil {
+				log.Println("error:", err)
+			}
+		}
+		if session != "" {
+			if err := r.request(http.MethodDelete, session, "", nil); err != nil {
+				log.Println("Error ending relay session:", err)
+			}
+		}
+	})
+}
+
+// pump forwards the packets of the relayed track until the relay is
+// closed.
+func (r *relay) pump(remote <-chan *webrtc.TrackRemote, packets chan<- *rtp.Packet) {
+	defer close(packets)
+	var tr *webrtc.TrackRemote
+	select {
+	case tr = <-remote:
+	case <-r.done:
+		return
+	}
+	for {
+		packet, _, err := tr.ReadRTP()
+		if err != nil {
+			return
+		}
+		select {
+		case packets <- packet:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (n *Node) startRelay(r *relay, entry TrackEntry) error {
+	base, ok := n.Directory.NodeURL(entry.Node)
+	if !ok {
+		return ErrNodeNotFound
+	}
+	pc, err := n.SFU.API.NewPeerConnection(n.Config)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pc, r.client, r.token = pc, n.Client, n.Token
+	r.mu.Unlock()
+
+	_, err = pc.AddTransceiverFromKind(webrtc.NewRTPCodecType(entry.Info.Kind),
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		return err
+	}
+	remote := make(chan *webrtc.TrackRemote, 1)
+	pc.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		select {
+		case remote <- tr:
+		default:
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			r.close()
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		return fmt.Errorf("%w: timed out gathering candidates", ErrRelayFailed)
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("track", entry.Info.ID)
+	u.RawQuery = q.Encode()
+	var answer string
+	err = r.request(http.MethodPost, u.String(), pc.LocalDescription().SDP, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("%w: %s", ErrRelayFailed, resp.Status)
+		}
+		session, err := resp.Location()
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.session = session.String()
+		r.mu.Unlock()
+		body, err := io.ReadAll(resp.Body)
+		answer = string(body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		return err
+	}
+
+	var audioLevel, dependencyDescriptor uint8
+	for _, t := range pc.GetTransceivers() {
+		audioLevel = sfu.AudioLevelExtension(t.Receiver())
+		dependencyDescriptor = sfu.DependencyDescriptorExtension(t.Receiver())
+	}
+
+	packets := make(chan *rtp.Packet, relayQueueSize)
+	go r.pump(remote, packets)
+	info := entry.Info
+	_, err = n.SFU.PublishTrack(sfu.LocalTrack{
+		ID:       strings.TrimPrefix(info.ID, info.StreamID+"#"),
+		StreamID: info.StreamID,
+		Owner:    info.Owner,
+		Codec: webrtc.RTPCodecCapability{
+			MimeType:  info.Codec,
+			ClockRate: info.ClockRate,
+			Channels:  info.Channels,
+		},
+		Source:                        info.Source,
+		AudioLevelExtension:           audioLevel,
+		DependencyDescriptorExtension: dependencyDescriptor,
+	}, packets)
+	return err
+}
+
+// request sends body to the WHEP endpoint of another node and hands
+// the response to handle, if set.
+func (r *relay) request(method, url, body string, handle func(*http.Response) error) error {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/sdp")
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if handle != nil {
+		return handle(resp)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+// Package client is a Go-native Raven client speaking the websocket
+// protocol of the server. It is meant for integration and load tests:
+// it publishes synthetic media and verifies what it receives.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/negotiation"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrClosed = errors.New("client closed")
+
+// Time allowed to write a message to the server.
+const writeWait = 10 * time.Second
+
+func deadline() time.Time {
+	return time.Now().Add(writeWait)
+}
+
+// message is the wire format of the websocket protocol.
+type message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// ServerError is an error reported by the server.
+type ServerError struct {
+	Message string `json:"message"`
+}
+
+func (e ServerError) Error() string { return "server: " + e.Message }
+
+// Client is a user connected to a Raven server.
+type Client struct {
+	Name string
+	Room string
+
+	PeerConn   *webrtc.PeerConnection
+	Negotiator *negotiation.Negotiator
+
+	// OnMessage is called with messages the client does not handle
+	// itself, such as chat and moderation.
+	OnMessage func(typ string, payload json.RawMessage)
+
+	ws       *websocket.Conn
+	sendCh   chan message
+	signaler negotiation.ChanSignaler
+	inBand   *negotiation.DataChannelSignaler
+	done     chan struct{}
+	closed   sync.Once
+
+	tracks map[string]sfu.TrackInfo
+	remote map[string]*webrtc.TrackRemote
+	errs   []error
+	// changed is closed and replaced whenever the state above changes.
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+// Option configures how a Client connects.
+type Option func(*options)
+
+type options struct {
+	node string
+}
+
+// PeerNode has the node with ID node of the server's bus host the
+// PeerConnection, rather than the node of the websocket.
+func PeerNode(node string) Option {
+	return func(o *options) {
+		o.node = node
+	}
+}
+
+// Dial connects to the Raven server at rawURL, e.g. ws://host:8000/,
+// as name in room. An empty room joins the default room.
+func Dial(ctx context.Context, rawURL, name, room string, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("name", name)
+	if room != "" {
+		q.Set("room", room)
+	}
+	u.RawQuery = q.Encode()
+
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var pc *webrtc.PeerConnection
+	api, err := newAPI(func() *webrtc.PeerConnection { return pc })
+	if err == nil {
+		pc, err = api.NewPeerConnection(webrtc.Configuration{})
+	}
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	c := &Client{
+		Name:     name,
+		Room:     room,
+		PeerConn: pc,
+		ws:       ws,
+		sendCh:   make(chan message, 32),
+		done:     make(chan struct{}),
+		tracks:   make(map[string]sfu.TrackInfo),
+		remote:   make(map[string]*webrtc.TrackRemote),
+		changed:  make(chan struct{}),
+	}
+	c.signaler = negotiation.NewChanSignaler(c.sendCh,
+		func(sb negotiation.SignalBody) message {
+			payload, _ := json.Marshal(sb)
+			return message{Type: "signal", Payload: payload}
+		})
+	// Renegotiation skips the server once the DataChannel is open.
+	c.inBand, err = negotiation.NewDataChannelSignaler(pc, c.signaler)
+	if err != nil {
+		ws.Close()
+		pc.Close()
+		return nil, err
+	}
+	pc.OnTrack(c.onTrack)
+	// The server is the polite side.
+	c.Negotiator = negotiation.NewRegisteredNegotiator(pc, c.inBand)
+
+	// Queued ahead of any signal, since the server needs a peer first.
+	create := struct {
+		InBand bool   `json:"in_band"`
+		Node   string `json:"node,omitempty"`
+	}{InBand: true, Node: o.node}
+	if err := c.Send("create_webrtc_peer", create); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.readWs()
+	go c.writeWs()
+	return c, nil
+}
+
+// Send sends a message of type typ to the server.
+func (c *Client) Send(typ string, payload any) error {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.sendCh <- message{Type: typ, Payload: buf}:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// Close disconnects the client.
+func (c *Client) Close() error {
+	var err error
+	c.closed.Do(func() {
+		close(c.done)
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline())
+		err = errors.Join(c.ws.Close(), c.PeerConn.Close())
+	})
+	return err
+}
+
+// Done is closed once the client is disconnected.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// InBand reports whether signals go over a DataChannel of PeerConn
+// rather than the websocket.
+func (c *Client) InBand() bool {
+	return c.inBand.InBand()
+}
+
+func (c *Client) readWs() {
+	defer c.Close()
+	for {
+		var msg message
+		if err := c.ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		if err := c.handle(msg); err != nil {
+			log.Printf("client %s: error handling %s: %v\n", c.Name, msg.Type, err)
+		}
+	}
+}
+
+func (c *Client) writeWs() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.sendCh:
+			c.ws.SetWriteDeadline(deadline())
+			if err := c.ws.WriteJSON(msg); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) handle(msg message) error {
+	switch msg.Type {
+	case "signal":
+		var body negotiation.SignalBody
+		if err := json.Unmarshal(msg.Payload, &body); err != nil {
+			return err
+		}
+		c.signaler.CallOnMessage(body)
+	case "track_info":
+		var info sfu.TrackInfo
+		if err := json.Unmarshal(msg.Payload, &info); err != nil {
+			return err
+		}
+		c.update(func() { c.tracks[info.ID] = info })
+	case "track_ended":
+		var ended struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &ended); err != nil {
+			return err
+		}
+		c.update(func() { delete(c.tracks, ended.ID) })
+	case "error":
+		var serverErr ServerError
+		if err := json.Unmarshal(msg.Payload, &serverErr); err != nil {
+			return err
+		}
+		c.update(func() { c.errs = append(c.errs, serverErr) })
+	default:
+		if c.OnMessage != nil {
+			c.OnMessage(msg.Type, msg.Payload)
+		}
+	}
+	return nil
+}
+
+func (c *Client) onTrack(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	id := fmt.Sprintf("%s#%s", tr.StreamID(), tr.ID())
+	c.update(func() { c.remote[id] = tr })
+}
+
+// update changes the state under lock and wakes up waiters.
+func (c *Client) update(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait calls check whenever the state changes until it reports done,
+// ctx expires or the client is closed.
+func (c *Client) wait(ctx context.Context, check func() (done bool, err error)) error {
+	for {
+		c.mu.Lock()
+		done, err := check()
+		changed := c.changed
+		c.mu.Unlock()
+		if done || err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+}
+
+// Tracks returns the tracks announced in the room.
+func (c *Client) Tracks() []sfu.TrackInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	infos := make([]sfu.TrackInfo, 0, len(c.tracks))
+	for _, info := range c.tracks {
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Errors returns the errors reported by the server so far.
+func (c *Client) Errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error(nil), c.errs...)
+}
+
+// WaitTrack waits until a track matching match is announced.
+func (c *Client) WaitTrack(ctx context.Context, match func(sfu.TrackInfo) bool) (sfu.TrackInfo, error) {
+	var found sfu.TrackInfo
+	err := c.wait(ctx, func() (bool, error) {
+		for _, info := range c.tracks {
+			if match(info) {
+				found = info
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return found, err
+}
+
+// Subscribe subscribes to trackID and waits for it to arrive. It fails
+// if the server reports an error in the meantime.
+func (c *Client) Subscribe(ctx context.Context, trackID string) (*webrtc.TrackRemote, error) {
+	c.mu.Lock()
+	errs := len(c.errs)
+	c.mu.Unlock()
+	if err := c.Send("subscribe", map[string]string{"track": trackID}); err != nil {
+		return nil, err
+	}
+	var tr *webrtc.TrackRemote
+	err := c.wait(ctx, func() (bool, error) {
+		if len(c.errs) > errs {
+			return false, c.errs[errs]
+		}
+		tr = c.remote[trackID]
+		return tr != nil, nil
+	})
+	return tr, err
+}
+
+// Unsubscribe stops receiving trackID.
+func (c *Client) Unsubscribe(trackID string) error {
+	c.update(func() { delete(c.remote, trackID) })
+	return c.Send("unsubscribe", map[string]string{"track": trackID})
+}
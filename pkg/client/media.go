@@ -0,0 +1,338 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+var (
+	VP8  = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	Opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+)
+
+// FrameSource produces the frames of a synthetic track. It returns
+// io.EOF when it is exhausted.
+type FrameSource interface {
+	NextFrame() (media.Sample, error)
+}
+
+// CounterFrames generates frames of Size bytes every Duration, each
+// starting with a big-endian frame counter which Receiver picks up.
+// Keep Size below the MTU so that each frame fits into a packet.
+type CounterFrames struct {
+	Size     int
+	Duration time.Duration
+	// Count limits the number of frames. Zero means no limit.
+	Count uint64
+
+	n uint64
+}
+
+func (f *CounterFrames) NextFrame() (media.Sample, error) {
+	if f.Count > 0 && f.n >= f.Count {
+		return media.Sample{}, io.EOF
+	}
+	data := make([]byte, max(f.Size, 8))
+	binary.BigEndian.PutUint64(data, f.n)
+	f.n++
+	return media.Sample{Data: data, Duration: f.Duration}, nil
+}
+
+// IVFFrames reads the frames of an IVF file, e.g. VP8.
+func IVFFrames(r io.Reader) (FrameSource, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Second * time.Duration(header.TimebaseNumerator) /
+		time.Duration(max(header.TimebaseDenominator, 1))
+	return frameFunc(func() (media.Sample, error) {
+		frame, _, err := reader.ParseNextFrame()
+		return media.Sample{Data: frame, Duration: duration}, err
+	}), nil
+}
+
+// OggFrames reads the pages of an Ogg Opus file.
+func OggFrames(r io.Reader) (FrameSource, error) {
+	reader, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	var lastGranule uint64
+	return frameFunc(func() (media.Sample, error) {
+		page, header, err := reader.ParseNextPage()
+		if err != nil {
+			return media.Sample{}, err
+		}
+		samples := header.GranulePosition - lastGranule
+		lastGranule = header.GranulePosition
+		duration := time.Duration(samples) * time.Second / 48000
+		return media.Sample{Data: page, Duration: duration}, nil
+	}), nil
+}
+
+type frameFunc func() (media.Sample, error)
+
+func (f frameFunc) NextFrame() (media.Sample, error) { return f() }
+
+// Publication is a track published by the client.
+type Publication struct {
+	// ID of the track in the SFU.
+	ID    string
+	Track *webrtc.TrackLocalStaticSample
+
+	sent   atomic.Uint64
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Publish adds a track with codec to the client's PeerConnection and
+// sends the frames of src in real time until src is exhausted, ctx
+// expires or Stop is called.
+func (c *Client) Publish(ctx context.Context, codec webrtc.RTPCodecCapability,
+	trackID string, source sfu.TrackSource, src FrameSource) (*Publication, error) {
+	publications, err := c.PublishSimulcast(ctx, codec, trackID, source, []Layer{{Frames: src}})
+	if err != nil {
+		return nil, err
+	}
+	return publications[0], nil
+}
+
+// Layer is an encoding of a simulcast track, identified by its RID.
+type Layer struct {
+	RID    string
+	Frames FrameSource
+}
+
+// PublishSimulcast is like Publish, but sends one encoding per layer.
+// It returns a Publication per layer.
+func (c *Client) PublishSimulcast(ctx context.Context, codec webrtc.RTPCodecCapability,
+	trackID string, source sfu.TrackSource, layers []Layer) ([]*Publication, error) {
+	// Announce the source first, so that the track is authorized as
+	// such once it arrives.
+	err := c.Send("publish_track", map[string]any{
+		"track_id": trackID,
+		"source":   source,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		sender *webrtc.RTPSender
+		tracks []*webrtc.TrackLocalStaticSample
+	)
+	for _, l := range layers {
+		var opts []func(*webrtc.TrackLocalStaticRTP)
+		if l.RID != "" {
+			opts = append(opts, webrtc.WithRTPStreamID(l.RID))
+		}
+		track, err := webrtc.NewTrackLocalStaticSample(codec, trackID, c.Name, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if sender == nil {
+			sender, err = c.PeerConn.AddTrack(track)
+		} else {
+			err = sender.AddEncoding(track)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	publications := make([]*Publication, 0, len(layers))
+	for i, track := range tracks {
+		ctx, cancel := context.WithCancel(ctx)
+		p := &Publication{
+			ID:     c.Name + "#" + trackID,
+			Track:  track,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		go p.run(ctx, layers[i].Frames)
+		publications = append(publications, p)
+	}
+	return publications, nil
+}
+
+func (p *Publication) run(ctx context.Context, src FrameSource) {
+	defer close(p.done)
+	defer p.cancel()
+	next := time.Now()
+	for {
+		sample, err := src.NextFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				p.err = err
+			}
+			return
+		}
+		if err := p.Track.WriteSample(sample); err != nil {
+			p.err = err
+			return
+		}
+		p.sent.Add(1)
+		next = next.Add(sample.Duration)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// Sent returns the number of frames sent so far.
+func (p *Publication) Sent() uint64 {
+	return p.sent.Load()
+}
+
+// Stop stops sending and returns the error which ended the
+// publication, if any.
+func (p *Publication) Stop() error {
+	p.cancel()
+	<-p.done
+	return p.err
+}
+
+// ReceiverStats summarizes the packets received on a track.
+type ReceiverStats struct {
+	Packets uint64
+	// Lost counts the packets missing in the sequence number space.
+	Lost uint64
+	// StartedAt is when the receiver started, FirstPacketAt when the
+	// first packet arrived.
+	StartedAt     time.Time
+	FirstPacketAt time.Time
+	// Frames counts the frames of CounterFrames seen, LastFrame is the
+	// last counter and Reordered counts counters which went backwards.
+	Frames    uint64
+	LastFrame uint64
+	Reordered uint64
+}
+
+// TimeToFirstPacket is zero until the first packet arrived.
+func (s ReceiverStats) TimeToFirstPacket() time.Duration {
+	if s.FirstPacketAt.IsZero() {
+		return 0
+	}
+	return s.FirstPacketAt.Sub(s.StartedAt)
+}
+
+// Receiver reads a remote track and keeps ReceiverStats about it.
+type Receiver struct {
+	Track *webrtc.TrackRemote
+
+	stats   ReceiverStats
+	lastSeq uint16
+	changed chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// Receive starts reading tr until it ends.
+func Receive(tr *webrtc.TrackRemote) *Receiver {
+	r := &Receiver{
+		Track:   tr,
+		stats:   ReceiverStats{StartedAt: time.Now()},
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *Receiver) run() {
+	defer close(r.done)
+	isVP8 := r.Track.Codec().MimeType == webrtc.MimeTypeVP8
+	for {
+		packet, _, err := r.Track.ReadRTP()
+		if err != nil {
+			return
+		}
+		payload := packet.Payload
+		if isVP8 {
+			var vp8 codecs.VP8Packet
+			if _, err := vp8.Unmarshal(packet.Payload); err != nil {
+				log.Println("Error depacketizing VP8:", err)
+				continue
+			}
+			payload = nil
+			if vp8.S == 1 && vp8.PID == 0 {
+				payload = vp8.Payload
+			}
+		}
+
+		r.mu.Lock()
+		s := &r.stats
+		if s.Packets == 0 {
+			s.FirstPacketAt = time.Now()
+		} else if gap := packet.SequenceNumber - r.lastSeq; gap > 1 && gap < 1<<15 {
+			s.Lost += uint64(gap - 1)
+		}
+		if s.Packets == 0 || packet.SequenceNumber-r.lastSeq < 1<<15 {
+			r.lastSeq = packet.SequenceNumber
+		}
+		s.Packets++
+		if len(payload) >= 8 {
+			frame := binary.BigEndian.Uint64(payload)
+			if s.Frames > 0 && frame <= s.LastFrame {
+				s.Reordered++
+			}
+			s.LastFrame = frame
+			s.Frames++
+		}
+		close(r.changed)
+		r.changed = make(chan struct{})
+		r.mu.Unlock()
+	}
+}
+
+// Stats returns the current ReceiverStats.
+func (r *Receiver) Stats() ReceiverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// WaitPackets waits until n packets have been received.
+func (r *Receiver) WaitPackets(ctx context.Context, n uint64) error {
+	for {
+		r.mu.Lock()
+		received, changed := r.stats.Packets, r.changed
+		r.mu.Unlock()
+		if received >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-r.done:
+			return io.EOF
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// newAPI returns the API of the SFU, plus ridHeaders for pc.
+func newAPI(pc func() *webrtc.PeerConnection) (*webrtc.API, error) {
+	m := sfu.NewMediaEngine()
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, err
+	}
+	registry.Add(&ridHeaders{pc: pc})
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry)), nil
+}
+
+// ridHeaders adds the MID and RID header extensions to the packets of
+// simulcast encodings, which pion does not do by itself, so that the
+// SFU can tell the encodings apart.
+type ridHeaders struct {
+	interceptor.NoOp
+	pc func() *webrtc.PeerConnection
+}
+
+func (h *ridHeaders) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return h, nil
+}
+
+func (h *ridHeaders) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var midID, ridID uint8
+	for _, ext := range info.RTPHeaderExtensions {
+		switch ext.URI {
+		case sdp.SDESMidURI:
+			midID = uint8(ext.ID)
+		case sdp.SDESRTPStreamIDURI:
+			ridID = uint8(ext.ID)
+		}
+	}
+	if midID == 0 || ridID == 0 {
+		return writer
+	}
+	var ids atomic.Pointer[[2]string] // MID and RID, once found
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		found := ids.Load()
+		if found == nil {
+			if mid, rid, ok := h.lookup(info.SSRC); ok {
+				found = &[2]string{mid, rid}
+				ids.Store(found)
+			}
+		}
+		if found != nil && found[1] != "" {
+			if err := header.SetExtension(midID, []byte(found[0])); err != nil {
+				return 0, err
+			}
+			if err := header.SetExtension(ridID, []byte(found[1])); err != nil {
+				return 0, err
+			}
+		}
+		return writer.Write(header, payload, a)
+	})
+}
+
+// lookup finds the MID and RID of the encoding sent with ssrc.
+func (h *ridHeaders) lookup(ssrc uint32) (string, string, bool) {
+	pc := h.pc()
+	if pc == nil {
+		return "", "", false
+	}
+	for _, t := range pc.GetTransceivers() {
+		sender := t.Sender()
+		if sender == nil {
+			continue
+		}
+		for _, e := range sender.GetParameters().Encodings {
+			if uint32(e.SSRC) == ssrc {
+				return t.Mid(), e.RID, true
+			}
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,77 @@
+package negotiation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+)
+
+// BusSignaler signals over a message bus, so that the PeerConnection
+// and the client it negotiates with may be handled by different
+// nodes. Signals are published on the send topic and read from the
+// receive topic; the other side uses the same topics swapped.
+type BusSignaler struct {
+	SignalerCallbacks
+
+	bus         bus.Bus
+	topic       string
+	unsubscribe func()
+	closed      bool
+	mu          sync.Mutex
+}
+
+var _ Signaler = (*BusSignaler)(nil)
+
+func NewBusSignaler(b bus.Bus, send, receive string) (*BusSignaler, error) {
+	s := &BusSignaler{
+		bus:   b,
+		topic: send,
+	}
+	unsubscribe, err := b.Subscribe(receive, s.onBusMessage)
+	if err != nil {
+		return nil, err
+	}
+	s.unsubscribe = unsubscribe
+	return s, nil
+}
+
+func (s *BusSignaler) onBusMessage(_ string, data []byte) {
+	var body SignalBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		s.callOnError(err)
+		return
+	}
+	s.callOnMessage(body)
+}
+
+func (s *BusSignaler) Send(body SignalBody) error {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrSignalerClosed
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	err = s.bus.Publish(context.Background(), s.topic, buf)
+	if errors.Is(err, bus.ErrClosed) {
+		return ErrSignalerClosed
+	}
+	return err
+}
+
+// Close stops receiving signals. The bus is left open.
+func (s *BusSignaler) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.unsubscribe()
+	}
+	return nil
+}
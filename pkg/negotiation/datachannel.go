@@ -0,0 +1,89 @@
+package negotiation
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The DataChannel of a DataChannelSignaler is negotiated out of band,
+// so both peers create it with the same ID.
+const (
+	dataChannelSignalerLabel        = "negotiation"
+	dataChannelSignalerID    uint16 = 1023
+)
+
+// DataChannelSignaler signals in-band, over a DataChannel of the
+// PeerConnection it negotiates, so that renegotiation skips the server
+// once the first negotiation is done. Until the DataChannel is open,
+// and once it closed, signals go through Fallback. Both peers must use
+// a DataChannelSignaler.
+type DataChannelSignaler struct {
+	SignalerCallbacks
+	Fallback Signaler
+
+	dc *webrtc.DataChannel
+}
+
+var _ Signaler = (*DataChannelSignaler)(nil)
+
+// NewDataChannelSignaler creates the DataChannel on pc. Signals are
+// received from both the DataChannel and fallback.
+func NewDataChannelSignaler(pc *webrtc.PeerConnection, fallback Signaler) (*DataChannelSignaler, error) {
+	negotiated := true
+	id := dataChannelSignalerID
+	dc, err := pc.CreateDataChannel(dataChannelSignalerLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &DataChannelSignaler{
+		Fallback: fallback,
+		dc:       dc,
+	}
+	dc.OnMessage(s.onDataChannelMessage)
+	return s, nil
+}
+
+func (s *DataChannelSignaler) onDataChannelMessage(msg webrtc.DataChannelMessage) {
+	var body SignalBody
+	if err := json.Unmarshal(msg.Data, &body); err != nil {
+		s.callOnError(err)
+		return
+	}
+	s.callOnMessage(body)
+}
+
+func (s *DataChannelSignaler) OnMessage(callback func(SignalBody)) {
+	s.SignalerCallbacks.OnMessage(callback)
+	s.Fallback.OnMessage(callback)
+}
+
+func (s *DataChannelSignaler) OnError(callback func(error)) {
+	s.SignalerCallbacks.OnError(callback)
+	s.Fallback.OnError(callback)
+}
+
+// InBand reports whether signals are sent over the DataChannel.
+func (s *DataChannelSignaler) InBand() bool {
+	return s.dc.ReadyState() == webrtc.DataChannelStateOpen
+}
+
+func (s *DataChannelSignaler) Send(body SignalBody) error {
+	if !s.InBand() {
+		return s.Fallback.Send(body)
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return s.dc.SendText(string(buf))
+}
+
+// Close closes the DataChannel and Fallback.
+func (s *DataChannelSignaler) Close() error {
+	return errors.Join(s.dc.Close(), s.Fallback.Close())
+}
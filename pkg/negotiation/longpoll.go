@@ -0,0 +1,242 @@
+package negotiation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	// Time to wait before polling again after a failed poll.
+	pollRetryDelay = time.Second
+	// maxPostSize limits the signals posted at once.
+	maxPostSize = 1 << 20
+)
+
+// LongPollHandler is the server side of signaling over HTTP long
+// polling, for clients which cannot keep a websocket open. The client
+// POSTs a JSON array of signals, and GETs the signals sent to it,
+// which waits up to PollTimeout for any. It serves a single peer.
+type LongPollHandler struct {
+	SignalerCallbacks
+	PollTimeout time.Duration
+
+	queue []SignalBody
+	// ready is closed and replaced whenever signals are queued.
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+}
+
+var (
+	_ Signaler     = (*LongPollHandler)(nil)
+	_ http.Handler = (*LongPollHandler)(nil)
+)
+
+func NewLongPollHandler() *LongPollHandler {
+	return &LongPollHandler{
+		PollTimeout: defaultPollTimeout,
+		ready:       make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Send queues body for the next poll.
+func (h *LongPollHandler) Send(body SignalBody) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.closed:
+		return ErrSignalerClosed
+	default:
+	}
+	h.queue = append(h.queue, body)
+	close(h.ready)
+	h.ready = make(chan struct{})
+	return nil
+}
+
+func (h *LongPollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-h.closed:
+		http.Error(w, "signaler closed", http.StatusGone)
+		return
+	default:
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.poll(w, r)
+	case http.MethodPost:
+		var bodies []SignalBody
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostSize)).Decode(&bodies)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		for _, body := range bodies {
+			h.callOnMessage(body)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// poll responds with the queued signals, or 204 No Content if none
+// were queued within PollTimeout.
+func (h *LongPollHandler) poll(w http.ResponseWriter, r *http.Request) {
+	timeout := time.NewTimer(h.PollTimeout)
+	defer timeout.Stop()
+	for {
+		h.mu.Lock()
+		queue, ready := h.queue, h.ready
+		h.queue = nil
+		h.mu.Unlock()
+		if len(queue) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(queue)
+			return
+		}
+		select {
+		case <-ready:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		case <-h.closed:
+			http.Error(w, "signaler closed", http.StatusGone)
+			return
+		}
+	}
+}
+
+// Close ends pending polls, and answers further requests with
+// 410 Gone.
+func (h *LongPollHandler) Close() error {
+	h.once.Do(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		close(h.closed)
+	})
+	return nil
+}
+
+// LongPollSignaler is the client side of a LongPollHandler at URL.
+type LongPollSignaler struct {
+	SignalerCallbacks
+	URL    string
+	Client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	sendMu sync.Mutex
+}
+
+var _ Signaler = (*LongPollSignaler)(nil)
+
+func NewLongPollSignaler(url string) *LongPollSignaler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LongPollSignaler{
+		URL:    url,
+		Client: http.DefaultClient,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start starts polling. Call it once the callbacks are registered.
+func (s *LongPollSignaler) Start() {
+	go s.pollLoop()
+}
+
+func (s *LongPollSignaler) pollLoop() {
+	for s.ctx.Err() == nil {
+		bodies, err := s.poll()
+		if err == errGone {
+			return
+		}
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.callOnError(err)
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+		for _, body := range bodies {
+			s.callOnMessage(body)
+		}
+	}
+}
+
+var errGone = errors.New("long poll: signaler gone")
+
+func (s *LongPollSignaler) poll() ([]SignalBody, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		var bodies []SignalBody
+		err := json.NewDecoder(res.Body).Decode(&bodies)
+		return bodies, err
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusGone:
+		return nil, errGone
+	default:
+		return nil, fmt.Errorf("long poll: %s", res.Status)
+	}
+}
+
+// Send posts body. Signals are posted one at a time, to keep them in
+// order.
+func (s *LongPollSignaler) Send(body SignalBody) error {
+	buf, err := json.Marshal([]SignalBody{body})
+	if err != nil {
+		return err
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.ctx.Err() != nil {
+		return ErrSignalerClosed
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.URL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("long poll: %s", res.Status)
+	}
+	return nil
+}
+
+// Close stops polling.
+func (s *LongPollSignaler) Close() error {
+	s.cancel()
+	return nil
+}
@@ -3,8 +3,14 @@
 package negotiation
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/ravenbox/raven-prototype/pkg/utils"
 
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -14,33 +20,151 @@ type Negotiator struct {
 	Signaler Signaler
 	Polite   bool
 	OnError  func(error)
+	// OnStateChange is called whenever the Negotiator enters a State.
+	OnStateChange func(State)
+	// OnRemoteRestart is called when signals of a new session arrive,
+	// as the remote peer replaced its PeerConnection. PeerConn can
+	// rarely follow, e.g. as the DTLS fingerprint changed, so it should
+	// be replaced too. ErrRemoteRestarted is reported if nil.
+	OnRemoteRestart func()
+
+	// CodecPreferences are set on the transceivers of each kind before
+	// an offer or answer is created.
+	CodecPreferences map[webrtc.RTPCodecType][]webrtc.RTPCodecParameters
+	// Direction overrides the direction of a transceiver in the
+	// descriptions sent, e.g. to offer sendonly. Returning
+	// RTPTransceiverDirectionUnknown keeps the direction.
+	Direction func(*webrtc.RTPTransceiver) webrtc.RTPTransceiverDirection
+	// BeforeCreate is called before an offer or answer is created, e.g.
+	// to add transceivers or change codec preferences.
+	BeforeCreate func(webrtc.SDPType) error
+	// Mungers rewrite descriptions in order before they are sent. The
+	// local description is set unmodified, as pion rejects changes.
+	Mungers []SDPMunger
+
+	// AnswerTimeout is how long an offer waits for its answer before it
+	// is rolled back and retried. Zero waits forever.
+	AnswerTimeout time.Duration
+	// MaxRetries limits the consecutive failed offers which are retried,
+	// RetryDelay times the number of failures apart.
+	MaxRetries int
+	RetryDelay time.Duration
+
+	makingOffer  bool
+	pendingOffer *webrtc.SessionDescription
+	retryPending bool
+
+	// op serializes offers and the handling of remote signals.
+	op          sync.Mutex
+	ignoreOffer bool
+	offers      int
+	failures    int
+	mids        int
+	// candidates arrived before the remote description.
+	candidates []webrtc.ICECandidateInit
 
-	makingOffer                  bool
-	ignoreOffer                  bool
-	isSettingRemoteAnswerPending bool
+	// session and seq stamp the signals sent.
+	session string
+	seq     uint64
+	sendMu  sync.Mutex
+	// remoteSession, received and descriptionSeq track the signals
+	// received. They are guarded by op.
+	remoteSession   string
+	retiredSessions retiredSessions
+	received        replayWindow
+	descriptionSeq  uint64
+	// remoteOrigin is the o= line of the last remote description set.
+	remoteOrigin sdp.Origin
+
+	state    State
+	changed  chan struct{}
+	counters counters
 
 	registered bool
 	mu         utils.Mutex
 }
 
-type negotiatorOption func(*Negotiator)
+const (
+	politeMidPrefix = "p"
+
+	defaultAnswerTimeout = 10 * time.Second
+	defaultMaxRetries    = 5
+	defaultRetryDelay    = 200 * time.Millisecond
+)
+
+var (
+	ErrAnswerTimeout     = errors.New("timed out waiting for answer")
+	ErrNegotiationFailed = errors.New("negotiation failed, giving up")
+	ErrRemoteRestarted   = errors.New("remote peer restarted its PeerConnection")
+)
+
+// Option configures a Negotiator.
+type Option func(*Negotiator)
 
 var (
-	Polite negotiatorOption = func(n *Negotiator) {
+	Polite Option = func(n *Negotiator) {
 		n.Polite = true
 	}
-	OnError = func(fn func(error)) negotiatorOption {
+	OnError = func(fn func(error)) Option {
 		return func(n *Negotiator) {
 			n.OnError = fn
 		}
 	}
+	OnStateChange = func(fn func(State)) Option {
+		return func(n *Negotiator) {
+			n.OnStateChange = fn
+		}
+	}
+	OnRemoteRestart = func(fn func()) Option {
+		return func(n *Negotiator) {
+			n.OnRemoteRestart = fn
+		}
+	}
+	CodecPreferences = func(kind webrtc.RTPCodecType, codecs ...webrtc.RTPCodecParameters) Option {
+		return func(n *Negotiator) {
+			if n.CodecPreferences == nil {
+				n.CodecPreferences = make(map[webrtc.RTPCodecType][]webrtc.RTPCodecParameters)
+			}
+			n.CodecPreferences[kind] = codecs
+		}
+	}
+	Direction = func(fn func(*webrtc.RTPTransceiver) webrtc.RTPTransceiverDirection) Option {
+		return func(n *Negotiator) {
+			n.Direction = fn
+		}
+	}
+	BeforeCreate = func(fn func(webrtc.SDPType) error) Option {
+		return func(n *Negotiator) {
+			n.BeforeCreate = fn
+		}
+	}
+	Munge = func(mungers ...SDPMunger) Option {
+		return func(n *Negotiator) {
+			n.Mungers = append(n.Mungers, mungers...)
+		}
+	}
+	AnswerTimeout = func(d time.Duration) Option {
+		return func(n *Negotiator) {
+			n.AnswerTimeout = d
+		}
+	}
+	Retry = func(maxRetries int, delay time.Duration) Option {
+		return func(n *Negotiator) {
+			n.MaxRetries = maxRetries
+			n.RetryDelay = delay
+		}
+	}
 )
 
 func NewNegotiator(
-	peerConn *webrtc.PeerConnection, signaler Signaler, opts ...negotiatorOption) *Negotiator {
+	peerConn *webrtc.PeerConnection, signaler Signaler, opts ...Option) *Negotiator {
 	n := Negotiator{
-		PeerConn: peerConn,
-		Signaler: signaler,
+		PeerConn:      peerConn,
+		Signaler:      signaler,
+		AnswerTimeout: defaultAnswerTimeout,
+		MaxRetries:    defaultMaxRetries,
+		RetryDelay:    defaultRetryDelay,
+		session:       newSessionID(),
 	}
 	for _, opt := range opts {
 		opt(&n)
@@ -49,7 +173,7 @@ func NewNegotiator(
 }
 
 func NewRegisteredNegotiator(
-	peerConn *webrtc.PeerConnection, signaler Signaler, opts ...negotiatorOption) *Negotiator {
+	peerConn *webrtc.PeerConnection, signaler Signaler, opts ...Option) *Negotiator {
 	n := NewNegotiator(peerConn, signaler, opts...)
 	n.Register()
 	return n
@@ -74,11 +198,12 @@ func (n *Negotiator) Register() {
 }
 
 func (n *Negotiator) onICECandidate(c *webrtc.ICECandidate) {
-	if c == nil {
-		return
+	// An empty candidate signals the end of candidates.
+	cInit := webrtc.ICECandidateInit{}
+	if c != nil {
+		cInit = c.ToJSON()
 	}
-	cInit := c.ToJSON()
-	err := n.Signaler.Send(SignalBody{
+	err := n.send(SignalBody{
 		Candidate: &cInit,
 	})
 	if err != nil {
@@ -87,79 +212,320 @@ func (n *Negotiator) onICECandidate(c *webrtc.ICECandidate) {
 }
 
 func (n *Negotiator) onNegotiationNeeded() {
+	n.op.Lock()
+	defer n.op.Unlock()
+	n.negotiate()
+}
+
+// negotiate sends an offer, unless one is pending or a retry is
+// scheduled. It requires n.op to be held.
+func (n *Negotiator) negotiate() {
+	var busy bool
+	n.mu.Tx(func() { busy = n.pendingOffer != nil || n.retryPending })
+	// pion fires negotiationneeded again once stable.
+	if busy || n.PeerConn.SignalingState() != webrtc.SignalingStateStable {
+		return
+	}
 	n.mu.Tx(func() { n.makingOffer = true })
+	defer func() {
+		n.mu.Tx(func() { n.makingOffer = false })
+		n.notify()
+	}()
+	n.setState(StateOffering)
+	if err := n.makeOffer(); err != nil {
+		n.offerFailed(err)
+	}
+}
+
+// makeOffer creates and sends an offer. pion rejects a rollback of a
+// local offer (have-local-offer->SetLocal(rollback) is not among its
+// signaling state transitions), so the offer is set only once its
+// answer arrives and is simply discarded to roll back.
+func (n *Negotiator) makeOffer() error {
+	if n.Polite {
+		n.assignMids()
+	}
+	if err := n.prepare(webrtc.SDPTypeOffer); err != nil {
+		return err
+	}
 	offer, err := n.PeerConn.CreateOffer(nil)
 	if err != nil {
-		n.handleError(err)
+		return err
+	}
+	sent, err := n.munge(offer)
+	if err != nil {
+		return err
+	}
+	n.mu.Tx(func() { n.pendingOffer = &offer })
+	if err := n.send(SignalBody{Description: &sent}); err != nil {
+		return err
+	}
+	n.offers++
+	if n.AnswerTimeout > 0 {
+		offers := n.offers
+		time.AfterFunc(n.AnswerTimeout, func() { n.answerTimedOut(offers) })
+	}
+	return nil
+}
+
+// assignMids gives new transceivers MIDs which cannot collide with the
+// numeric ones pion assigns on the impolite peer. pion assigns MIDs in
+// CreateOffer and keeps them when an offer is discarded, which is what
+// a rollback would undo.
+func (n *Negotiator) assignMids() {
+	for _, t := range n.PeerConn.GetTransceivers() {
+		if t.Mid() != "" {
+			continue
+		}
+		n.mids++
+		if err := t.SetMid(fmt.Sprint(politeMidPrefix, n.mids)); err != nil {
+			n.handleError(err)
+		}
+	}
+}
+
+// answerTimedOut gives up on the offers-th offer if it is still
+// unanswered.
+func (n *Negotiator) answerTimedOut(offers int) {
+	n.op.Lock()
+	defer n.op.Unlock()
+	var pending bool
+	n.mu.Tx(func() { pending = n.pendingOffer != nil })
+	if n.offers == offers && pending {
+		n.offerFailed(ErrAnswerTimeout)
+	}
+}
+
+// offerFailed reports err, rolls back the pending offer and schedules
+// a retry. It requires n.op to be held.
+func (n *Negotiator) offerFailed(err error) {
+	n.handleError(err)
+	n.rollback()
+	if n.PeerConn.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	n.failures++
+	if n.failures > n.MaxRetries {
+		n.failures = 0
+		n.handleError(ErrNegotiationFailed)
+		return
+	}
+	n.mu.Tx(func() { n.retryPending = true })
+	time.AfterFunc(n.RetryDelay*time.Duration(n.failures), func() {
+		n.op.Lock()
+		defer n.op.Unlock()
+		n.mu.Tx(func() { n.retryPending = false })
+		n.notify()
+		n.negotiate()
+	})
+}
+
+// rollback discards the pending offer, if any.
+func (n *Negotiator) rollback() {
+	var pending bool
+	n.mu.Tx(func() {
+		pending = n.pendingOffer != nil
+		n.pendingOffer = nil
+	})
+	if pending {
+		n.setState(StateRollback)
+	}
+}
+
+// send stamps s with the session and the next sequence number, and
+// sends it.
+func (n *Negotiator) send(s SignalBody) error {
+	n.sendMu.Lock()
+	defer n.sendMu.Unlock()
+	n.seq++
+	s.Session = n.session
+	s.Seq = n.seq
+	return n.Signaler.Send(s)
+}
+
+func (n *Negotiator) onMessage(s SignalBody) {
+	n.op.Lock()
+	defer n.op.Unlock()
+	if !n.accept(s) {
+		n.counters.droppedSignals.Add(1)
+		return
+	}
+	if description := s.Description; description != nil {
+		n.onDescription(*description)
+	}
+	if candidate := s.Candidate; candidate != nil {
+		n.onCandidate(*candidate)
+	}
+}
+
+// accept reports whether s should be handled: duplicates, descriptions
+// older than the last one received and signals of a replaced session
+// are dropped. A new session means that the remote peer restarted. It
+// requires n.op to be held.
+func (n *Negotiator) accept(s SignalBody) bool {
+	if s.Session == "" {
+		return true
+	}
+	if n.retiredSessions.contains(s.Session) {
+		// A late signal of the replaced PeerConnection.
+		return false
+	}
+	if s.Session != n.remoteSession {
+		restarted := n.remoteSession != ""
+		if restarted {
+			n.retiredSessions.add(n.remoteSession)
+		}
+		n.remoteSession = s.Session
+		n.received = replayWindow{}
+		n.descriptionSeq = 0
+		if restarted {
+			n.remoteRestarted()
+		}
+	}
+	if !n.received.check(s.Seq) {
+		return false
+	}
+	if s.Description != nil {
+		if s.Seq < n.descriptionSeq {
+			return false
+		}
+		n.descriptionSeq = s.Seq
+	}
+	return true
+}
+
+// remoteRestarted forgets the state of the previous remote session.
+func (n *Negotiator) remoteRestarted() {
+	n.remoteOrigin = sdp.Origin{}
+	n.candidates = nil
+	if n.OnRemoteRestart != nil {
+		n.OnRemoteRestart()
+		return
+	}
+	n.handleError(ErrRemoteRestarted)
+}
+
+// onCandidate adds a remote candidate, or queues it until the remote
+// description is set. It requires n.op to be held.
+func (n *Negotiator) onCandidate(candidate webrtc.ICECandidateInit) {
+	if n.PeerConn.RemoteDescription() == nil {
+		n.candidates = append(n.candidates, candidate)
 		return
 	}
-	err = n.PeerConn.SetLocalDescription(offer)
+	// Candidates of an ignored offer may not apply.
+	if err := n.PeerConn.AddICECandidate(candidate); err != nil && !n.ignoreOffer {
+		n.handleError(err)
+	}
+}
+
+// onDescription applies a remote description. It requires n.op to be
+// held.
+func (n *Negotiator) onDescription(description webrtc.SessionDescription) {
+	stale, err := n.isStale(description)
 	if err != nil {
 		n.handleError(err)
 		return
 	}
-	err = n.Signaler.Send(SignalBody{
-		Description: n.PeerConn.LocalDescription(),
+	if stale {
+		// A late or duplicated description, e.g. an offer which the
+		// remote peer rolled back since.
+		return
+	}
+	switch description.Type {
+	case webrtc.SDPTypeOffer:
+		n.onOffer(description)
+	case webrtc.SDPTypeAnswer:
+		n.onAnswer(description)
+	default:
+		n.handleError(n.setRemoteDescription(description))
+	}
+}
+
+func (n *Negotiator) onAnswer(answer webrtc.SessionDescription) {
+	var offer *webrtc.SessionDescription
+	n.mu.Tx(func() { offer = n.pendingOffer })
+	if offer == nil || !sameMids(*offer, answer) {
+		// An answer to an offer which is gone.
+		return
+	}
+	n.mu.Tx(func() { n.pendingOffer = nil })
+	if err := n.PeerConn.SetLocalDescription(*offer); err != nil {
+		n.offerFailed(err)
+		return
+	}
+	if err := n.setRemoteDescription(answer); err != nil {
+		n.offerFailed(err)
+		return
+	}
+	n.failures = 0
+	n.setState(StateStable)
+}
+
+func (n *Negotiator) onOffer(offer webrtc.SessionDescription) {
+	var offerCollision bool
+	n.mu.Tx(func() {
+		offerCollision = n.pendingOffer != nil ||
+			n.PeerConn.SignalingState() != webrtc.SignalingStateStable
 	})
-	if err != nil {
+	n.ignoreOffer = !n.Polite && offerCollision
+	if n.ignoreOffer {
+		n.setState(StateCollisionIgnored)
+		return
+	}
+	if offerCollision {
+		n.rollback()
+	}
+
+	if err := n.setRemoteDescription(offer); err != nil {
 		n.handleError(err)
 		return
 	}
-	n.mu.Tx(func() { n.makingOffer = false })
-	n.makingOffer = false
+	n.setState(StateAnswering)
+	if err := n.answer(); err != nil {
+		n.handleError(err)
+		return
+	}
+	n.setState(StateStable)
 }
 
-func (n *Negotiator) onMessage(s SignalBody) {
-	if description := s.Description; description != nil {
-		var (
-			readyForOffer  bool
-			offerCollision bool
-		)
-		n.mu.Tx(func() {
-			readyForOffer = !n.makingOffer &&
-				(n.PeerConn.SignalingState() == webrtc.SignalingStateStable ||
-					n.isSettingRemoteAnswerPending)
-			offerCollision = description.Type == webrtc.SDPTypeOffer && !readyForOffer
-		})
-		if ignore := !n.Polite && offerCollision; ignore {
-			return
-		}
-
-		n.mu.Tx(func() {
-			n.isSettingRemoteAnswerPending = description.Type == webrtc.SDPTypeAnswer
-		})
-		n.PeerConn.SetRemoteDescription(*description)
-		n.mu.Tx(func() {
-			n.isSettingRemoteAnswerPending = false
-		})
-
-		if description.Type == webrtc.SDPTypeOffer {
-			answer, err := n.PeerConn.CreateAnswer(nil)
-			if err != nil {
-				n.handleError(err)
-				return
-			}
-			err = n.PeerConn.SetLocalDescription(answer)
-			if err != nil {
-				n.handleError(err)
-				return
-			}
-			err = n.Signaler.Send(SignalBody{
-				Description: &answer,
-			})
-			if err != nil {
-				n.handleError(err)
-				return
-			}
+func (n *Negotiator) answer() error {
+	if err := n.prepare(webrtc.SDPTypeAnswer); err != nil {
+		return err
+	}
+	answer, err := n.PeerConn.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := n.PeerConn.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	if answer, err = n.munge(answer); err != nil {
+		return err
+	}
+	return n.send(SignalBody{Description: &answer})
+}
+
+// prepare runs BeforeCreate and applies the codec preferences before a
+// description of type typ is created.
+func (n *Negotiator) prepare(typ webrtc.SDPType) error {
+	if n.BeforeCreate != nil {
+		if err := n.BeforeCreate(typ); err != nil {
+			return err
 		}
 	}
-	if candidate := s.Candidate; candidate != nil {
-		err := n.PeerConn.AddICECandidate(*candidate)
-		if err != nil {
-			n.handleError(err)
-			return
+	if len(n.CodecPreferences) == 0 {
+		return nil
+	}
+	for _, t := range n.PeerConn.GetTransceivers() {
+		codecs, ok := n.CodecPreferences[t.Kind()]
+		if !ok {
+			continue
+		}
+		if err := t.SetCodecPreferences(codecs); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func (n *Negotiator) onSignalerError(err error) {
@@ -170,6 +536,7 @@ func (n *Negotiator) handleError(err error) {
 	if err == nil {
 		return
 	}
+	n.counters.errors.Add(1)
 	if n.OnError != nil {
 		n.OnError(err)
 	}
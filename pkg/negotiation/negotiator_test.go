@@ -1,9 +1,12 @@
 package negotiation_test
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -344,3 +347,480 @@ func Test_MultipleDataTracksNegotiation(t *testing.T) {
 		t.Fatal("test timeout")
 	}
 }
+
+func Test_NegotiationHooks(t *testing.T) {
+	config := webrtc.Configuration{}
+	pc1, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc1.Close()
+
+	pc2, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc2.Close()
+
+	sig1, sig2 := negotiation.DummySignalersPipeline(nil, nil)
+	defer sig1.Close()
+	defer sig2.Close()
+
+	vp8 := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	}
+	var answers int
+	negotiation.NewRegisteredNegotiator(pc1, sig1,
+		negotiation.CodecPreferences(webrtc.RTPCodecTypeVideo, vp8),
+		negotiation.Direction(func(tr *webrtc.RTPTransceiver) webrtc.RTPTransceiverDirection {
+			if tr.Kind() == webrtc.RTPCodecTypeAudio {
+				return webrtc.RTPTransceiverDirectionRecvonly
+			}
+			return webrtc.RTPTransceiverDirectionUnknown
+		}),
+		negotiation.Munge(
+			negotiation.Bandwidth(webrtc.RTPCodecTypeVideo, 500),
+			negotiation.Fmtp("opus", map[string]string{"stereo": "1"}),
+		),
+	)
+	negotiation.NewRegisteredNegotiator(pc2, sig2, negotiation.Polite,
+		negotiation.BeforeCreate(func(typ webrtc.SDPType) error {
+			if typ == webrtc.SDPTypeAnswer {
+				answers++
+			}
+			return nil
+		}))
+
+	track, err := webrtc.NewTrackLocalStaticSample(vp8.RTPCodecCapability, "video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc1.AddTrack(track); err != nil {
+		t.Fatal("Failed to add track:", err)
+	}
+	if _, err := pc1.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal("Failed to add transceiver:", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pc2.RemoteDescription() == nil || pc1.SignalingState() != webrtc.SignalingStateStable {
+		if time.Now().After(deadline) {
+			t.Fatal("negotiation timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	offer := pc2.RemoteDescription().SDP
+	t.Log(offer)
+	video, audio, _ := strings.Cut(offer, "m=audio")
+	if strings.Contains(video, "H264") || !strings.Contains(video, "VP8/90000") {
+		t.Error("Expected VP8 to be the only video codec")
+	}
+	if !strings.Contains(video, "b=AS:500") || !strings.Contains(video, "b=TIAS:500000") {
+		t.Error("Expected bandwidth lines in the video section")
+	}
+	if !strings.Contains(audio, "a=recvonly") || strings.Contains(audio, "a=sendrecv") {
+		t.Error("Expected the audio section to be recvonly")
+	}
+	if !strings.Contains(audio, "stereo=1") {
+		t.Error("Expected stereo Opus")
+	}
+	if answers != 1 {
+		t.Errorf("Expected BeforeCreate to be called for 1 answer, got %d", answers)
+	}
+}
+
+func Test_WaitStable(t *testing.T) {
+	config := webrtc.Configuration{}
+	pc1, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc1.Close()
+
+	pc2, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc2.Close()
+
+	sig1, sig2 := negotiation.DummySignalersPipeline(nil, nil)
+	defer sig1.Close()
+	defer sig2.Close()
+
+	var (
+		states []negotiation.State
+		mu     sync.Mutex
+	)
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig1,
+		negotiation.OnStateChange(func(s negotiation.State) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, s)
+		}))
+	neg2 := negotiation.NewRegisteredNegotiator(pc2, sig2, negotiation.Polite)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		"audio", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc1.AddTrack(track)
+	if err != nil {
+		t.Fatal("Failed to add track:", err)
+	}
+	if err := neg1.WaitStable(ctx); err != nil {
+		t.Fatal("Negotiation after AddTrack did not complete:", err)
+	}
+	if len(pc2.GetTransceivers()) != 1 {
+		t.Fatal("Expected the remote peer to have a transceiver")
+	}
+
+	if err := pc1.RemoveTrack(sender); err != nil {
+		t.Fatal("Failed to remove track:", err)
+	}
+	if err := neg1.WaitStable(ctx); err != nil {
+		t.Fatal("Negotiation after RemoveTrack did not complete:", err)
+	}
+	if err := neg2.WaitStable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats1, stats2 := neg1.Stats(), neg2.Stats()
+	t.Logf("neg1: %+v, neg2: %+v", stats1, stats2)
+	if stats1.Offers != 2 || stats1.Completed != 2 || stats2.Answers != 2 {
+		t.Errorf("Expected 2 rounds, got %+v and %+v", stats1, stats2)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []negotiation.State{
+		negotiation.StateOffering, negotiation.StateStable,
+		negotiation.StateOffering, negotiation.StateStable,
+	}
+	if !slices.Equal(states, want) {
+		t.Errorf("Expected states %v, got %v", want, states)
+	}
+}
+
+func Test_NegotiationFuzz(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode")
+	}
+	for seed := int64(1); seed <= 8; seed++ {
+		t.Run(fmt.Sprint("seed", seed), func(t *testing.T) {
+			testNegotiationFuzz(t, seed)
+		})
+	}
+}
+
+// testNegotiationFuzz adds tracks on both peers at once over a lossy
+// signaling channel, and checks that both peers converge.
+func testNegotiationFuzz(t *testing.T, seed int64) {
+	config := webrtc.Configuration{}
+	pc1, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc1.Close()
+
+	pc2, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc2.Close()
+
+	fuzz := func(seed int64) *negotiation.DummySignalerInterceptor {
+		return &negotiation.DummySignalerInterceptor{
+			Fuzz: &negotiation.SignalFuzz{
+				Drop:      0.1,
+				Duplicate: 0.1,
+				Reorder:   0.2,
+				Rand:      rand.New(rand.NewSource(seed)),
+			},
+		}
+	}
+	sig1, sig2 := negotiation.DummySignalersPipeline(fuzz(seed), fuzz(-seed))
+	defer sig1.Close()
+	defer sig2.Close()
+
+	opts := []negotiation.Option{
+		negotiation.AnswerTimeout(200 * time.Millisecond),
+		negotiation.Retry(100, 10*time.Millisecond),
+	}
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig1, opts...)
+	neg2 := negotiation.NewRegisteredNegotiator(pc2, sig2,
+		append(opts, negotiation.Polite)...)
+
+	addTracks := func(pc *webrtc.PeerConnection, mimeType string) error {
+		for i := 0; i < 2; i++ {
+			track, err := webrtc.NewTrackLocalStaticSample(
+				webrtc.RTPCodecCapability{MimeType: mimeType},
+				fmt.Sprint(mimeType, i), "stream")
+			if err != nil {
+				return err
+			}
+			if _, err := pc.AddTrack(track); err != nil {
+				return err
+			}
+			time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		}
+		return nil
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for pc, mimeType := range map[*webrtc.PeerConnection]string{
+		pc1: webrtc.MimeTypeOpus,
+		pc2: webrtc.MimeTypeVP8,
+	} {
+		wg.Add(1)
+		go func(pc *webrtc.PeerConnection, mimeType string) {
+			defer wg.Done()
+			errs <- addTracks(pc, mimeType)
+		}(pc, mimeType)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Failed to add track:", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	// Each peer may have to offer again once the other is stable.
+	for i := 0; i < 3; i++ {
+		if err := neg1.WaitStable(ctx); err != nil {
+			t.Fatalf("neg1 did not converge: %v (%+v)", err, neg1.Stats())
+		}
+		if err := neg2.WaitStable(ctx); err != nil {
+			t.Fatalf("neg2 did not converge: %v (%+v)", err, neg2.Stats())
+		}
+	}
+
+	transceivers := func(pc *webrtc.PeerConnection) map[string]webrtc.RTPCodecType {
+		kinds := make(map[string]webrtc.RTPCodecType)
+		for _, tr := range pc.GetTransceivers() {
+			kinds[tr.Mid()] = tr.Kind()
+		}
+		return kinds
+	}
+	t1, t2 := transceivers(pc1), transceivers(pc2)
+	t.Logf("neg1: %+v, neg2: %+v", neg1.Stats(), neg2.Stats())
+	if len(t1) != 4 || fmt.Sprint(t1) != fmt.Sprint(t2) {
+		t.Errorf("Expected the same 4 transceivers, got %v and %v", t1, t2)
+	}
+}
+
+func Test_EarlyCandidates(t *testing.T) {
+	config := webrtc.Configuration{}
+	pc1, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc1.Close()
+
+	pc2, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc2.Close()
+
+	identity := func(s negotiation.SignalBody) negotiation.SignalBody { return s }
+	ch1 := make(chan negotiation.SignalBody, 32)
+	ch2 := make(chan negotiation.SignalBody, 32)
+	sig1 := negotiation.NewChanSignaler(ch1, identity)
+	sig2 := negotiation.NewChanSignaler(ch2, identity)
+
+	var (
+		errs []error
+		mu   sync.Mutex
+	)
+	onError := negotiation.OnError(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig1, onError)
+	negotiation.NewRegisteredNegotiator(pc2, sig2, negotiation.Polite, onError)
+
+	go func() {
+		for s := range ch1 {
+			sig2.CallOnMessage(s)
+		}
+	}()
+	// The answer of pc2 is held back until all its candidates were
+	// delivered.
+	endOfCandidates := make(chan struct{})
+	go func() {
+		var held []negotiation.SignalBody
+		for s := range ch2 {
+			switch {
+			case s.Description != nil && held != nil:
+				sig1.CallOnMessage(s)
+			case s.Description != nil:
+				held = append(held, s)
+			case s.Candidate.Candidate == "":
+				sig1.CallOnMessage(s)
+				close(endOfCandidates)
+				for _, s := range held {
+					sig1.CallOnMessage(s)
+				}
+				held = []negotiation.SignalBody{}
+			default:
+				sig1.CallOnMessage(s)
+			}
+		}
+	}()
+
+	connected := make(chan struct{})
+	pc1.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		if s == webrtc.ICEConnectionStateConnected {
+			close(connected)
+		}
+	})
+	if _, err := pc1.CreateDataChannel("data", nil); err != nil {
+		t.Fatal("Could not create data channel:", err)
+	}
+
+	select {
+	case <-endOfCandidates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("End of candidates was not signaled")
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ICE did not connect with the queued candidates")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := neg1.WaitStable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) > 0 {
+		t.Error("Expected no errors, got", errs)
+	}
+}
+
+func Test_SignalSequencing(t *testing.T) {
+	config := webrtc.Configuration{}
+	newPeerConnection := func() *webrtc.PeerConnection {
+		pc, err := webrtc.NewPeerConnection(config)
+		if err != nil {
+			t.Fatal("Failed to create webrtc PeerConnection:", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	pc1, pc2 := newPeerConnection(), newPeerConnection()
+
+	identity := func(s negotiation.SignalBody) negotiation.SignalBody { return s }
+	newSignaler := func() (negotiation.ChanSignaler, chan negotiation.SignalBody) {
+		ch := make(chan negotiation.SignalBody, 32)
+		return negotiation.NewChanSignaler(ch, identity), ch
+	}
+	sig1, ch1 := newSignaler()
+	sig2, ch2 := newSignaler()
+	// Every signal is delivered twice.
+	pipe := func(ch chan negotiation.SignalBody, to negotiation.ChanSignaler) {
+		for s := range ch {
+			to.CallOnMessage(s)
+			to.CallOnMessage(s)
+		}
+	}
+	go pipe(ch1, sig2)
+	go pipe(ch2, sig1)
+
+	var (
+		errs []error
+		mu   sync.Mutex
+	)
+	onError := negotiation.OnError(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+	restarted := make(chan struct{})
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig1, onError)
+	neg2 := negotiation.NewRegisteredNegotiator(pc2, sig2, negotiation.Polite, onError,
+		negotiation.OnRemoteRestart(func() { close(restarted) }))
+
+	addTrack(t, pc1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := neg1.WaitStable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := neg2.WaitStable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats1, stats2 := neg1.Stats(), neg2.Stats()
+	t.Logf("neg1: %+v, neg2: %+v", stats1, stats2)
+	if stats2.Answers != 1 || stats2.DroppedSignals == 0 || stats1.DroppedSignals == 0 {
+		t.Errorf("Expected duplicates to be dropped, got %+v and %+v", stats1, stats2)
+	}
+	mu.Lock()
+	if len(errs) > 0 {
+		t.Error("Expected no errors, got", errs)
+	}
+	mu.Unlock()
+
+	// The remote peer comes back with a new PeerConnection.
+	pc3 := newPeerConnection()
+	sig3, ch3 := newSignaler()
+	go pipe(ch3, sig2)
+	negotiation.NewRegisteredNegotiator(pc3, sig3)
+	addTrack(t, pc3)
+	select {
+	case <-restarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Remote restart was not detected")
+	}
+}
+
+func addTrack(t *testing.T, pc *webrtc.PeerConnection) {
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		"audio", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal("Failed to add track:", err)
+	}
+}
+
+// Test_LocalRollback pins that pion cannot roll back a local offer,
+// which the Negotiator works around by setting its offers late. Once
+// this fails, glare can be resolved with a rollback instead.
+func Test_LocalRollback(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback, SDP: offer.SDP}
+	if err := pc.SetLocalDescription(rollback); err == nil {
+		t.Error("pion rolled back a local offer")
+	}
+	if state := pc.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+		t.Errorf("Got signaling state %s after a rollback, want have-local-offer", state)
+	}
+}
@@ -0,0 +1,196 @@
+package negotiation
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// SDPMunger rewrites a description of type typ before it is sent.
+type SDPMunger func(desc *sdp.SessionDescription, typ webrtc.SDPType) error
+
+// Bandwidth limits the media sections of kind to kbps with a b=AS line,
+// and a b=TIAS line in bits per second.
+func Bandwidth(kind webrtc.RTPCodecType, kbps uint64) SDPMunger {
+	return func(desc *sdp.SessionDescription, _ webrtc.SDPType) error {
+		for _, m := range desc.MediaDescriptions {
+			if m.MediaName.Media != kind.String() {
+				continue
+			}
+			m.Bandwidth = []sdp.Bandwidth{
+				{Type: "AS", Bandwidth: kbps},
+				{Type: "TIAS", Bandwidth: kbps * 1000},
+			}
+		}
+		return nil
+	}
+}
+
+// Fmtp merges params into the format parameters of codec, e.g.
+// Fmtp("opus", map[string]string{"stereo": "1", "usedtx": "1"}).
+func Fmtp(codec string, params map[string]string) SDPMunger {
+	return func(desc *sdp.SessionDescription, _ webrtc.SDPType) error {
+		for _, m := range desc.MediaDescriptions {
+			for _, pt := range payloadTypes(m, codec) {
+				setFmtp(m, pt, params)
+			}
+		}
+		return nil
+	}
+}
+
+// payloadTypes returns the payload types m maps to codec.
+func payloadTypes(m *sdp.MediaDescription, codec string) []string {
+	pts := []string{}
+	for _, a := range m.Attributes {
+		if a.Key != "rtpmap" {
+			continue
+		}
+		pt, encoding, ok := strings.Cut(a.Value, " ")
+		name, _, _ := strings.Cut(encoding, "/")
+		if ok && strings.EqualFold(name, codec) {
+			pts = append(pts, pt)
+		}
+	}
+	return pts
+}
+
+func setFmtp(m *sdp.MediaDescription, pt string, params map[string]string) {
+	for i, a := range m.Attributes {
+		value, found := strings.CutPrefix(a.Value, pt+" ")
+		if a.Key != "fmtp" || !found {
+			continue
+		}
+		m.Attributes[i].Value = pt + " " + mergeFmtp(value, params)
+		return
+	}
+	m.Attributes = append(m.Attributes, sdp.NewAttribute("fmtp", pt+" "+mergeFmtp("", params)))
+}
+
+func mergeFmtp(fmtp string, params map[string]string) string {
+	merged := []string{}
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(fmtp, ";") {
+		key, _, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if key == "" {
+			continue
+		}
+		if v, ok := params[key]; ok {
+			p = key + "=" + v
+		}
+		seen[key] = true
+		merged = append(merged, strings.TrimSpace(p))
+	}
+	for key, v := range params {
+		if !seen[key] {
+			merged = append(merged, key+"="+v)
+		}
+	}
+	return strings.Join(merged, ";")
+}
+
+// mungeDirections rewrites the direction of each media section whose
+// transceiver n.Direction overrides.
+func (n *Negotiator) mungeDirections(desc *sdp.SessionDescription, _ webrtc.SDPType) error {
+	directions := make(map[string]webrtc.RTPTransceiverDirection)
+	for _, t := range n.PeerConn.GetTransceivers() {
+		if d := n.Direction(t); d != webrtc.RTPTransceiverDirectionUnknown && t.Mid() != "" {
+			directions[t.Mid()] = d
+		}
+	}
+	for _, m := range desc.MediaDescriptions {
+		mid, _ := m.Attribute("mid")
+		d, ok := directions[mid]
+		if !ok {
+			continue
+		}
+		attrs := m.Attributes[:0]
+		for _, a := range m.Attributes {
+			switch a.Key {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+			default:
+				attrs = append(attrs, a)
+			}
+		}
+		m.Attributes = append(attrs, sdp.NewPropertyAttribute(d.String()))
+	}
+	return nil
+}
+
+// munge applies the direction overrides and n.Mungers to a copy of
+// desc.
+func (n *Negotiator) munge(desc webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	mungers := n.Mungers
+	if n.Direction != nil {
+		mungers = append([]SDPMunger{n.mungeDirections}, mungers...)
+	}
+	if len(mungers) == 0 {
+		return desc, nil
+	}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return desc, err
+	}
+	for _, m := range mungers {
+		if err := m(parsed, desc.Type); err != nil {
+			return desc, fmt.Errorf("munging %s: %w", desc.Type, err)
+		}
+	}
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return desc, err
+	}
+	return webrtc.SessionDescription{Type: desc.Type, SDP: string(raw)}, nil
+}
+
+// sameMids reports whether answer has the media sections of offer.
+func sameMids(offer, answer webrtc.SessionDescription) bool {
+	mids := func(desc webrtc.SessionDescription) []string {
+		parsed, err := desc.Unmarshal()
+		if err != nil {
+			return nil
+		}
+		mids := []string{}
+		for _, m := range parsed.MediaDescriptions {
+			mid, _ := m.Attribute("mid")
+			mids = append(mids, mid)
+		}
+		return mids
+	}
+	return slices.Equal(mids(offer), mids(answer))
+}
+
+// isStale reports whether desc is older than the last remote
+// description set. Each description a peer creates has a greater
+// session version (RFC 3264, section 8).
+func (n *Negotiator) isStale(desc webrtc.SessionDescription) (bool, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return false, err
+	}
+	origin := parsed.Origin
+	return origin.SessionID == n.remoteOrigin.SessionID &&
+		origin.SessionVersion <= n.remoteOrigin.SessionVersion, nil
+}
+
+// setRemoteDescription sets desc, remembers its origin and adds the
+// candidates which arrived before it.
+func (n *Negotiator) setRemoteDescription(desc webrtc.SessionDescription) error {
+	if err := n.PeerConn.SetRemoteDescription(desc); err != nil {
+		return err
+	}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return err
+	}
+	n.remoteOrigin = parsed.Origin
+	candidates := n.candidates
+	n.candidates = nil
+	for _, c := range candidates {
+		n.onCandidate(c)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package negotiation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+)
+
+// replayWindowSize is the number of sequence numbers below the highest
+// one received that are still told apart from duplicates.
+const replayWindowSize = 64
+
+// retiredSessionsSize is the number of replaced remote sessions whose
+// late signals are still recognized.
+const retiredSessionsSize = 4
+
+// newSessionID returns a random ID for the signals of a PeerConnection.
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// replayWindow tells duplicated sequence numbers apart, like the
+// SRTP replay list (RFC 3711, section 3.3.2).
+type replayWindow struct {
+	max  uint64
+	seen uint64 // bit i is set if max-i was received
+}
+
+// check records seq, and reports whether it was new.
+func (w *replayWindow) check(seq uint64) bool {
+	switch {
+	case seq > w.max:
+		shift := seq - w.max
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.max = seq
+		return true
+	case w.max-seq >= replayWindowSize:
+		return false
+	default:
+		bit := uint64(1) << (w.max - seq)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
+
+// retiredSessions is a ring of the last replaced remote sessions.
+type retiredSessions struct {
+	ids  [retiredSessionsSize]string
+	next int
+}
+
+func (r *retiredSessions) add(id string) {
+	r.ids[r.next] = id
+	r.next = (r.next + 1) % len(r.ids)
+}
+
+func (r *retiredSessions) contains(id string) bool {
+	return id != "" && slices.Contains(r.ids[:], id)
+}
@@ -3,11 +3,16 @@ package negotiation
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
+var ErrSignalerClosed = errors.New("send on closed signaler")
+
 type Signaler interface {
 	Send(SignalBody) error
 	OnMessage(func(SignalBody))
@@ -18,6 +23,11 @@ type Signaler interface {
 type SignalBody struct {
 	Candidate   *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
 	Description *webrtc.SessionDescription `json:"description,omitempty"`
+	// Session identifies the PeerConnection of the sender, and Seq
+	// numbers its signals from 1. Signals without them are accepted
+	// as they come.
+	Session string `json:"session,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
 }
 
 func (s SignalBody) Type() string {
@@ -74,18 +84,43 @@ type DummySignalerInterceptor struct {
 	// BeforeRecv interrupts reading loop. It can be used to
 	// simulate network latency and similar stuff.
 	BeforeRecv func(*SignalBody) error
+	// Fuzz makes sent messages unreliable, after BeforeSend.
+	Fuzz *SignalFuzz
+}
+
+// SignalFuzz drops, duplicates and reorders messages with the given
+// probabilities, to test the recovery from a lossy signaling channel.
+type SignalFuzz struct {
+	Drop      float64
+	Duplicate float64
+	// Reorder holds a message back until the next one was sent, or
+	// reorderWindow passed.
+	Reorder float64
+	// Rand is the source of randomness, seeded for reproducible runs.
+	// The global source is used if nil.
+	Rand *rand.Rand
+}
+
+const reorderWindow = 50 * time.Millisecond
+
+func (f *SignalFuzz) chance(p float64) bool {
+	if f.Rand != nil {
+		return f.Rand.Float64() < p
+	}
+	return rand.Float64() < p
 }
 
 type dummySignalerPipelineEndpoint struct {
 	DummySignalerInterceptor
-
-	onMessageCallback func(SignalBody)
-	onErrorCallback   func(error)
+	SignalerCallbacks
 
 	output chan<- SignalBody
 	input  <-chan SignalBody
 	err    chan error
 	closed chan struct{}
+
+	fuzzMu sync.Mutex
+	held   *SignalBody
 }
 
 var _ Signaler = (*dummySignalerPipelineEndpoint)(nil)
@@ -109,18 +144,14 @@ func (d *dummySignalerPipelineEndpoint) Start() {
 					d.FireError(err)
 				}
 			}
-			if d.onMessageCallback != nil {
-				d.onMessageCallback(body)
-			}
+			d.callOnMessage(body)
 		}
 	}()
 
 	// Error loop:
 	go func() {
 		for err := range d.err {
-			if d.onErrorCallback != nil {
-				d.onErrorCallback(err)
-			}
+			d.callOnError(err)
 		}
 	}()
 }
@@ -142,21 +173,57 @@ func (d *dummySignalerPipelineEndpoint) Send(body SignalBody) error {
 			return err
 		}
 	}
+	if d.Fuzz != nil {
+		return d.fuzzSend(body)
+	}
+	return d.send(body)
+}
+
+func (d *dummySignalerPipelineEndpoint) send(body SignalBody) error {
 	select {
 	case <-d.closed:
-		return errors.New("send on closed signaler")
+		return ErrSignalerClosed
 	default:
 		d.output <- body
 	}
 	return nil
 }
 
-func (d *dummySignalerPipelineEndpoint) OnMessage(callback func(SignalBody)) {
-	d.onMessageCallback = callback
+func (d *dummySignalerPipelineEndpoint) fuzzSend(body SignalBody) error {
+	d.fuzzMu.Lock()
+	defer d.fuzzMu.Unlock()
+	f := d.Fuzz
+	if f.chance(f.Drop) {
+		return nil
+	}
+	if d.held == nil && f.chance(f.Reorder) {
+		d.held = &body
+		time.AfterFunc(reorderWindow, func() {
+			d.fuzzMu.Lock()
+			defer d.fuzzMu.Unlock()
+			d.flushHeld()
+		})
+		return nil
+	}
+	if err := d.send(body); err != nil {
+		return err
+	}
+	if f.chance(f.Duplicate) {
+		if err := d.send(body); err != nil {
+			return err
+		}
+	}
+	return d.flushHeld()
 }
 
-func (d *dummySignalerPipelineEndpoint) OnError(callback func(error)) {
-	d.onErrorCallback = callback
+// flushHeld sends the message held back for reordering, if any.
+func (d *dummySignalerPipelineEndpoint) flushHeld() error {
+	if d.held == nil {
+		return nil
+	}
+	body := *d.held
+	d.held = nil
+	return d.send(body)
 }
 
 func (d *dummySignalerPipelineEndpoint) Close() error {
@@ -164,19 +231,44 @@ func (d *dummySignalerPipelineEndpoint) Close() error {
 	return nil
 }
 
+// SignalerCallbacks holds the callbacks of a Signaler. They may be
+// registered while signals are received.
 type SignalerCallbacks struct {
 	onMessageCallback func(SignalBody)
 	onErrorCallback   func(error)
+	mu                sync.Mutex
 }
 
 func (s *SignalerCallbacks) OnMessage(callback func(SignalBody)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.onMessageCallback = callback
 }
 
 func (s *SignalerCallbacks) OnError(callback func(error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.onErrorCallback = callback
 }
 
+func (s *SignalerCallbacks) callOnMessage(body SignalBody) {
+	s.mu.Lock()
+	callback := s.onMessageCallback
+	s.mu.Unlock()
+	if callback != nil {
+		callback(body)
+	}
+}
+
+func (s *SignalerCallbacks) callOnError(err error) {
+	s.mu.Lock()
+	callback := s.onErrorCallback
+	s.mu.Unlock()
+	if callback != nil {
+		callback(err)
+	}
+}
+
 type ChanSignaler interface {
 	Signaler
 	CallOnMessage(SignalBody)
@@ -217,13 +309,9 @@ func (s *chanSignaler[T]) Close() error {
 }
 
 func (s *chanSignaler[T]) CallOnMessage(body SignalBody) {
-	if s.onMessageCallback != nil {
-		s.onMessageCallback(body)
-	}
+	s.callOnMessage(body)
 }
 
 func (s *chanSignaler[T]) CallOnError(err error) {
-	if s.onErrorCallback != nil {
-		s.onErrorCallback(err)
-	}
+	s.callOnError(err)
 }
@@ -0,0 +1,165 @@
+package negotiation_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+	"github.com/ravenbox/raven-prototype/pkg/negotiation"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+func newPeerConnections(t *testing.T) (pc1, pc2 *webrtc.PeerConnection) {
+	config := webrtc.Configuration{}
+	pc1, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	t.Cleanup(func() { pc1.Close() })
+	pc2, err = webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	t.Cleanup(func() { pc2.Close() })
+	return pc1, pc2
+}
+
+// negotiateTrack adds a track on pc1 and waits until pc2 got it.
+func negotiateTrack(t *testing.T, pc1, pc2 *webrtc.PeerConnection, neg1, neg2 *negotiation.Negotiator) {
+	addTrack(t, pc1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := neg1.WaitStable(ctx); err != nil {
+		t.Fatal("Negotiation did not complete:", err, neg1.Stats())
+	}
+	if err := neg2.WaitStable(ctx); err != nil {
+		t.Fatal("Negotiation did not complete:", err, neg2.Stats())
+	}
+	if n := len(pc2.GetTransceivers()); n != len(pc1.GetTransceivers()) {
+		t.Fatalf("Expected %d transceivers, got %d", len(pc1.GetTransceivers()), n)
+	}
+}
+
+func Test_WebSocketSignaler(t *testing.T) {
+	pc1, pc2 := newPeerConnections(t)
+
+	negotiators := make(chan *negotiation.Negotiator, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sig := negotiation.NewWebSocketSignaler(conn)
+		negotiators <- negotiation.NewRegisteredNegotiator(pc2, sig, negotiation.Polite)
+		sig.Start()
+		sig.SendMessage("hello", json.RawMessage(`{}`))
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := negotiation.NewWebSocketSignaler(conn)
+	defer sig.Close()
+	hello := make(chan string, 1)
+	sig.OnOther = func(typ string, _ json.RawMessage) { hello <- typ }
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig)
+	sig.Start()
+
+	negotiateTrack(t, pc1, pc2, neg1, <-negotiators)
+	if typ := <-hello; typ != "hello" {
+		t.Errorf("Expected a hello message, got %q", typ)
+	}
+}
+
+func Test_LongPollSignaler(t *testing.T) {
+	pc1, pc2 := newPeerConnections(t)
+
+	handler := negotiation.NewLongPollHandler()
+	handler.PollTimeout = 100 * time.Millisecond
+	defer handler.Close()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	neg2 := negotiation.NewRegisteredNegotiator(pc2, handler, negotiation.Polite)
+
+	sig := negotiation.NewLongPollSignaler(srv.URL)
+	defer sig.Close()
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig)
+	sig.Start()
+
+	negotiateTrack(t, pc1, pc2, neg1, neg2)
+	// Polls which time out keep the signaler going.
+	time.Sleep(2 * handler.PollTimeout)
+	negotiateTrack(t, pc1, pc2, neg1, neg2)
+}
+
+func Test_DataChannelSignaler(t *testing.T) {
+	pc1, pc2 := newPeerConnections(t)
+
+	var outOfBand atomic.Int32
+	count := &negotiation.DummySignalerInterceptor{
+		BeforeSend: func(sb *negotiation.SignalBody) error {
+			if sb.Description != nil {
+				outOfBand.Add(1)
+			}
+			return nil
+		},
+	}
+	fallback1, fallback2 := negotiation.DummySignalersPipeline(count, count)
+	sig1, err := negotiation.NewDataChannelSignaler(pc1, fallback1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sig1.Close()
+	sig2, err := negotiation.NewDataChannelSignaler(pc2, fallback2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sig2.Close()
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig1)
+	neg2 := negotiation.NewRegisteredNegotiator(pc2, sig2, negotiation.Polite)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !sig1.InBand() || !sig2.InBand() {
+		if time.Now().After(deadline) {
+			t.Fatal("DataChannel did not open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := outOfBand.Load()
+	negotiateTrack(t, pc1, pc2, neg1, neg2)
+	if after := outOfBand.Load(); after != before {
+		t.Errorf("Expected renegotiation in-band, %d descriptions went out of band", after-before)
+	}
+}
+
+func Test_BusSignaler(t *testing.T) {
+	pc1, pc2 := newPeerConnections(t)
+	b := bus.NewLocal()
+	defer b.Close()
+
+	sig1, err := negotiation.NewBusSignaler(b, "alice.out", "alice.in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sig1.Close()
+	sig2, err := negotiation.NewBusSignaler(b, "alice.in", "alice.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sig2.Close()
+	neg1 := negotiation.NewRegisteredNegotiator(pc1, sig1)
+	neg2 := negotiation.NewRegisteredNegotiator(pc2, sig2, negotiation.Polite)
+
+	negotiateTrack(t, pc1, pc2, neg1, neg2)
+}
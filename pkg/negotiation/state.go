@@ -0,0 +1,183 @@
+package negotiation
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// State is the phase of negotiation a Negotiator went through last.
+type State int
+
+const (
+	// StateStable is entered once a negotiation round completed.
+	StateStable State = iota
+	// StateOffering is entered when an offer is created.
+	StateOffering
+	// StateAnswering is entered when a remote offer is answered.
+	StateAnswering
+	// StateRollback is entered when the pending offer is discarded,
+	// either by the polite peer to accept a colliding remote offer or
+	// to retry after a failure.
+	StateRollback
+	// StateCollisionIgnored is entered when the impolite peer ignores a
+	// colliding remote offer.
+	StateCollisionIgnored
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStable:
+		return "stable"
+	case StateOffering:
+		return "offering"
+	case StateAnswering:
+		return "answering"
+	case StateRollback:
+		return "rollback"
+	case StateCollisionIgnored:
+		return "collision-ignored"
+	default:
+		return "unknown"
+	}
+}
+
+// Stats counts what a Negotiator did so far.
+type Stats struct {
+	Offers        uint64
+	Answers       uint64
+	Rollbacks     uint64
+	IgnoredOffers uint64
+	// Completed counts the rounds which reached a stable state.
+	Completed uint64
+	Errors    uint64
+	// DroppedSignals counts duplicated and stale signals.
+	DroppedSignals uint64
+}
+
+type counters struct {
+	offers, answers, rollbacks, ignoredOffers, completed, errors, droppedSignals atomic.Uint64
+}
+
+// Stats returns the counters of n.
+func (n *Negotiator) Stats() Stats {
+	c := &n.counters
+	return Stats{
+		Offers:         c.offers.Load(),
+		Answers:        c.answers.Load(),
+		Rollbacks:      c.rollbacks.Load(),
+		IgnoredOffers:  c.ignoredOffers.Load(),
+		Completed:      c.completed.Load(),
+		Errors:         c.errors.Load(),
+		DroppedSignals: c.droppedSignals.Load(),
+	}
+}
+
+// State returns the state n entered last.
+func (n *Negotiator) State() State {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state
+}
+
+func (n *Negotiator) setState(s State) {
+	switch s {
+	case StateOffering:
+		n.counters.offers.Add(1)
+	case StateAnswering:
+		n.counters.answers.Add(1)
+	case StateRollback:
+		n.counters.rollbacks.Add(1)
+	case StateCollisionIgnored:
+		n.counters.ignoredOffers.Add(1)
+	case StateStable:
+		n.counters.completed.Add(1)
+	}
+	n.mu.Tx(func() { n.state = s })
+	n.notify()
+	if n.OnStateChange != nil {
+		n.OnStateChange(s)
+	}
+}
+
+// notify wakes up WaitStable.
+func (n *Negotiator) notify() {
+	n.mu.Tx(func() {
+		if n.changed != nil {
+			close(n.changed)
+		}
+		n.changed = make(chan struct{})
+	})
+}
+
+// WaitStable waits until no negotiation is in progress or needed.
+// Changes made right before, such as AddTrack or RemoveTrack, are
+// taken into account even though pion reports them asynchronously.
+func (n *Negotiator) WaitStable(ctx context.Context) error {
+	for {
+		var (
+			stable  bool
+			changed chan struct{}
+		)
+		n.mu.Tx(func() {
+			stable = !n.makingOffer && !n.retryPending && n.pendingOffer == nil &&
+				n.PeerConn.SignalingState() == webrtc.SignalingStateStable
+			if n.changed == nil {
+				n.changed = make(chan struct{})
+			}
+			changed = n.changed
+		})
+		if stable && !n.needsNegotiation() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// needsNegotiation reports whether the transceivers differ from what
+// was last negotiated: transceivers missing from the local description
+// have never been negotiated, and senders which gained or lost a track
+// change direction.
+func (n *Negotiator) needsNegotiation() bool {
+	if n.PeerConn.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return false
+	}
+	local := n.PeerConn.CurrentLocalDescription()
+	var sections map[string]string // mid -> direction
+	if local != nil {
+		parsed, err := local.Unmarshal()
+		if err != nil {
+			return false
+		}
+		sections = make(map[string]string)
+		for _, m := range parsed.MediaDescriptions {
+			mid, _ := m.Attribute("mid")
+			for _, d := range []string{"sendrecv", "sendonly", "recvonly", "inactive"} {
+				if _, ok := m.Attribute(d); ok {
+					sections[mid] = d
+				}
+			}
+		}
+	}
+	for _, t := range n.PeerConn.GetTransceivers() {
+		if t.Mid() == "" {
+			return true
+		}
+		direction, ok := sections[t.Mid()]
+		if !ok {
+			// Offered, but not answered yet.
+			return true
+		}
+		sending := t.Sender() != nil && t.Sender().Track() != nil
+		if sending != strings.HasPrefix(direction, "send") {
+			return true
+		}
+	}
+	return false
+}
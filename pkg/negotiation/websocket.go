@@ -0,0 +1,114 @@
+package negotiation
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// signalMessageType is the type of signal messages in the websocket
+// protocol of Raven.
+const signalMessageType = "signal"
+
+// Time allowed to write a message to the websocket.
+const wsWriteWait = 10 * time.Second
+
+// wsMessage is the wire format of the websocket protocol of Raven.
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// WebSocketSignaler signals over a gorilla websocket connection, e.g.
+// of a Go client or bot. Signals are framed like the "signal" messages
+// of Raven, so it can talk to a Raven server directly.
+type WebSocketSignaler struct {
+	SignalerCallbacks
+	// OnOther is called with the messages which are not signals.
+	OnOther func(typ string, payload json.RawMessage)
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	closed  chan struct{}
+	once    sync.Once
+}
+
+var _ Signaler = (*WebSocketSignaler)(nil)
+
+// NewWebSocketSignaler returns a Signaler over conn, which it takes
+// over. Call Start once the callbacks are registered.
+func NewWebSocketSignaler(conn *websocket.Conn) *WebSocketSignaler {
+	return &WebSocketSignaler{
+		conn:   conn,
+		closed: make(chan struct{}),
+	}
+}
+
+// Start starts reading from the websocket.
+func (s *WebSocketSignaler) Start() {
+	go s.readLoop()
+}
+
+func (s *WebSocketSignaler) readLoop() {
+	for {
+		var msg wsMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			select {
+			case <-s.closed:
+			default:
+				s.callOnError(err)
+			}
+			return
+		}
+		if msg.Type != signalMessageType {
+			if s.OnOther != nil {
+				s.OnOther(msg.Type, msg.Payload)
+			}
+			continue
+		}
+		var body SignalBody
+		if err := json.Unmarshal(msg.Payload, &body); err != nil {
+			s.callOnError(err)
+			continue
+		}
+		s.callOnMessage(body)
+	}
+}
+
+func (s *WebSocketSignaler) Send(body SignalBody) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return s.SendMessage(signalMessageType, payload)
+}
+
+// SendMessage sends a message of another type over the websocket.
+func (s *WebSocketSignaler) SendMessage(typ string, payload json.RawMessage) error {
+	select {
+	case <-s.closed:
+		return ErrSignalerClosed
+	default:
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(wsMessage{Type: typ, Payload: payload})
+}
+
+// Close closes the websocket.
+func (s *WebSocketSignaler) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		s.writeMu.Lock()
+		s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(wsWriteWait))
+		s.writeMu.Unlock()
+		err = s.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,67 @@
+package recording
+
+import (
+	"github.com/pion/rtp"
+)
+
+// jitterBuffer puts packets back into sequence order before they are
+// written. A missing packet is given up on once size packets are
+// waiting behind it.
+type jitterBuffer struct {
+	size    int
+	packets map[uint16]*rtp.Packet
+	next    uint16
+	started bool
+}
+
+func newJitterBuffer(size int) *jitterBuffer {
+	return &jitterBuffer{
+		size:    size,
+		packets: make(map[uint16]*rtp.Packet, size),
+	}
+}
+
+// push adds p and returns the packets which are ready in order.
+func (j *jitterBuffer) push(p *rtp.Packet) []*rtp.Packet {
+	if !j.started {
+		j.next = p.SequenceNumber
+		j.started = true
+	}
+	if seqBefore(p.SequenceNumber, j.next) {
+		return nil // too late or duplicate
+	}
+	j.packets[p.SequenceNumber] = p
+
+	var ready []*rtp.Packet
+	for len(j.packets) > 0 {
+		if next, ok := j.packets[j.next]; ok {
+			ready = append(ready, next)
+			delete(j.packets, j.next)
+			j.next++
+			continue
+		}
+		if len(j.packets) < j.size {
+			break
+		}
+		j.next++ // lost
+	}
+	return ready
+}
+
+// flush returns all remaining packets in order.
+func (j *jitterBuffer) flush() []*rtp.Packet {
+	var ready []*rtp.Packet
+	for len(j.packets) > 0 {
+		if next, ok := j.packets[j.next]; ok {
+			ready = append(ready, next)
+			delete(j.packets, j.next)
+		}
+		j.next++
+	}
+	return ready
+}
+
+// seqBefore reports whether a precedes b, taking wraparound into account.
+func seqBefore(a, b uint16) bool {
+	return a != b && b-a < 1<<15
+}
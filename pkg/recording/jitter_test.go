@@ -0,0 +1,45 @@
+package recording
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func sequenceNumbers(packets []*rtp.Packet) []uint16 {
+	seqs := make([]uint16, 0, len(packets))
+	for _, p := range packets {
+		seqs = append(seqs, p.SequenceNumber)
+	}
+	return seqs
+}
+
+func Test_JitterBufferReorders(t *testing.T) {
+	tt := []struct {
+		name string
+		size int
+		in   []uint16
+		want []uint16
+	}{
+		{name: "in order", size: 4, in: []uint16{1, 2, 3}, want: []uint16{1, 2, 3}},
+		{name: "swapped", size: 4, in: []uint16{1, 3, 2, 4}, want: []uint16{1, 2, 3, 4}},
+		{name: "duplicate", size: 4, in: []uint16{1, 2, 2, 3}, want: []uint16{1, 2, 3}},
+		{name: "late", size: 2, in: []uint16{1, 3, 4, 2, 5}, want: []uint16{1, 3, 4, 5}},
+		{name: "wraparound", size: 4, in: []uint16{65534, 0, 65535, 1}, want: []uint16{65534, 65535, 0, 1}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			jb := newJitterBuffer(tc.size)
+			var out []*rtp.Packet
+			for _, seq := range tc.in {
+				p := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}
+				out = append(out, jb.push(p)...)
+			}
+			out = append(out, jb.flush()...)
+			if got := sequenceNumbers(out); !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Package recording writes SFU tracks to disk. A recording subscribes
+// to inbound tracks as a sink, just like a peer would subscribe.
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/utils"
+)
+
+var (
+	ErrAlreadyRecording = errors.New("already recording")
+	ErrNotRecording     = errors.New("not recording")
+)
+
+const (
+	manifestFile = "manifest.json"
+
+	// Packets waiting behind a lost one before it is skipped.
+	jitterBufferSize = 64
+)
+
+// Manifest describes a finished recording. It carries the timing
+// needed to align the track files afterwards.
+type Manifest struct {
+	Name      string          `json:"name"`
+	StartedAt time.Time       `json:"started_at"`
+	StoppedAt time.Time       `json:"stopped_at"`
+	Tracks    []ManifestTrack `json:"tracks"`
+}
+
+type ManifestTrack struct {
+	sfu.TrackInfo
+	File string `json:"file"`
+	// FirstPacketAt is the arrival time of the packet carrying
+	// FirstTimestamp. Together with the clock rate this maps RTP
+	// timestamps of all tracks onto a common wall clock.
+	FirstPacketAt  time.Time `json:"first_packet_at"`
+	FirstTimestamp uint32    `json:"first_timestamp"`
+	EndedAt        time.Time `json:"ended_at"`
+	Packets        uint64    `json:"packets"`
+}
+
+// Recorder manages named recordings, usually one per room.
+type Recorder struct {
+	SFU *sfu.SFU
+	Dir string
+
+	sessions map[string]*Session
+	mu       sync.Mutex
+}
+
+func NewRecorder(sfu *sfu.SFU, dir string) *Recorder {
+	return &Recorder{
+		SFU:      sfu,
+		Dir:      dir,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Start begins a recording called name. Tracks are added to it with
+// Session.AddTrack.
+func (r *Recorder) Start(name string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.sessions[name]; exists {
+		return nil, ErrAlreadyRecording
+	}
+	started := time.Now()
+	dir := filepath.Join(r.Dir, fmt.Sprintf("%s-%s",
+		utils.SanitizeFileName(name), started.UTC().Format("20060102T150405Z")))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Session{
+		Name:    name,
+		Dir:     dir,
+		sfu:     r.SFU,
+		started: started,
+		tracks:  make(map[string]*trackRecording),
+	}
+	r.sessions[name] = s
+	return s, nil
+}
+
+// Session returns the running recording called name.
+func (r *Recorder) Session(name string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[name]
+	return s, ok
+}
+
+// Active returns the names of all running recordings.
+func (r *Recorder) Active() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return utils.MapKeys(r.sessions)
+}
+
+// Stop ends the recording called name and writes its manifest.
+func (r *Recorder) Stop(name string) (Manifest, error) {
+	r.mu.Lock()
+	s, exists := r.sessions[name]
+	delete(r.sessions, name)
+	r.mu.Unlock()
+	if !exists {
+		return Manifest{}, ErrNotRecording
+	}
+	return s.stop()
+}
+
+// Session is a running recording.
+type Session struct {
+	Name string
+	Dir  string
+
+	sfu     *sfu.SFU
+	started time.Time
+	tracks  map[string]*trackRecording
+	stopped bool
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+type trackRecording struct {
+	ManifestTrack
+	writer rtpWriter
+}
+
+func (s *Session) sinkID() string {
+	return "recording:" + s.Name
+}
+
+// AddTrack starts recording the track described by info. Adding a
+// track twice is a no-op.
+func (s *Session) AddTrack(info sfu.TrackInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return ErrNotRecording
+	}
+	if _, exists := s.tracks[info.ID]; exists {
+		return nil
+	}
+	ext, err := fileExtension(info.Codec)
+	if err != nil {
+		return err
+	}
+	file := fmt.Sprintf("%02d-%s-%s%s", len(s.tracks), utils.SanitizeFileName(info.Owner), info.Source, ext)
+	writer, err := newWriter(filepath.Join(s.Dir, file), info)
+	if err != nil {
+		return err
+	}
+	packets, err := s.sfu.SubscribeSink(s.sinkID(), info.ID)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	tr := &trackRecording{
+		ManifestTrack: ManifestTrack{TrackInfo: info, File: file},
+		writer:        writer,
+	}
+	s.tracks[info.ID] = tr
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		tr.record(packets)
+	}()
+	return nil
+}
+
+// record writes packets until the channel is closed.
+func (tr *trackRecording) record(packets <-chan *rtp.Packet) {
+	jb := newJitterBuffer(jitterBufferSize)
+	write := func(ready []*rtp.Packet) {
+		for _, p := range ready {
+			if err := tr.writer.WriteRTP(p); err != nil {
+				log.Printf("Error recording track %s: %v\n", tr.ID, err)
+			}
+		}
+	}
+	for p := range packets {
+		if tr.Packets == 0 {
+			tr.FirstPacketAt = time.Now()
+			tr.FirstTimestamp = p.Timestamp
+		}
+		tr.Packets++
+		write(jb.push(p))
+	}
+	write(jb.flush())
+	tr.EndedAt = time.Now()
+	if err := tr.writer.Close(); err != nil {
+		log.Printf("Error closing recording of track %s: %v\n", tr.ID, err)
+	}
+}
+
+func (s *Session) stop() (Manifest, error) {
+	s.mu.Lock()
+	s.stopped = true
+	for trackID := range s.tracks {
+		// Tracks that already ended are unsubscribed by the SFU.
+		s.sfu.UnsubscribeSink(s.sinkID(), trackID)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	m := Manifest{
+		Name:      s.Name,
+		StartedAt: s.started,
+		StoppedAt: time.Now(),
+		Tracks:    make([]ManifestTrack, 0, len(s.tracks)),
+	}
+	for _, tr := range s.tracks {
+		m.Tracks = append(m.Tracks, tr.ManifestTrack)
+	}
+	slices.SortFunc(m.Tracks, func(a, b ManifestTrack) int {
+		return strings.Compare(a.File, b.File)
+	})
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	return m, os.WriteFile(filepath.Join(s.Dir, manifestFile), data, 0o644)
+}
@@ -0,0 +1,121 @@
+package recording
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// vp8Packet returns a single packet VP8 frame.
+func vp8Packet(seq uint16, timestamp uint32, keyframe bool) *rtp.Packet {
+	tag := byte(0x01) // delta frame
+	if keyframe {
+		tag = 0x00
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: seq,
+			Timestamp:      timestamp,
+			Marker:         true,
+		},
+		Payload: []byte{0x10, tag, 0x02, 0x00, 0x9d, 0x01, 0x2a},
+	}
+}
+
+func Test_Record(t *testing.T) {
+	s := sfu.NewSFU()
+	ended := make(chan struct{})
+	s.OnTrackEnded = func(sfu.TrackInfo) { close(ended) }
+	packets := make(chan *rtp.Packet, 16)
+	trackID, err := s.PublishTrack(sfu.LocalTrack{
+		ID:       "video",
+		StreamID: "alice",
+		Owner:    "alice",
+		Codec:    webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.TrackInfo(trackID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRecorder(s, t.TempDir())
+	session, err := r.Start("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.AddTrack(info); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	// The delta frame ahead of the first keyframe cannot be decoded.
+	packets <- vp8Packet(0, 1000, false)
+	packets <- vp8Packet(1, 4000, true)
+	packets <- vp8Packet(2, 7000, false)
+	packets <- vp8Packet(3, 10000, false)
+	// Ending the track flushes it to the recording.
+	close(packets)
+	<-ended
+	m, err := r.Stop("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Tracks) != 1 {
+		t.Fatalf("Got %d tracks in the manifest, want 1", len(m.Tracks))
+	}
+	tr := m.Tracks[0]
+	if tr.ID != trackID || tr.File != "00-alice-camera.ivf" || tr.Packets != 4 || tr.FirstTimestamp != 1000 {
+		t.Errorf("Got manifest track %+v", tr)
+	}
+	if tr.FirstPacketAt.Before(before) || tr.EndedAt.Before(tr.FirstPacketAt) ||
+		m.StoppedAt.Before(tr.EndedAt) || m.StartedAt.After(before) {
+		t.Errorf("Got inconsistent times in manifest %+v", m)
+	}
+	data, err := os.ReadFile(filepath.Join(session.Dir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Manifest
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Tracks) != 1 || written.Tracks[0].File != tr.File || written.Tracks[0].Packets != tr.Packets {
+		t.Errorf("Got written manifest %+v, want %+v", written, m)
+	}
+
+	f, err := os.Open(filepath.Join(session.Dir, tr.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header.FourCC[:]) != "VP80" {
+		t.Errorf("Got FourCC %q", header.FourCC)
+	}
+	var frames []byte
+	for {
+		frame, _, err := reader.ParseNextFrame()
+		if err != nil {
+			break
+		}
+		frames = append(frames, frame[0])
+	}
+	// The keyframe and the two delta frames following it.
+	if string(frames) != "\x00\x01\x01" {
+		t.Errorf("Got frames starting with %x, want 000101", frames)
+	}
+}
@@ -0,0 +1,234 @@
+package recording
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+var ErrUnsupportedCodec = errors.New("codec can not be recorded")
+
+type rtpWriter interface {
+	WriteRTP(*rtp.Packet) error
+	Close() error
+}
+
+// fileExtension returns the extension of files recorded for codec.
+func fileExtension(codec string) (string, error) {
+	switch strings.ToLower(codec) {
+	case strings.ToLower(webrtc.MimeTypeVP8),
+		strings.ToLower(webrtc.MimeTypeVP9),
+		strings.ToLower(webrtc.MimeTypeAV1):
+		return ".ivf", nil
+	case strings.ToLower(webrtc.MimeTypeOpus), strings.ToLower(sfu.MimeTypeRED):
+		return ".ogg", nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return ".h264", nil
+	default:
+		return "", ErrUnsupportedCodec
+	}
+}
+
+// newWriter creates a media writer for the codec of info at path.
+func newWriter(path string, info sfu.TrackInfo) (rtpWriter, error) {
+	switch strings.ToLower(info.Codec) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeAV1):
+		return ivfwriter.New(path, ivfwriter.WithCodec(info.Codec))
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return newVP9Writer(path, info.Width, info.Height)
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return newOggWriter(path, info)
+	case strings.ToLower(sfu.MimeTypeRED):
+		w, err := newOggWriter(path, info)
+		if err != nil {
+			return nil, err
+		}
+		return &redWriter{w}, nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264writer.New(path)
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+}
+
+func newOggWriter(path string, info sfu.TrackInfo) (*oggwriter.OggWriter, error) {
+	channels := info.Channels
+	if channels == 0 {
+		channels = 2
+	}
+	return oggwriter.New(path, info.ClockRate, channels)
+}
+
+// redWriter records the primary Opus encoding of redundant audio.
+type redWriter struct {
+	rtpWriter
+}
+
+func (w *redWriter) WriteRTP(packet *rtp.Packet) error {
+	primary, ok := sfu.PrimaryRED(packet.Payload)
+	if !ok {
+		return nil
+	}
+	stripped := *packet
+	stripped.Payload = primary
+	return w.rtpWriter.WriteRTP(&stripped)
+}
+
+// vp9Writer writes VP9 frames into an IVF file, which pion's
+// ivfwriter does not support. The frames of the spatial layers of an
+// SVC picture share its timestamp, and are joined into a superframe.
+type vp9Writer struct {
+	out    io.WriteCloser
+	frames uint32
+	// Layer frames of the picture with timestamp.
+	picture       [][]byte
+	timestamp     uint32
+	firstTS       uint32
+	seenKeyFrame  bool
+	width, height uint16
+}
+
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+	vp9ClockRate       = 90000
+)
+
+func newVP9Writer(path string, width, height int) (*vp9Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 || height == 0 {
+		width, height = 640, 480
+	}
+	w := &vp9Writer{
+		out:    f,
+		width:  uint16(width),
+		height: uint16(height),
+	}
+	if err := w.writeHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *vp9Writer) writeHeader() error {
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)             // version
+	binary.LittleEndian.PutUint16(header[6:], ivfHeaderSize) // header size
+	copy(header[8:], "VP90")                                 // fourcc
+	binary.LittleEndian.PutUint16(header[12:], w.width)      // width
+	binary.LittleEndian.PutUint16(header[14:], w.height)     // height
+	binary.LittleEndian.PutUint32(header[16:], vp9ClockRate) // timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)            // timebase numerator
+	binary.LittleEndian.PutUint32(header[24:], w.frames)     // frame count
+	_, err := w.out.Write(header)
+	return err
+}
+
+func (w *vp9Writer) WriteRTP(packet *rtp.Packet) error {
+	if len(packet.Payload) == 0 {
+		return nil
+	}
+	var vp9 codecs.VP9Packet
+	if _, err := vp9.Unmarshal(packet.Payload); err != nil {
+		return err
+	}
+	if len(w.picture) > 0 && packet.Timestamp != w.timestamp {
+		// The marker of the previous picture was lost.
+		if err := w.writePicture(); err != nil {
+			return err
+		}
+	}
+	if !w.seenKeyFrame {
+		if !vp9.B || vp9.P || vp9.SID != 0 {
+			return nil // wait for a key frame
+		}
+		w.seenKeyFrame = true
+		w.firstTS = packet.Timestamp
+	}
+	// B begins the frame of the next spatial layer.
+	if vp9.B || len(w.picture) == 0 {
+		w.picture = append(w.picture, nil)
+		w.timestamp = packet.Timestamp
+	}
+	last := len(w.picture) - 1
+	w.picture[last] = append(w.picture[last], vp9.Payload...)
+	if !packet.Marker {
+		return nil
+	}
+	return w.writePicture()
+}
+
+// writePicture writes the current picture as one IVF frame.
+func (w *vp9Writer) writePicture() error {
+	frame := superframe(w.picture)
+	w.picture = w.picture[:0]
+	header := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(w.timestamp-w.firstTS))
+	if _, err := w.out.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(frame); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+// superframe joins frames, followed by the superframe index of the VP9
+// bitstream (Annex B): a marker byte, the size of each frame and the
+// marker again.
+func superframe(frames [][]byte) []byte {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	largest := 0
+	for _, f := range frames {
+		largest = max(largest, len(f))
+	}
+	sizeBytes := 1
+	for largest >= 1<<(8*sizeBytes) {
+		sizeBytes++
+	}
+	marker := 0xc0 | byte(sizeBytes-1)<<3 | byte(len(frames)-1)
+	var out []byte
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	out = append(out, marker)
+	for _, f := range frames {
+		for i := 0; i < sizeBytes; i++ {
+			out = append(out, byte(len(f)>>(8*i)))
+		}
+	}
+	return append(out, marker)
+}
+
+func (w *vp9Writer) Close() error {
+	if ws, ok := w.out.(io.WriteSeeker); ok {
+		if _, err := ws.Seek(0, io.SeekStart); err != nil {
+			w.out.Close()
+			return err
+		}
+		if err := w.writeHeader(); err != nil {
+			w.out.Close()
+			return err
+		}
+	}
+	return w.out.Close()
+}
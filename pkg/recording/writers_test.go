@@ -0,0 +1,192 @@
+package recording
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// vp9Packet returns a packet of spatial layer sid of a picture, with
+// data as the frame. begin and end mark the first and last packet of
+// the layer frame.
+func vp9Packet(timestamp uint32, sid uint8, keyframe, begin, end, marker bool, data ...byte) *rtp.Packet {
+	b0 := byte(0xa0) // I, L
+	if !keyframe {
+		b0 |= 0x40 // P
+	}
+	if begin {
+		b0 |= 0x08
+	}
+	if end {
+		b0 |= 0x04
+	}
+	pic := uint16(timestamp / 3000)
+	payload := []byte{b0, 0x80 | byte(pic>>8), byte(pic), sid << 1, 0}
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, Timestamp: timestamp, Marker: marker},
+		Payload: append(payload, data...),
+	}
+}
+
+// readIVF returns the frames of an IVF file and their timestamps.
+func readIVF(t *testing.T, path string) ([][]byte, []uint64) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, _, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	var timestamps []uint64
+	for {
+		frame, header, err := reader.ParseNextFrame()
+		if err != nil {
+			return frames, timestamps
+		}
+		frames = append(frames, frame)
+		timestamps = append(timestamps, header.Timestamp)
+	}
+}
+
+func Test_VP9Writer(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		packets    []*rtp.Packet
+		frames     [][]byte
+		timestamps []uint64
+	}{
+		{
+			name: "single layer",
+			packets: []*rtp.Packet{
+				// Not decodable without the keyframe.
+				vp9Packet(3000, 0, false, true, true, true, 0xee),
+				vp9Packet(6000, 0, true, true, false, false, 1, 2),
+				vp9Packet(6000, 0, true, false, true, true, 3),
+				vp9Packet(9000, 0, false, true, true, true, 4),
+			},
+			frames:     [][]byte{{1, 2, 3}, {4}},
+			timestamps: []uint64{0, 3000},
+		},
+		{
+			name: "spatial layers",
+			packets: []*rtp.Packet{
+				vp9Packet(3000, 0, true, true, true, false, 1),
+				vp9Packet(3000, 1, true, true, false, false, 2, 2),
+				vp9Packet(3000, 1, true, false, true, false, 2),
+				vp9Packet(3000, 2, true, true, true, true, 3, 3, 3, 3),
+				vp9Packet(6000, 0, false, true, true, false, 4),
+				vp9Packet(6000, 1, false, true, true, true, 5),
+			},
+			frames: [][]byte{
+				{1, 2, 2, 2, 3, 3, 3, 3, 0xc2, 1, 3, 4, 0xc2},
+				{4, 5, 0xc1, 1, 1, 0xc1},
+			},
+			timestamps: []uint64{0, 3000},
+		},
+		{
+			name: "lost marker",
+			packets: []*rtp.Packet{
+				vp9Packet(3000, 0, true, true, true, false, 1),
+				vp9Packet(3000, 1, true, true, true, false, 2),
+				vp9Packet(6000, 0, false, true, true, true, 3),
+			},
+			frames:     [][]byte{{1, 2, 0xc1, 1, 1, 0xc1}, {3}},
+			timestamps: []uint64{0, 3000},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.ivf")
+			w, err := newVP9Writer(path, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tc.packets {
+				if err := w.WriteRTP(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			frames, timestamps := readIVF(t, path)
+			if len(frames) != len(tc.frames) {
+				t.Fatalf("Got %d frames, want %d", len(frames), len(tc.frames))
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], tc.frames[i]) || timestamps[i] != tc.timestamps[i] {
+					t.Errorf("Got frame %d %x at %d, want %x at %d",
+						i, frames[i], timestamps[i], tc.frames[i], tc.timestamps[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_REDWriter(t *testing.T) {
+	ext, err := fileExtension(sfu.MimeTypeRED)
+	if err != nil || ext != ".ogg" {
+		t.Fatalf("Got extension %q, %v for RED", ext, err)
+	}
+	path := filepath.Join(t.TempDir(), "audio"+ext)
+	w, err := newWriter(path, sfu.TrackInfo{Codec: sfu.MimeTypeRED, ClockRate: 48000, Channels: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, payload := range [][]byte{
+		{0x6f, 1, 2, 3},
+		// A redundant block of 2 bytes ahead of the primary one.
+		{0xef, 0x03, 0xc0, 0x02, 0x6f, 1, 2, 4, 5, 6},
+		// Truncated, not recorded.
+		{0xef, 0x03},
+	} {
+		p := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: payload,
+		}
+		if err := w.WriteRTP(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, _, err := oggreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]byte
+	for {
+		page, _, err := reader.ParseNextPage()
+		if err != nil {
+			break
+		}
+		if !bytes.HasPrefix(page, []byte("OpusTags")) {
+			got = append(got, page)
+		}
+	}
+	want := [][]byte{{1, 2, 3}, {4, 5, 6}}
+	if len(got) != len(want) {
+		t.Fatalf("Got pages %x, want %x", got, want)
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("Got page %d %x, want %x", i, got[i], want[i])
+		}
+	}
+}
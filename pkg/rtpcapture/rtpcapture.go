@@ -0,0 +1,213 @@
+// Package rtpcapture captures the packets of SFU tracks to rtpdump
+// files and replays them into an SFU as synthetic tracks.
+//
+// Each captured track is stored as two files sharing a base name:
+// <base>.rtpdump holds the RTP and RTCP packets with their arrival
+// offsets and <base>.json the sfu.TrackInfo of the track. Of simulcast
+// tracks, only the layer which started the track is captured.
+package rtpcapture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/rtpdump"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/utils"
+)
+
+const (
+	dumpExt = ".rtpdump"
+	infoExt = ".json"
+)
+
+var errClosed = errors.New("capture closed")
+
+// Dir is a sfu.Capturer writing one capture per track into a directory.
+type Dir string
+
+var _ sfu.Capturer = Dir("")
+
+func (d Dir) CaptureTrack(info sfu.TrackInfo) (sfu.TrackCapture, error) {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return nil, err
+	}
+	base := fmt.Sprintf("%s-%s", utils.SanitizeFileName(info.ID), time.Now().UTC().Format("20060102T150405.000Z"))
+	return Create(filepath.Join(string(d), base), info)
+}
+
+// Writer writes a capture of a single track.
+type Writer struct {
+	file   *os.File
+	dump   *rtpdump.Writer
+	start  time.Time
+	closed bool
+	mu     sync.Mutex
+}
+
+var _ sfu.TrackCapture = (*Writer)(nil)
+
+// Create starts a capture at base, see the package documentation.
+func Create(base string, info sfu.TrackInfo) (*Writer, error) {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+infoExt, data, 0o644); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(base + dumpExt)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	dump, err := rtpdump.NewWriter(f, rtpdump.Header{
+		Start:  start,
+		Source: net.IPv4zero,
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Writer{file: f, dump: dump, start: start}, nil
+}
+
+func (w *Writer) WriteRTP(packet *rtp.Packet, arrival time.Time) error {
+	raw, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	return w.write(rtpdump.Packet{Payload: raw}, arrival)
+}
+
+func (w *Writer) WriteRTCP(raw []byte, arrival time.Time) error {
+	payload := append([]byte(nil), raw...)
+	return w.write(rtpdump.Packet{IsRTCP: true, Payload: payload}, arrival)
+}
+
+func (w *Writer) write(p rtpdump.Packet, arrival time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	p.Offset = arrival.Sub(w.start)
+	return w.dump.WritePacket(p)
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.file.Close()
+}
+
+// Capture is a capture read back from disk.
+type Capture struct {
+	Info    sfu.TrackInfo
+	Start   time.Time
+	Packets []rtpdump.Packet
+}
+
+// Open reads the capture at path, which may be given with or without
+// the .rtpdump extension.
+func Open(path string) (*Capture, error) {
+	base := strings.TrimSuffix(path, dumpExt)
+	data, err := os.ReadFile(base + infoExt)
+	if err != nil {
+		return nil, err
+	}
+	var c Capture
+	if err := json.Unmarshal(data, &c.Info); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(base + dumpExt)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, header, err := rtpdump.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	c.Start = header.Start
+	for {
+		p, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return &c, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.Packets = append(c.Packets, p)
+	}
+}
+
+// Replay sends the RTP packets of the capture to out, paced by their
+// original arrival offsets. It returns when all packets are sent or
+// ctx is done.
+func (c *Capture) Replay(ctx context.Context, out chan<- *rtp.Packet) error {
+	start := time.Now()
+	for _, p := range c.Packets {
+		if p.IsRTCP {
+			continue
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(p.Payload); err != nil {
+			return err
+		}
+		if wait := time.Until(start.Add(p.Offset)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case out <- &packet:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Publish replays the capture into s as a synthetic track owned by
+// owner. It returns the id of the track, which ends when the replay
+// is over or ctx is done.
+func (c *Capture) Publish(ctx context.Context, s *sfu.SFU, owner string) (string, error) {
+	packets := make(chan *rtp.Packet)
+	trackID, err := s.PublishTrack(sfu.LocalTrack{
+		ID:       c.Info.ID + "-replay",
+		StreamID: owner,
+		Owner:    owner,
+		Codec: webrtc.RTPCodecCapability{
+			MimeType:  c.Info.Codec,
+			ClockRate: c.Info.ClockRate,
+			Channels:  c.Info.Channels,
+		},
+		Source: c.Info.Source,
+	}, packets)
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		defer close(packets)
+		c.Replay(ctx, packets)
+	}()
+	return trackID, nil
+}
@@ -0,0 +1,98 @@
+package rtpcapture_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/rtpcapture"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func Test_CaptureAndReplay(t *testing.T) {
+	info := sfu.TrackInfo{
+		ID:        "stream#video",
+		Owner:     "alice",
+		Kind:      webrtc.RTPCodecTypeVideo.String(),
+		Codec:     webrtc.MimeTypeVP8,
+		ClockRate: 90000,
+		Source:    sfu.SourceCamera,
+	}
+	base := filepath.Join(t.TempDir(), "capture")
+	w, err := rtpcapture.Create(base, info)
+	if err != nil {
+		t.Fatal("Failed to create capture:", err)
+	}
+
+	const packets = 10
+	start := time.Now()
+	for i := 0; i < packets; i++ {
+		p := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    96,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 3000),
+				SSRC:           1234,
+			},
+			Payload: []byte{byte(i)},
+		}
+		arrival := start.Add(time.Duration(20+i*10) * time.Millisecond)
+		if err := w.WriteRTP(p, arrival); err != nil {
+			t.Fatal("Failed to write RTP packet:", err)
+		}
+	}
+	if err := w.WriteRTCP([]byte{0x80, 0xc9, 0x00, 0x01, 0, 0, 0, 1}, start); err != nil {
+		t.Fatal("Failed to write RTCP packet:", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Failed to close capture:", err)
+	}
+
+	c, err := rtpcapture.Open(base + ".rtpdump")
+	if err != nil {
+		t.Fatal("Failed to open capture:", err)
+	}
+	if c.Info.ID != info.ID || c.Info.Codec != info.Codec {
+		t.Fatalf("Unexpected track info: %+v", c.Info)
+	}
+	if len(c.Packets) != packets+1 {
+		t.Fatalf("Read %d packets, want %d", len(c.Packets), packets+1)
+	}
+
+	s := sfu.NewSFU()
+	trackID, err := c.Publish(context.Background(), s, "replay")
+	if err != nil {
+		t.Fatal("Failed to publish capture:", err)
+	}
+	sink, err := s.SubscribeSink("test", trackID)
+	if err != nil {
+		t.Fatal("Failed to subscribe to replayed track:", err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for want := 0; want < packets; want++ {
+		select {
+		case p, ok := <-sink:
+			if !ok {
+				t.Fatalf("Track ended after %d packets", want)
+			}
+			if p.SequenceNumber != uint16(want) || p.Payload[0] != byte(want) {
+				t.Fatalf("Got packet %d, want %d", p.SequenceNumber, want)
+			}
+		case <-timeout:
+			t.Fatal("receive timeout.")
+		}
+	}
+	select {
+	case _, ok := <-sink:
+		if ok {
+			t.Fatal("Received more packets than captured")
+		}
+	case <-timeout:
+		t.Fatal("Replayed track did not end")
+	}
+}
@@ -0,0 +1,211 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// MimeTypeRED is redundant audio (RFC 2198), which repeats earlier
+// Opus frames in each packet to recover from loss.
+const MimeTypeRED = "audio/red"
+
+const (
+	opusPayloadType = 111
+	redPayloadType  = 63
+	// Audio which stays silent for silenceDelay is reported as
+	// Silent in its TrackInfo.
+	silenceDelay = time.Second
+	// Opus packets of up to maxDTXSize bytes carry no audio; they
+	// are sent instead of silence with DTX.
+	maxDTXSize = 2
+)
+
+// NewAudioAPI returns an API for PeerConnections which only carry
+// audio, e.g. of voice channels. It uses NewAudioMediaEngine and only
+// the RTCP reports interceptor; those for video are left out to cost
+// less per PeerConnection.
+func NewAudioAPI() *webrtc.API {
+	m := NewAudioMediaEngine()
+	i := &interceptor.Registry{}
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		log.Println("Error registering interceptors:", err)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+}
+
+// NewAudioMediaEngine returns a MediaEngine offering Opus with DTX,
+// preceded by RED for peers supporting it, and the audio level header
+// extension. The default codecs follow, so that video offered by
+// clients is still negotiated rather than rejected; it is for the
+// Authorizer to refuse it.
+func NewAudioMediaEngine() *webrtc.MediaEngine {
+	m := &webrtc.MediaEngine{}
+	codecs := []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType: MimeTypeRED, ClockRate: 48000, Channels: 2,
+				SDPFmtpLine: "111/111",
+			},
+			PayloadType: redPayloadType,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
+				SDPFmtpLine: "minptime=10;useinbandfec=1;usedtx=1",
+			},
+			PayloadType: opusPayloadType,
+		},
+	}
+	for _, codec := range codecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			log.Println("Error registering codecs:", err)
+		}
+	}
+	// The default Opus codec is skipped, as it has the same payload
+	// type.
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		log.Println("Error registering codecs:", err)
+	}
+	err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		log.Println("Error registering audio level extension:", err)
+	}
+	return m
+}
+
+// outboundTrack is the track forwarding an inbound track to a
+// subscriber.
+type outboundTrack interface {
+	webrtc.TrackLocal
+	WriteRTP(*rtp.Packet) error
+}
+
+func newOutboundTrack(track *inboundTrack) (outboundTrack, error) {
+	if strings.EqualFold(track.codec.MimeType, MimeTypeRED) {
+		return newREDTrack(track.codec, track.remoteID, track.streamID)
+	}
+	return webrtc.NewTrackLocalStaticRTP(track.codec, track.remoteID, track.streamID)
+}
+
+// redTrack forwards RED audio to subscribers which negotiated RED,
+// and only its primary Opus encoding to the others.
+type redTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	opus *webrtc.TrackLocalStaticRTP
+}
+
+func newREDTrack(codec webrtc.RTPCodecCapability, id, streamID string) (*redTrack, error) {
+	red, err := webrtc.NewTrackLocalStaticRTP(codec, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	opus, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: codec.ClockRate,
+		Channels:  codec.Channels,
+	}, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &redTrack{TrackLocalStaticRTP: red, opus: opus}, nil
+}
+
+func (t *redTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if errors.Is(err, webrtc.ErrUnsupportedCodec) {
+		return t.opus.Bind(ctx)
+	}
+	return codec, err
+}
+
+func (t *redTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	if err := t.TrackLocalStaticRTP.Unbind(ctx); err == nil {
+		return nil
+	}
+	return t.opus.Unbind(ctx)
+}
+
+func (t *redTrack) WriteRTP(p *rtp.Packet) error {
+	err := t.TrackLocalStaticRTP.WriteRTP(p)
+	if primary, ok := PrimaryRED(p.Payload); ok {
+		stripped := *p
+		stripped.Payload = primary
+		err = errors.Join(err, t.opus.WriteRTP(&stripped))
+	}
+	return err
+}
+
+// PrimaryRED returns the primary encoding of a RED payload. The
+// redundant blocks are announced by 4 byte headers with their length,
+// the primary one by a last 1 byte header.
+func PrimaryRED(payload []byte) ([]byte, bool) {
+	offset, redundant := 0, 0
+	for {
+		if offset >= len(payload) {
+			return nil, false
+		}
+		if payload[offset]&0x80 == 0 {
+			offset++
+			break
+		}
+		if offset+4 > len(payload) {
+			return nil, false
+		}
+		redundant += int(binary.BigEndian.Uint16(payload[offset+2:]) & 0x3ff)
+		offset += 4
+	}
+	if offset+redundant > len(payload) {
+		return nil, false
+	}
+	return payload[offset+redundant:], true
+}
+
+// observeSilence infers whether the publisher of an audio track muted
+// it: muted tracks send digital silence, or only DTX packets. Tracks
+// which stop sending altogether are not noticed.
+func (n *SFU) observeSilence(track *inboundTrack, packet *rtp.Packet) {
+	if !silent(track, packet) {
+		track.silentSince = time.Time{}
+		if track.silent.Swap(false) {
+			n.notifyTrackInfo(track)
+		}
+		return
+	}
+	if track.silentSince.IsZero() {
+		track.silentSince = time.Now()
+	}
+	if time.Since(track.silentSince) >= silenceDelay && !track.silent.Swap(true) {
+		n.notifyTrackInfo(track)
+	}
+}
+
+// silent reports whether packet of track carries no sound.
+func silent(track *inboundTrack, packet *rtp.Packet) bool {
+	if track.audioLevel != 0 {
+		var level rtp.AudioLevelExtension
+		raw := packet.GetExtension(track.audioLevel)
+		if raw != nil && level.Unmarshal(raw) == nil && level.Level == 127 {
+			return true
+		}
+	}
+	payload := packet.Payload
+	switch {
+	case strings.EqualFold(track.codec.MimeType, MimeTypeRED):
+		var ok bool
+		if payload, ok = PrimaryRED(payload); !ok {
+			return false
+		}
+	case !strings.EqualFold(track.codec.MimeType, webrtc.MimeTypeOpus):
+		return false
+	}
+	return len(payload) <= maxDTXSize
+}
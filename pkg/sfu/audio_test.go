@@ -0,0 +1,126 @@
+package sfu_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func Test_Silence(t *testing.T) {
+	s := sfu.NewSFU()
+	silent := make(chan bool, 16)
+	s.OnTrackInfo = func(info sfu.TrackInfo) { silent <- info.Silent }
+	packets := make(chan *rtp.Packet, 16)
+	defer close(packets)
+	_, err := s.PublishTrack(sfu.LocalTrack{
+		ID:       "audio",
+		StreamID: "alice",
+		Owner:    "alice",
+		Codec:    webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+	}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if <-silent {
+		t.Fatal("Expected a new track not to be silent")
+	}
+
+	var seq uint16
+	// expect sends packets of size until the track is reported silent
+	// or not.
+	expect := func(size int, want bool) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			packets <- &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq},
+				Payload: make([]byte, size),
+			}
+			seq++
+			select {
+			case got := <-silent:
+				if got != want {
+					t.Fatalf("Got silent %v, want %v", got, want)
+				}
+				return
+			case <-deadline:
+				t.Fatalf("Silent did not become %v", want)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+	// DTX packets only carry the TOC byte.
+	expect(1, true)
+	expect(60, false)
+}
+
+func Test_RED(t *testing.T) {
+	s := sfu.NewSFU()
+	packets := make(chan *rtp.Packet, 16)
+	defer close(packets)
+	trackID, err := s.PublishTrack(sfu.LocalTrack{
+		ID:       "audio",
+		StreamID: "alice",
+		Owner:    "alice",
+		Codec: webrtc.RTPCodecCapability{
+			MimeType: sfu.MimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111",
+		},
+	}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A redundant block of 3 bytes, 960 samples earlier, and the
+	// primary encoding.
+	primary := []byte{9, 9, 9, 9, 9}
+	payload := append([]byte{0x80 | 111, 960 >> 6, 960<<2&0xff | 0, 3, 111, 1, 2, 3}, primary...)
+
+	type received struct {
+		codec   string
+		payload []byte
+	}
+	subscribe := func(id string, api *webrtc.API) <-chan received {
+		local, remote := connect(t, s, id, s.AudioAPI, api)
+		ch := make(chan received, 1)
+		remote.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			p, _, err := tr.ReadRTP()
+			if err == nil {
+				ch <- received{tr.Codec().MimeType, p.Payload}
+			}
+		})
+		if err := s.Subscribe(local, trackID); err != nil {
+			t.Fatal(err)
+		}
+		negotiate(t, local, remote)
+		return ch
+	}
+	supporting := subscribe("supporting", sfu.NewAudioAPI())
+	other := subscribe("other", sfu.NewAPI())
+
+	var seq uint16
+	check := func(ch <-chan received, codec string, want []byte) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			packets <- &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: payload}
+			seq++
+			select {
+			case r := <-ch:
+				if !strings.EqualFold(r.codec, codec) || !bytes.Equal(r.payload, want) {
+					t.Fatalf("Got %s %x, want %s %x", r.codec, r.payload, codec, want)
+				}
+				return
+			case <-deadline:
+				t.Fatal("No packet received")
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+	check(supporting, sfu.MimeTypeRED, payload)
+	check(other, webrtc.MimeTypeOpus, primary)
+}
@@ -0,0 +1,54 @@
+package sfu
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Capturer opts inbound tracks into packet capture, for reproducing
+// issues offline. See package rtpcapture for a file based Capturer.
+//
+// Of a simulcast track only the layer which started it is captured,
+// since a capture replays as a track with a single layer.
+type Capturer interface {
+	CaptureTrack(info TrackInfo) (TrackCapture, error)
+}
+
+// TrackCapture receives the packets of a single track together with
+// their arrival time. Its methods may be called concurrently.
+type TrackCapture interface {
+	WriteRTP(packet *rtp.Packet, arrival time.Time) error
+	WriteRTCP(raw []byte, arrival time.Time) error
+	Close() error
+}
+
+// startCapture attaches a TrackCapture to track if a Capturer is set.
+func (n *SFU) startCapture(track *inboundTrack) bool {
+	if n.Capturer == nil {
+		return false
+	}
+	capture, err := n.Capturer.CaptureTrack(n.trackInfo(track))
+	if err != nil {
+		log.Printf("Error capturing track %s: %v\n", track.id, err)
+		return false
+	}
+	track.capture = capture
+	return true
+}
+
+// captureRTCP captures RTCP packets arriving on r until it is stopped.
+func (n *SFU) captureRTCP(track *inboundTrack, r *webrtc.RTPReceiver) {
+	buf := make([]byte, 1500)
+	for {
+		i, _, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		if err := track.capture.WriteRTCP(buf[:i], time.Now()); err != nil {
+			log.Println("Error capturing RTCP packet:", err)
+		}
+	}
+}
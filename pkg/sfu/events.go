@@ -0,0 +1,40 @@
+package sfu
+
+import "sync"
+
+// events runs the callbacks of the SFU one at a time, in the order
+// they were queued, so that they are never called from the goroutines
+// forwarding media. The zero value is ready to use.
+type events struct {
+	queue   []func()
+	running bool
+	mu      sync.Mutex
+}
+
+// push adds f to the callbacks to run. It never blocks.
+func (e *events) push(f func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queue = append(e.queue, f)
+	if !e.running {
+		e.running = true
+		go e.run()
+	}
+}
+
+// run calls the queued callbacks until there are none left.
+func (e *events) run() {
+	for {
+		e.mu.Lock()
+		if len(e.queue) == 0 {
+			e.running = false
+			e.mu.Unlock()
+			return
+		}
+		f := e.queue[0]
+		e.queue[0] = nil
+		e.queue = e.queue[1:]
+		e.mu.Unlock()
+		f()
+	}
+}
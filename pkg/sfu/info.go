@@ -0,0 +1,110 @@
+package sfu
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TrackInfo describes an inbound track for discovery by subscribers.
+type TrackInfo struct {
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+	Owner    string `json:"owner"`
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec"`
+	// ClockRate and Channels of the codec.
+	ClockRate uint32      `json:"clock_rate"`
+	Channels  uint16      `json:"channels,omitempty"`
+	Source    TrackSource `json:"source"`
+	// Layers are the RIDs of a simulcast track.
+	Layers []string `json:"layers,omitempty"`
+	Width  int      `json:"width,omitempty"`
+	Height int      `json:"height,omitempty"`
+	// Muted is set when the publisher muted the track, ServerMuted
+	// when it is muted server-side.
+	Muted       bool `json:"muted"`
+	ServerMuted bool `json:"server_muted"`
+	// Silent is set while audio has only been silence or DTX for a
+	// while, which is how a mute shows when it is not announced.
+	Silent bool `json:"silent,omitempty"`
+}
+
+// TrackInfos returns the TrackInfo of all inbound tracks.
+func (n *SFU) TrackInfos() []TrackInfo {
+	n.mu.RLock()
+	tracks := make([]*inboundTrack, 0, len(n.inboundTracks))
+	for _, track := range n.inboundTracks {
+		tracks = append(tracks, track)
+	}
+	n.mu.RUnlock()
+
+	infos := make([]TrackInfo, 0, len(tracks))
+	for _, track := range tracks {
+		infos = append(infos, n.trackInfo(track))
+	}
+	return infos
+}
+
+// TrackInfo returns the TrackInfo of trackID.
+func (n *SFU) TrackInfo(trackID string) (TrackInfo, error) {
+	n.mu.RLock()
+	track, exists := n.inboundTracks[trackID]
+	n.mu.RUnlock()
+	if !exists {
+		return TrackInfo{}, ErrTrackNotFound
+	}
+	return n.trackInfo(track), nil
+}
+
+func (n *SFU) trackInfo(track *inboundTrack) TrackInfo {
+	track.mu.RLock()
+	defer track.mu.RUnlock()
+	return TrackInfo{
+		ID:          track.id,
+		StreamID:    track.streamID,
+		Owner:       track.ownerID,
+		Kind:        track.kind.String(),
+		Codec:       track.codec.MimeType,
+		ClockRate:   track.codec.ClockRate,
+		Channels:    track.codec.Channels,
+		Source:      track.Source(),
+		Layers:      append([]string(nil), track.layers...),
+		Width:       track.width,
+		Height:      track.height,
+		Muted:       track.publisherMuted,
+		ServerMuted: track.muted.Load(),
+		Silent:      track.silent.Load(),
+	}
+}
+
+// notifyTrackInfo queues a call of OnTrackInfo, which may be called
+// from the packet loop of track, e.g. by observeSilence.
+func (n *SFU) notifyTrackInfo(track *inboundTrack) {
+	if n.OnTrackInfo == nil {
+		return
+	}
+	n.events.push(func() { n.OnTrackInfo(n.trackInfo(track)) })
+}
+
+// addLayer records another simulcast layer of track and forwards it
+// to the subscribers which selected it. See SetViewport.
+func (n *SFU) addLayer(track *inboundTrack, tr *webrtc.TrackRemote) {
+	track.mu.Lock()
+	track.layers = append(track.layers, tr.RID())
+	track.simulcast = append(track.simulcast, &layer{rid: tr.RID(), ssrc: uint32(tr.SSRC())})
+	track.mu.Unlock()
+	n.notifyTrackInfo(track)
+
+	for {
+		packet, _, err := tr.ReadRTP()
+		if err != nil {
+			log.Printf("Layer %s of track %s ended: %v\n", tr.RID(), track.id, err)
+			return
+		}
+		// Unlike the first layer, the layer is not captured.
+		track.mu.RLock()
+		n.fanOut(track, tr.RID(), packet)
+		track.mu.RUnlock()
+	}
+}
@@ -0,0 +1,124 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/svc"
+)
+
+// keyframe is what the payload of a packet tells about keyframes.
+type keyframe struct {
+	// known is false for codecs whose payload is not parsed.
+	known bool
+	// start is set on the first packet of a keyframe.
+	start bool
+	// Resolution of the keyframe, if the bitstream carries it.
+	width, height int
+}
+
+func parseKeyframe(mimeType string, payload []byte) keyframe {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return parseVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return parseH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return parseVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return parseAV1Keyframe(payload)
+	}
+	return keyframe{}
+}
+
+// parseVP8Keyframe reads the payload descriptor (RFC 7741) and the
+// frame header (RFC 6386, section 9.1).
+func parseVP8Keyframe(payload []byte) keyframe {
+	kf := keyframe{known: true}
+	var vp8 codecs.VP8Packet
+	if _, err := vp8.Unmarshal(payload); err != nil {
+		return kf
+	}
+	frame := vp8.Payload
+	if vp8.S != 1 || vp8.PID != 0 || len(frame) < 3 || frame[0]&0x01 != 0 {
+		return kf
+	}
+	kf.start = true
+	// A start code follows the 3 byte frame tag of keyframes, then
+	// 14 bits each of width and height.
+	if len(frame) >= 10 && frame[3] == 0x9d && frame[4] == 0x01 && frame[5] == 0x2a {
+		kf.width = int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff)
+		kf.height = int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff)
+	}
+	return kf
+}
+
+// parseVP9Keyframe reads the payload descriptor, whose scalability
+// structure gives the resolution.
+func parseVP9Keyframe(payload []byte) keyframe {
+	kf := keyframe{known: true}
+	f, err := svc.ParseVP9(payload)
+	if err != nil {
+		return kf
+	}
+	kf.start = f.Start && f.Keyframe && f.Spatial == 0
+	if len(f.Sizes) > 0 {
+		size := f.Sizes[len(f.Sizes)-1]
+		kf.width, kf.height = size.Width, size.Height
+	}
+	return kf
+}
+
+// parseAV1Keyframe reads the aggregation header, and the sequence
+// header which starts coded video sequences and gives the resolution.
+func parseAV1Keyframe(payload []byte) keyframe {
+	kf := keyframe{known: true}
+	f, err := svc.ParseAV1(payload)
+	if err != nil {
+		return kf
+	}
+	kf.start = f.Start && f.Keyframe && f.Spatial == 0
+	if len(f.Sizes) > 0 {
+		kf.width, kf.height = f.Sizes[0].Width, f.Sizes[0].Height
+	}
+	return kf
+}
+
+// H.264 NAL unit types (RFC 6184).
+const (
+	h264IDR   = 5
+	h264SPS   = 7
+	h264STAPA = 24
+	h264FUA   = 28
+)
+
+// parseH264Keyframe looks for an IDR slice or SPS at the start of the
+// payload.
+func parseH264Keyframe(payload []byte) keyframe {
+	kf := keyframe{known: true}
+	if len(payload) < 2 {
+		return kf
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case h264IDR, h264SPS:
+		kf.start = true
+	case h264STAPA:
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || len(rest) < 2+size {
+				break
+			}
+			if t := rest[2] & 0x1f; t == h264IDR || t == h264SPS {
+				kf.start = true
+				break
+			}
+			rest = rest[2+size:]
+		}
+	case h264FUA:
+		// Start bit and type of the fragmented unit.
+		kf.start = payload[1]&0x80 != 0 && payload[1]&0x1f == h264IDR
+	}
+	return kf
+}
@@ -0,0 +1,186 @@
+package sfu
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ForwardingPolicy limits the video a subscriber receives. Video
+// tracks are ranked by relevance and only the first LastN of them are
+// forwarded; the others are paused without renegotiation.
+//
+// Tracks of pinned owners rank first, then screen shares, then tracks
+// on screen, then the tracks of the active speakers of the
+// subscriber's speaker group, loudest first.
+type ForwardingPolicy struct {
+	// LastN is the number of video tracks forwarded. Zero or less
+	// forwards all of them.
+	LastN int `json:"last_n"`
+	// Pinned are the ids of owners whose video is always wanted.
+	Pinned []string `json:"pinned,omitempty"`
+	// OnScreen are the ids of tracks the subscriber displays.
+	OnScreen []string `json:"on_screen,omitempty"`
+}
+
+// forwarding holds the ForwardingPolicy of subscribers.
+type forwarding struct {
+	policies map[string]ForwardingPolicy // by peer id
+	paused   map[string][]string         // track ids by peer id, as last reported
+	mu       sync.Mutex
+}
+
+func (f *forwarding) init() {
+	if f.policies == nil {
+		f.policies = make(map[string]ForwardingPolicy)
+		f.paused = make(map[string][]string)
+	}
+}
+
+// SetForwardingPolicy sets the ForwardingPolicy of peer and applies it
+// to its subscriptions right away.
+func (n *SFU) SetForwardingPolicy(peer *webrtc.PeerConnection, p ForwardingPolicy) error {
+	peerID, exists := n.PeerID(peer)
+	if !exists {
+		return ErrPeerNotRegistered
+	}
+	n.forwarding.mu.Lock()
+	n.forwarding.init()
+	n.forwarding.policies[peerID] = p
+	n.forwarding.mu.Unlock()
+	n.updateForwarding(peerID)
+	return nil
+}
+
+// ForwardingPolicy returns the ForwardingPolicy of peer.
+func (n *SFU) ForwardingPolicy(peer *webrtc.PeerConnection) (ForwardingPolicy, error) {
+	peerID, exists := n.PeerID(peer)
+	if !exists {
+		return ForwardingPolicy{}, ErrPeerNotRegistered
+	}
+	n.forwarding.mu.Lock()
+	defer n.forwarding.mu.Unlock()
+	return n.forwarding.policies[peerID], nil
+}
+
+// removeForwardingPolicy forgets the policy of a peer which is gone.
+func (n *SFU) removeForwardingPolicy(peerID string) {
+	n.forwarding.mu.Lock()
+	defer n.forwarding.mu.Unlock()
+	delete(n.forwarding.policies, peerID)
+	delete(n.forwarding.paused, peerID)
+}
+
+// updateAllForwarding applies the policies of all subscribers, e.g.
+// after the active speaker changed.
+func (n *SFU) updateAllForwarding() {
+	n.forwarding.mu.Lock()
+	peerIDs := make([]string, 0, len(n.forwarding.policies))
+	for peerID := range n.forwarding.policies {
+		peerIDs = append(peerIDs, peerID)
+	}
+	n.forwarding.mu.Unlock()
+	for _, peerID := range peerIDs {
+		n.updateForwarding(peerID)
+	}
+}
+
+// rankedTrack is a video track subscribed by a peer.
+type rankedTrack struct {
+	track *inboundTrack
+	sub   *subscription
+	class int
+	rank  int
+}
+
+// updateForwarding pauses and resumes the video subscriptions of
+// peerID according to its policy and viewports.
+func (n *SFU) updateForwarding(peerID string) {
+	n.forwarding.mu.Lock()
+	policy := n.forwarding.policies[peerID]
+	n.forwarding.mu.Unlock()
+
+	speakers := n.ActiveSpeakers(n.speakerGroup(peerID))
+	var ranked []rankedTrack
+	n.mu.RLock()
+	for _, track := range n.inboundTracks {
+		if track.kind != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		track.mu.RLock()
+		sub, subscribed := track.subscribers[peerID]
+		track.mu.RUnlock()
+		if !subscribed || sub.peer == nil {
+			continue
+		}
+		r := rankedTrack{track: track, sub: sub, class: 3}
+		switch {
+		case slices.Contains(policy.Pinned, track.ownerID):
+			r.class = 0
+		case track.Source().IsScreen():
+			r.class = 1
+		case slices.Contains(policy.OnScreen, track.id):
+			r.class = 2
+		}
+		if visible, known := sub.visible(); known && visible && r.class > 2 {
+			r.class = 2
+		}
+		r.rank = slices.Index(speakers, track.ownerID)
+		if r.rank < 0 {
+			r.rank = len(speakers)
+		}
+		ranked = append(ranked, r)
+	}
+	n.mu.RUnlock()
+	slices.SortFunc(ranked, func(a, b rankedTrack) int {
+		if a.class != b.class {
+			return a.class - b.class
+		}
+		if a.rank != b.rank {
+			return a.rank - b.rank
+		}
+		return strings.Compare(a.track.id, b.track.id)
+	})
+
+	paused := []string{}
+	for i, r := range ranked {
+		visible, _ := r.sub.visible()
+		pause := (policy.LastN > 0 && i >= policy.LastN) || !visible
+		if pause {
+			paused = append(paused, r.track.id)
+		}
+		if r.sub.setPaused(pause) {
+			r.track.mu.RLock()
+			ssrc := r.track.ssrcOf(r.sub.currentLayer())
+			r.track.mu.RUnlock()
+			n.requestLayerKeyframe(r.track, ssrc)
+		}
+	}
+	slices.Sort(paused)
+
+	if _, registered := n.Peer(peerID); !registered {
+		return
+	}
+	n.forwarding.mu.Lock()
+	defer n.forwarding.mu.Unlock()
+	n.forwarding.init()
+	changed := !slices.Equal(n.forwarding.paused[peerID], paused)
+	n.forwarding.paused[peerID] = paused
+	// Queued under the lock, so that the last call has the last state.
+	if changed && n.OnForwarding != nil {
+		n.events.push(func() { n.OnForwarding(peerID, paused) })
+	}
+}
+
+// Paused returns the ids of the tracks paused for peer.
+func (n *SFU) Paused(peer *webrtc.PeerConnection) ([]string, error) {
+	peerID, exists := n.PeerID(peer)
+	if !exists {
+		return nil, ErrPeerNotRegistered
+	}
+	n.forwarding.mu.Lock()
+	defer n.forwarding.mu.Unlock()
+	return slices.Clone(n.forwarding.paused[peerID]), nil
+}
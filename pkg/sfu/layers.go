@@ -0,0 +1,286 @@
+package sfu
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/svc"
+)
+
+// Viewport is how a subscriber displays a video track.
+type Viewport struct {
+	// Width and Height the track is rendered at, in pixels.
+	Width   int  `json:"width"`
+	Height  int  `json:"height"`
+	Visible bool `json:"visible"`
+	// FrameRate wanted, zero for the full rate. Only temporal SVC
+	// layers can lower it.
+	FrameRate int `json:"frame_rate,omitempty"`
+}
+
+// layer is a simulcast encoding of an inbound track.
+type layer struct {
+	rid  string
+	ssrc uint32
+	// Resolution found in the last keyframe, if the codec tells.
+	width, height atomic.Int32
+}
+
+// Usual RIDs of simulcast layers and how much they are scaled down.
+var ridScales = map[string]int{
+	"q": 4, "h": 2, "f": 1,
+	"l": 4, "m": 2,
+	"low": 4, "mid": 2, "high": 1,
+}
+
+// size returns the resolution of l, from its keyframes or else
+// estimated from its RID and the resolution of track.
+func (l *layer) size(track *inboundTrack) (int, int, bool) {
+	if w, h := l.width.Load(), l.height.Load(); w > 0 && h > 0 {
+		return int(w), int(h), true
+	}
+	scale, ok := ridScales[l.rid]
+	if !ok || track.width == 0 || track.height == 0 {
+		return 0, 0, false
+	}
+	return track.width / scale, track.height / scale, true
+}
+
+// SetViewport tells how peer displays trackID. Video which is not
+// visible is paused, and the smallest simulcast or SVC layer covering
+// the viewport is forwarded.
+func (n *SFU) SetViewport(peer *webrtc.PeerConnection, trackID string, v Viewport) error {
+	n.mu.RLock()
+	peerID, registered := n.peers[peer]
+	track, exists := n.inboundTracks[trackID]
+	n.mu.RUnlock()
+	if !registered {
+		return ErrPeerNotRegistered
+	}
+	if !exists {
+		return ErrTrackNotFound
+	}
+	track.mu.RLock()
+	sub, subscribed := track.subscribers[peerID]
+	target := n.selectLayer(track, v)
+	track.mu.RUnlock()
+	if !subscribed {
+		return ErrNotSubscribed
+	}
+	layers := allLayers
+	if track.svc != nil {
+		layers = track.svc.selectLayers(v)
+	}
+
+	sub.mu.Lock()
+	sub.viewport = &v
+	switched := target != nil && target.rid != sub.target
+	if switched {
+		sub.target = target.rid
+	}
+	// Higher spatial layers need a keyframe.
+	upgraded := layers.spatial > sub.svc.spatial
+	sub.svcTarget = layers
+	sub.mu.Unlock()
+	if switched && target.rid != sub.currentLayer() {
+		n.requestLayerKeyframe(track, target.ssrc)
+	}
+	if upgraded {
+		n.requestLayerKeyframe(track, track.ssrc)
+	}
+	n.updateForwarding(peerID)
+	return nil
+}
+
+// selectLayer returns the smallest layer of track covering v, or the
+// largest one if none does. It returns nil if track has a single
+// layer or the sizes of its layers are unknown. track.mu must be held.
+func (n *SFU) selectLayer(track *inboundTrack, v Viewport) *layer {
+	if len(track.simulcast) < 2 {
+		return nil
+	}
+	var best, largest *layer
+	var bestArea, largestArea int
+	for _, l := range track.simulcast {
+		w, h, ok := l.size(track)
+		if !ok {
+			return nil
+		}
+		area := w * h
+		if largest == nil || area > largestArea {
+			largest, largestArea = l, area
+		}
+		if w >= v.Width && h >= v.Height && (best == nil || area < bestArea) {
+			best, bestArea = l, area
+		}
+	}
+	if best == nil {
+		return largest
+	}
+	return best
+}
+
+// requestLayerKeyframe asks the publisher of track for a keyframe of
+// the layer sent with ssrc.
+func (n *SFU) requestLayerKeyframe(track *inboundTrack, ssrc uint32) {
+	if track.owner == nil {
+		return
+	}
+	err := track.owner.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: ssrc},
+	})
+	if err != nil {
+		log.Println("Error sending PLI:", err)
+	}
+}
+
+// fanOut hands a packet of layer rid of track to the subscribers
+// which are forwarded that layer. track.mu must be read-locked.
+func (n *SFU) fanOut(track *inboundTrack, rid string, packet *rtp.Packet) {
+	var kf keyframe
+	if len(track.simulcast) > 1 {
+		kf = parseKeyframe(track.codec.MimeType, packet.Payload)
+		if l, ok := track.layer(rid); ok && kf.width > 0 && kf.height > 0 {
+			l.width.Store(int32(kf.width))
+			l.height.Store(int32(kf.height))
+		}
+	}
+	var frame *svc.Frame
+	if track.svc != nil {
+		if f, ok := track.svc.observe(packet); ok {
+			frame = &f
+		}
+	}
+	for _, sub := range track.subscribers {
+		if sub.paused.Load() {
+			continue
+		}
+		out, ok := sub.take(rid, packet, kf, frame, track.codec.ClockRate)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.ch <- out:
+		default:
+			// drop packet in case of congestion
+		}
+	}
+}
+
+// ssrcOf returns the SSRC of layer rid of t. t.mu must be held.
+func (t *inboundTrack) ssrcOf(rid string) uint32 {
+	if l, ok := t.layer(rid); ok {
+		return l.ssrc
+	}
+	return t.ssrc
+}
+
+// layer looks up a simulcast layer of track. track.mu must be held.
+func (t *inboundTrack) layer(rid string) (*layer, bool) {
+	for _, l := range t.simulcast {
+		if l.rid == rid {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// currentLayer returns the RID of the layer forwarded to sub.
+func (sub *subscription) currentLayer() string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.layer
+}
+
+// take returns packet as it is to be forwarded to sub, if sub is
+// forwarded layer rid and, for SVC, the layers of frame. Switching to
+// the target layer waits for a keyframe of it, unless keyframes of
+// the codec are not recognized.
+func (sub *subscription) take(rid string, packet *rtp.Packet, kf keyframe, frame *svc.Frame, clockRate uint32) (*rtp.Packet, bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if rid != sub.layer {
+		if rid != sub.target || (kf.known && !kf.start) {
+			return nil, false
+		}
+		sub.layer = rid
+		sub.rw.switched = true
+	}
+	if frame != nil && !sub.takeFrame(*frame) {
+		// Keep the sequence numbers continuous over dropped layers.
+		sub.rw.resync = true
+		return nil, false
+	}
+	out := sub.rw.rewrite(packet, clockRate)
+	// The marker ends a picture, which now ends with the highest
+	// spatial layer forwarded.
+	if frame != nil && frame.End && frame.Spatial == sub.svc.spatial && !out.Marker {
+		marked := *out
+		marked.Marker = true
+		out = &marked
+	}
+	return out, true
+}
+
+// setPaused pauses or resumes sub and reports whether it was resumed.
+func (sub *subscription) setPaused(paused bool) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	resumed := sub.paused.Swap(paused) && !paused
+	if resumed {
+		sub.rw.resync = true
+	}
+	return resumed
+}
+
+// visible reports whether the subscriber displays the track. Without
+// a viewport, it is assumed to.
+func (sub *subscription) visible() (visible, known bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.viewport == nil {
+		return true, false
+	}
+	return sub.viewport.Visible, true
+}
+
+// rewriter keeps the sequence numbers and timestamps forwarded to a
+// subscriber continuous across pauses and layer switches.
+type rewriter struct {
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+	started   bool
+	// resync continues the sequence numbers after a pause, switched
+	// also the timestamps after a switch to another layer.
+	resync, switched bool
+}
+
+func (w *rewriter) rewrite(p *rtp.Packet, clockRate uint32) *rtp.Packet {
+	if w.started && (w.resync || w.switched) {
+		w.seqOffset = p.SequenceNumber - (w.lastSeq + 1)
+		if w.switched {
+			elapsed := uint32(time.Since(w.lastAt).Seconds() * float64(clockRate))
+			w.tsOffset = p.Timestamp - (w.lastTS + max(elapsed, 1))
+		}
+	}
+	w.resync, w.switched = false, false
+	out := p
+	if w.seqOffset != 0 || w.tsOffset != 0 {
+		rewritten := *p
+		rewritten.SequenceNumber -= w.seqOffset
+		rewritten.Timestamp -= w.tsOffset
+		out = &rewritten
+	}
+	if !w.started || int16(out.SequenceNumber-w.lastSeq) > 0 {
+		w.lastSeq, w.lastTS, w.lastAt = out.SequenceNumber, out.Timestamp, time.Now()
+	}
+	w.started = true
+	return out
+}
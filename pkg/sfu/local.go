@@ -0,0 +1,106 @@
+package sfu
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// LocalTrack describes an inbound track which is not received from a
+// PeerConnection, e.g. a replayed capture.
+type LocalTrack struct {
+	ID       string
+	StreamID string
+	// Owner is reported in TrackInfo. It does not have to be a
+	// registered peer.
+	Owner  string
+	Codec  webrtc.RTPCodecCapability
+	Source TrackSource
+	// AudioLevelExtension is the id of the RFC 6464 audio level
+	// header extension in the packets, if they carry one.
+	AudioLevelExtension uint8
+	// DependencyDescriptorExtension is the id of the dependency
+	// descriptor header extension of SVC video, if any.
+	DependencyDescriptorExtension uint8
+}
+
+func (t LocalTrack) kind() webrtc.RTPCodecType {
+	if strings.HasPrefix(strings.ToLower(t.Codec.MimeType), "audio/") {
+		return webrtc.RTPCodecTypeAudio
+	}
+	return webrtc.RTPCodecTypeVideo
+}
+
+// PublishTrack adds a local track which forwards the packets read
+// from packets until the channel is closed or the track is
+// unpublished. It returns the id of the track.
+func (n *SFU) PublishTrack(t LocalTrack, packets <-chan *rtp.Packet) (string, error) {
+	trackID := fmt.Sprintf("%s#%s", t.StreamID, t.ID)
+	stopped := make(chan struct{})
+	track := &inboundTrack{
+		id:       trackID,
+		ownerID:  t.Owner,
+		remoteID: t.ID,
+		streamID: t.StreamID,
+		kind:     t.kind(),
+		codec:    t.Codec,
+		stop: sync.OnceValue(func() error {
+			close(stopped)
+			return nil
+		}),
+		subscribers: make(map[string]*subscription),
+	}
+	source := t.Source
+	if source == "" {
+		source = defaultSource(track.kind)
+	}
+	if !source.Valid() {
+		return "", ErrInvalidSource
+	}
+	track.source.Store(source)
+	if track.kind == webrtc.RTPCodecTypeAudio {
+		track.audioLevel = t.AudioLevelExtension
+		track.speakerGroup = n.speakerGroup(track.ownerID)
+	} else {
+		track.svc = newScalable(t.Codec.MimeType, t.DependencyDescriptorExtension)
+	}
+	if n.Authorizer != nil && !n.Authorizer.CanPublish(t.Owner, source) {
+		return "", ErrNotPermitted
+	}
+
+	n.mu.Lock()
+	if _, exists := n.inboundTracks[trackID]; exists {
+		n.mu.Unlock()
+		return "", ErrTrackExists
+	}
+	n.inboundTracks[trackID] = track
+	n.mu.Unlock()
+	log.Printf("Local track %s has started: %s\n", trackID, t.Codec.MimeType)
+
+	n.startCapture(track)
+	n.notifyTrackInfo(track)
+	go func() {
+		defer func() {
+			// Keep the producer from blocking on an unpublished track.
+			for range packets {
+			}
+		}()
+		defer n.removeTrack(trackID, track)
+		n.forward(track, func() (*rtp.Packet, error) {
+			select {
+			case packet, ok := <-packets:
+				if !ok {
+					return nil, ErrTrackEnded
+				}
+				return packet, nil
+			case <-stopped:
+				return nil, ErrTrackEnded
+			}
+		})
+	}()
+	return trackID, nil
+}
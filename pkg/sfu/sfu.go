@@ -5,35 +5,182 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/ravenbox/raven-prototype/pkg/utils"
 )
 
+var (
+	ErrPeerNotRegistered = errors.New("peer not registered")
+	ErrTrackNotFound     = errors.New("track does not exist")
+	ErrNotSubscribed     = errors.New("peer is not subscribed to track")
+	ErrAlreadySubscribed = errors.New("already subscribed to track")
+	ErrNotPermitted      = errors.New("not permitted")
+	ErrInvalidSource     = errors.New("invalid track source")
+	ErrTrackExists       = errors.New("track already exists")
+	ErrTrackEnded        = errors.New("track ended")
+	ErrTooManyPending    = errors.New("too many tracks announced ahead of publishing")
+)
+
+// Authorizer decides what registered peers are allowed to do. It is
+// called without locks of the SFU held, so it may look up tracks.
+type Authorizer interface {
+	CanPublish(peerID string, source TrackSource) bool
+	CanSubscribe(peerID, trackID string) bool
+}
+
 type SFU struct {
-	peers         map[*webrtc.PeerConnection]struct{}
+	// Authorizer is consulted for every inbound track and subscription.
+	// A nil Authorizer allows everything.
+	Authorizer Authorizer
+	// Policies for forwarding tracks by source.
+	Policies map[TrackSource]SourcePolicy
+	// OnTrackInfo is called whenever a track starts or its TrackInfo
+	// changes, OnTrackEnded when it is gone. Like OnActiveSpeaker,
+	// they are called in order from a goroutine of their own.
+	OnTrackInfo  func(TrackInfo)
+	OnTrackEnded func(TrackInfo)
+	// Capturer captures the packets of all inbound tracks if set.
+	Capturer Capturer
+	// API creates the PeerConnections of peers. NewSFU sets NewAPI().
+	API *webrtc.API
+	// AudioAPI creates the PeerConnections of peers which only send
+	// and receive audio. NewSFU sets NewAudioAPI().
+	AudioAPI *webrtc.API
+	// SpeakerGroup returns the group, e.g. the room, in which the
+	// audio of ownerID competes for active speaker. If nil, all
+	// tracks are in one group.
+	SpeakerGroup func(ownerID string) string
+	// OnActiveSpeaker is called when the dominant speaker of a group
+	// changes. It is called from a goroutine of its own, so it may
+	// take its time without holding up media.
+	OnActiveSpeaker func(group, ownerID string)
+	// OnForwarding is called with the ids of the tracks paused for a
+	// subscriber whenever they change, from the same goroutine as
+	// OnTrackInfo. See ForwardingPolicy.
+	OnForwarding func(peerID string, paused []string)
+
+	peers         map[*webrtc.PeerConnection]string
 	inboundTracks map[string]*inboundTrack
-	mu            sync.RWMutex
+	pendingMeta   map[*webrtc.PeerConnection][]TrackMeta
+	speakers      speakerDetector
+	forwarding    forwarding
+	events        events
+	// starting serializes the authorization of inbound tracks with
+	// adding them, see newRemoteTrack. The Authorizer may take mu.
+	starting sync.Mutex
+	mu       sync.RWMutex
 }
 
 type inboundTrack struct {
-	subscribers map[*webrtc.PeerConnection]chan *rtp.Packet
-	mu          sync.RWMutex
+	id      string
+	owner   *webrtc.PeerConnection // nil for local tracks
+	ownerID string
+	// stop ends the track, e.g. by stopping its receiver.
+	stop     func() error
+	capture  TrackCapture
+	remoteID string
+	streamID string
+	mid      string
+	ssrc     uint32
+	kind     webrtc.RTPCodecType
+	codec    webrtc.RTPCodecCapability
+	// audioLevel is the id of the audio level header extension, or 0.
+	audioLevel   uint8
+	speakerGroup string
+	// silent is set while audio is inferred to be muted, since
+	// silentSince. silentSince is only used by the forwarding loop.
+	silent      atomic.Bool
+	silentSince time.Time
+	source      atomic.Value // TrackSource
+	muted       atomic.Bool
+	subscribers map[string]*subscription // by subscriber id
+
+	// rid of the layer the track was created with, and the simulcast
+	// layers of the track, if any.
+	rid       string
+	simulcast []*layer
+	// svc is set for video whose layers are scalable within one
+	// stream.
+	svc *scalable
+
+	// Reported by the publisher.
+	layers         []string
+	width, height  int
+	publisherMuted bool
+
+	mu sync.RWMutex
+}
+
+func (t *inboundTrack) Source() TrackSource {
+	return t.source.Load().(TrackSource)
+}
+
+// subscription forwards a track either to a peer or, if peer is
+// nil, to a sink reading ch.
+type subscription struct {
+	ch     chan *rtp.Packet
+	peer   *webrtc.PeerConnection
+	sender *webrtc.RTPSender
+	// paused stops forwarding without renegotiation.
+	paused atomic.Bool
+
+	// layer is the RID of the simulcast layer forwarded, target the
+	// one to switch to at the next keyframe.
+	layer, target string
+	// svc are the SVC layers forwarded, svcTarget the ones to switch
+	// to when the stream allows.
+	svc, svcTarget svcLayers
+	viewport       *Viewport
+	rw             rewriter
+	mu             sync.Mutex
 }
 
 func NewSFU() *SFU {
 	return &SFU{
-		peers:         make(map[*webrtc.PeerConnection]struct{}),
+		Policies:      DefaultSourcePolicies,
+		API:           NewAPI(),
+		AudioAPI:      NewAudioAPI(),
+		peers:         make(map[*webrtc.PeerConnection]string),
 		inboundTracks: make(map[string]*inboundTrack),
+		pendingMeta:   make(map[*webrtc.PeerConnection][]TrackMeta),
 	}
 }
 
-func (n *SFU) RegisterPeer(peer *webrtc.PeerConnection) {
+// RegisterPeer adds peer to the SFU under id. The id is only used
+// for inspection, e.g. by the admin API.
+func (n *SFU) RegisterPeer(id string, peer *webrtc.PeerConnection) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peers[peer] = id
+	peer.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		n.newRemoteTrack(peer, tr, r)
+	})
+}
+
+// UnregisterPeer removes peer and all of its subscriptions from the SFU.
+// Tracks published by peer are removed once their read loop ends.
+func (n *SFU) UnregisterPeer(peer *webrtc.PeerConnection) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	n.peers[peer] = struct{}{}
-	peer.OnTrack(n.newRemoteTrack)
+	id, exists := n.peers[peer]
+	if !exists {
+		return
+	}
+	delete(n.peers, peer)
+	delete(n.pendingMeta, peer)
+	n.removeForwardingPolicy(id)
+	for _, track := range n.inboundTracks {
+		track.mu.Lock()
+		if sub, ok := track.subscribers[id]; ok && sub.peer == peer {
+			close(sub.ch)
+			delete(track.subscribers, id)
+		}
+		track.mu.Unlock()
+	}
 }
 
 func (n *SFU) Peers() []*webrtc.PeerConnection {
@@ -42,32 +189,98 @@ func (n *SFU) Peers() []*webrtc.PeerConnection {
 	return utils.MapPointerKeys(n.peers)
 }
 
+// PeerID returns the id peer has been registered with.
+func (n *SFU) PeerID(peer *webrtc.PeerConnection) (string, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	id, ok := n.peers[peer]
+	return id, ok
+}
+
+// Peer looks up a registered peer by its id.
+func (n *SFU) Peer(id string) (*webrtc.PeerConnection, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for peer, peerID := range n.peers {
+		if peerID == id {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
 func (n *SFU) Tracks() []string {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	return utils.MapKeys(n.inboundTracks)
 }
 
+// TrackOwner returns the id of the peer which publishes trackID.
+func (n *SFU) TrackOwner(trackID string) (string, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	track, exists := n.inboundTracks[trackID]
+	if !exists {
+		return "", ErrTrackNotFound
+	}
+	return track.ownerID, nil
+}
+
+// Subscriptions returns the ids of subscribed peers keyed by track id.
+func (n *SFU) Subscriptions() map[string][]string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	subs := make(map[string][]string, len(n.inboundTracks))
+	for trackID, track := range n.inboundTracks {
+		track.mu.RLock()
+		ids := utils.MapKeys(track.subscribers)
+		track.mu.RUnlock()
+		subs[trackID] = ids
+	}
+	return subs
+}
+
+// Subscribe forwards trackID to peer on a new outbound track, which
+// triggers a renegotiation.
 func (n *SFU) Subscribe(peer *webrtc.PeerConnection, trackID string) error {
+	peerID, err := n.subscribe(peer, trackID)
+	if err != nil {
+		return err
+	}
+	n.updateForwarding(peerID)
+	return nil
+}
+
+func (n *SFU) subscribe(peer *webrtc.PeerConnection, trackID string) (string, error) {
+	if peerID, ok := n.PeerID(peer); ok && n.Authorizer != nil &&
+		!n.Authorizer.CanSubscribe(peerID, trackID) {
+		return "", ErrNotPermitted
+	}
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	_, exists := n.peers[peer]
+	peerID, exists := n.peers[peer]
 	if !exists {
-		return errors.New("peer not registered")
+		return "", ErrPeerNotRegistered
 	}
 	track, exists := n.inboundTracks[trackID]
 	if !exists {
-		return errors.New("tack does not exists")
+		return "", ErrTrackNotFound
+	}
+	track.mu.RLock()
+	_, subscribed := track.subscribers[peerID]
+	track.mu.RUnlock()
+	if subscribed {
+		return "", ErrAlreadySubscribed
 	}
 
-	outboundTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
+	outboundTrack, err := newOutboundTrack(track)
 	if err != nil {
-		return err
+		return "", err
 	}
 	rtpSender, err := peer.AddTrack(outboundTrack)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// Read incoming RTCP packets
 	// Before these packets are returned they are processed by interceptors. For things
@@ -81,9 +294,17 @@ func (n *SFU) Subscribe(peer *webrtc.PeerConnection, trackID string) error {
 		}
 	}()
 
-	ch := make(chan *rtp.Packet, 32)
+	ch := make(chan *rtp.Packet, n.policy(track.Source()).queueSize())
 	track.mu.Lock()
-	track.subscribers[peer] = ch
+	track.subscribers[peerID] = &subscription{
+		ch:        ch,
+		peer:      peer,
+		sender:    rtpSender,
+		layer:     track.rid,
+		target:    track.rid,
+		svc:       allLayers,
+		svcTarget: allLayers,
+	}
 	track.mu.Unlock()
 	go func() {
 		for packet := range ch {
@@ -94,35 +315,241 @@ func (n *SFU) Subscribe(peer *webrtc.PeerConnection, trackID string) error {
 		}
 	}()
 
+	return peerID, nil
+}
+
+// Unsubscribe stops forwarding trackID to peer and removes the
+// outbound track from peer, which triggers a renegotiation.
+func (n *SFU) Unsubscribe(peer *webrtc.PeerConnection, trackID string) error {
+	n.mu.Lock()
+	peerID, exists := n.peers[peer]
+	if !exists {
+		n.mu.Unlock()
+		return ErrPeerNotRegistered
+	}
+	sub, err := n.unsubscribe(peerID, trackID)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Another track may take the place of this one.
+	n.updateForwarding(peerID)
+	return peer.RemoveTrack(sub.sender)
+}
+
+// unsubscribe detaches the subscriber id from trackID.
+// n.mu must be held.
+func (n *SFU) unsubscribe(id, trackID string) (*subscription, error) {
+	track, exists := n.inboundTracks[trackID]
+	if !exists {
+		return nil, ErrTrackNotFound
+	}
+	track.mu.Lock()
+	defer track.mu.Unlock()
+	sub, exists := track.subscribers[id]
+	if !exists {
+		return nil, ErrNotSubscribed
+	}
+	close(sub.ch)
+	delete(track.subscribers, id)
+	return sub, nil
+}
+
+// SetMuted enables or disables forwarding of trackID to all of its
+// subscribers. Muting is done server-side and needs no renegotiation.
+func (n *SFU) SetMuted(trackID string, muted bool) error {
+	n.mu.RLock()
+	track, exists := n.inboundTracks[trackID]
+	n.mu.RUnlock()
+	if !exists {
+		return ErrTrackNotFound
+	}
+	if track.muted.Swap(muted) != muted {
+		n.notifyTrackInfo(track)
+	}
 	return nil
 }
 
-func (n *SFU) newRemoteTrack(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+// Muted reports whether trackID is muted server-side.
+func (n *SFU) Muted(trackID string) (bool, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	track, exists := n.inboundTracks[trackID]
+	if !exists {
+		return false, ErrTrackNotFound
+	}
+	return track.muted.Load(), nil
+}
+
+// Unpublish forcibly ends trackID, e.g. by stopping its receiver on
+// the publishing peer. The track is then removed from all subscribers.
+func (n *SFU) Unpublish(trackID string) error {
+	n.mu.RLock()
+	track, exists := n.inboundTracks[trackID]
+	n.mu.RUnlock()
+	if !exists {
+		return ErrTrackNotFound
+	}
+	return track.stop()
+}
+
+func (n *SFU) newRemoteTrack(peer *webrtc.PeerConnection, tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
 	trackID := fmt.Sprintf("%s#%s", tr.StreamID(), tr.ID())
 	log.Printf("Track %s has started, of type %d: %s \n",
 		trackID, tr.PayloadType(), tr.Codec().MimeType)
+	// The layers of a simulcast track start concurrently. Only the
+	// first one is authorized, the others join its track.
+	n.starting.Lock()
+	if existing, ok := n.simulcastTrack(peer, trackID, tr); ok {
+		n.starting.Unlock()
+		n.addLayer(existing, tr)
+		return
+	}
+	peerID, _ := n.PeerID(peer)
 	track := &inboundTrack{
-		subscribers: make(map[*webrtc.PeerConnection]chan *rtp.Packet),
+		id:          trackID,
+		owner:       peer,
+		ownerID:     peerID,
+		stop:        r.Stop,
+		remoteID:    tr.ID(),
+		streamID:    tr.StreamID(),
+		mid:         mid(peer, r),
+		ssrc:        uint32(tr.SSRC()),
+		kind:        tr.Kind(),
+		codec:       tr.Codec().RTPCodecCapability,
+		subscribers: make(map[string]*subscription),
+	}
+	if tr.Kind() == webrtc.RTPCodecTypeAudio {
+		track.audioLevel = AudioLevelExtension(r)
+		track.speakerGroup = n.speakerGroup(track.ownerID)
+	} else {
+		track.svc = newScalable(track.codec.MimeType, DependencyDescriptorExtension(r))
+	}
+	if rid := tr.RID(); rid != "" {
+		track.rid = rid
+		track.layers = []string{rid}
+		track.simulcast = []*layer{{rid: rid, ssrc: track.ssrc}}
+	}
+	track.source.Store(defaultSource(tr.Kind()))
+	if meta, ok := n.takePendingMeta(peer, track); ok {
+		track.apply(meta)
+	}
+	if n.Authorizer != nil && !n.Authorizer.CanPublish(peerID, track.Source()) {
+		n.starting.Unlock()
+		log.Printf("Track %s rejected: %s may not publish %s\n", trackID, peerID, track.Source())
+		if err := r.Stop(); err != nil {
+			log.Println("Error stopping rejected track:", err)
+		}
+		return
 	}
 	n.mu.Lock()
 	n.inboundTracks[trackID] = track
 	n.mu.Unlock()
+	n.starting.Unlock()
+	defer n.removeTrack(trackID, track)
+	if n.startCapture(track) {
+		go n.captureRTCP(track, r)
+	}
+	n.notifyTrackInfo(track)
 
-	for {
+	n.forward(track, func() (*rtp.Packet, error) {
 		packet, _, err := tr.ReadRTP()
+		return packet, err
+	})
+}
+
+// simulcastTrack returns the track trackID of peer if tr is another
+// simulcast layer of it.
+func (n *SFU) simulcastTrack(peer *webrtc.PeerConnection, trackID string, tr *webrtc.TrackRemote) (*inboundTrack, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	existing, exists := n.inboundTracks[trackID]
+	if !exists || existing.owner != peer || tr.RID() == "" {
+		return nil, false
+	}
+	return existing, true
+}
+
+// forward fans packets returned by read out to all subscribers of
+// track until read fails.
+func (n *SFU) forward(track *inboundTrack, read func() (*rtp.Packet, error)) {
+	n.limitBitrate(track)
+	lastREMB := time.Now()
+	for {
+		packet, err := read()
 		if err != nil {
 			log.Println("Error reading RTP packet:", err)
 			return
 		}
+		if track.capture != nil {
+			if err := track.capture.WriteRTP(packet, time.Now()); err != nil {
+				log.Println("Error capturing RTP packet:", err)
+			}
+		}
+		if track.audioLevel != 0 {
+			n.observeAudioLevel(track, packet)
+		}
+		if track.kind == webrtc.RTPCodecTypeAudio {
+			n.observeSilence(track, packet)
+		}
+		if time.Since(lastREMB) >= rembInterval {
+			n.limitBitrate(track)
+			lastREMB = time.Now()
+		}
+		if track.muted.Load() {
+			continue
+		}
 		track.mu.RLock()
-		subscribers := track.subscribers
+		n.fanOut(track, track.rid, packet)
 		track.mu.RUnlock()
-		for _, ch := range subscribers {
-			select {
-			case ch <- packet:
-			default:
-				// drop packet in case of congestion
+	}
+}
+
+// removeTrack drops an ended inbound track and detaches it from
+// all subscribers.
+func (n *SFU) removeTrack(trackID string, track *inboundTrack) {
+	n.mu.Lock()
+	if n.inboundTracks[trackID] == track {
+		delete(n.inboundTracks, trackID)
+	}
+	n.mu.Unlock()
+	n.removeSpeakerTrack(trackID)
+	if track.capture != nil {
+		if err := track.capture.Close(); err != nil {
+			log.Println("Error closing capture:", err)
+		}
+	}
+	if n.OnTrackEnded != nil {
+		// Queued behind the OnTrackInfo calls of the track.
+		info := n.trackInfo(track)
+		n.events.push(func() { n.OnTrackEnded(info) })
+	}
+
+	track.mu.Lock()
+	for id, sub := range track.subscribers {
+		close(sub.ch)
+		if sub.peer != nil {
+			if err := sub.peer.RemoveTrack(sub.sender); err != nil {
+				log.Println("Error removing ended track from subscriber:", err)
 			}
 		}
+		delete(track.subscribers, id)
+	}
+	track.mu.Unlock()
+	n.updateAllForwarding()
+}
+
+// Direction tells a negotiator of a subscriber to offer transceivers
+// which only carry subscriptions as sendonly, so that the subscriber
+// does not expect media on them. See negotiation.Direction.
+func Direction(t *webrtc.RTPTransceiver) webrtc.RTPTransceiverDirection {
+	sender, receiver := t.Sender(), t.Receiver()
+	if sender == nil || sender.Track() == nil {
+		return webrtc.RTPTransceiverDirectionUnknown
+	}
+	if receiver != nil && receiver.Track() != nil {
+		// The transceiver also carries a track of the peer.
+		return webrtc.RTPTransceiverDirectionUnknown
 	}
+	return webrtc.RTPTransceiverDirectionSendonly
 }
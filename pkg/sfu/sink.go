@@ -0,0 +1,56 @@
+package sfu
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// SubscribeSink subscribes to trackID without a PeerConnection, e.g.
+// for recording. Packets are delivered on the returned channel, which
+// is closed once the track ends or UnsubscribeSink is called. Packets
+// must not be modified, they are shared with other subscribers.
+//
+// The publisher of video is asked for a keyframe, since sinks such as
+// media writers skip everything before the first one.
+func (n *SFU) SubscribeSink(sinkID, trackID string) (<-chan *rtp.Packet, error) {
+	track, ch, err := n.subscribeSink(sinkID, trackID)
+	if err != nil {
+		return nil, err
+	}
+	if track.kind == webrtc.RTPCodecTypeVideo {
+		n.requestLayerKeyframe(track, track.ssrc)
+	}
+	return ch, nil
+}
+
+func (n *SFU) subscribeSink(sinkID, trackID string) (*inboundTrack, <-chan *rtp.Packet, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	track, exists := n.inboundTracks[trackID]
+	if !exists {
+		return nil, nil, ErrTrackNotFound
+	}
+	ch := make(chan *rtp.Packet, n.policy(track.Source()).queueSize())
+	track.mu.Lock()
+	defer track.mu.Unlock()
+	if _, exists := track.subscribers[sinkID]; exists {
+		return nil, nil, ErrAlreadySubscribed
+	}
+	track.subscribers[sinkID] = &subscription{
+		ch:        ch,
+		layer:     track.rid,
+		target:    track.rid,
+		svc:       allLayers,
+		svcTarget: allLayers,
+	}
+	return track, ch, nil
+}
+
+// UnsubscribeSink detaches a sink subscribed by SubscribeSink.
+func (n *SFU) UnsubscribeSink(sinkID, trackID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := n.unsubscribe(sinkID, trackID)
+	return err
+}
@@ -0,0 +1,92 @@
+package sfu_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func Test_SinkRequestsKeyframe(t *testing.T) {
+	s := sfu.NewSFU()
+	started := make(chan sfu.TrackInfo, 1)
+	s.OnTrackInfo = func(info sfu.TrackInfo) {
+		select {
+		case started <- info:
+		default:
+		}
+	}
+	local, remote := connect(t, s, "alice", s.API, sfu.NewAPI())
+	video, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := remote.AddTrack(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plis := make(chan uint32, 16)
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, p := range packets {
+				if pli, ok := p.(*rtcp.PictureLossIndication); ok {
+					plis <- pli.MediaSSRC
+				}
+			}
+		}
+	}()
+	negotiate(t, remote, local)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				video.WriteSample(media.Sample{Data: []byte{0x01, 0x00, 0x00}, Duration: 20 * time.Millisecond})
+			case <-done:
+				return
+			}
+		}
+	}()
+	var info sfu.TrackInfo
+	select {
+	case info = <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Track not started")
+	}
+	select {
+	case <-plis:
+		t.Fatal("Got a PLI without subscribers")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ch, err := s.SubscribeSink("recorder", info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.UnsubscribeSink("recorder", info.ID)
+	select {
+	case ssrc := <-plis:
+		if want := uint32(sender.GetParameters().Encodings[0].SSRC); ssrc != want {
+			t.Errorf("Got PLI for SSRC %d, want %d", ssrc, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No PLI sent when a sink subscribed")
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Error("Sink got no packets")
+	}
+}
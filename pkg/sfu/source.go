@@ -0,0 +1,233 @@
+package sfu
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// TrackSource tells what a published track carries. Publishers
+// announce it with TrackMeta; otherwise it is inferred from the kind.
+type TrackSource string
+
+const (
+	SourceCamera      TrackSource = "camera"
+	SourceMicrophone  TrackSource = "microphone"
+	SourceScreen      TrackSource = "screen"
+	SourceScreenAudio TrackSource = "screen-audio"
+)
+
+// IsScreen reports whether s is part of a screen share.
+func (s TrackSource) IsScreen() bool {
+	return s == SourceScreen || s == SourceScreenAudio
+}
+
+func (s TrackSource) Valid() bool {
+	switch s {
+	case SourceCamera, SourceMicrophone, SourceScreen, SourceScreenAudio:
+		return true
+	default:
+		return false
+	}
+}
+
+func defaultSource(kind webrtc.RTPCodecType) TrackSource {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return SourceMicrophone
+	}
+	return SourceCamera
+}
+
+// TrackMeta annotates a track of a publisher. The track is matched
+// either by its MID or by its track ID, whichever is given.
+type TrackMeta struct {
+	MID     string
+	TrackID string
+	// Source of the track. If empty, the current source is kept.
+	Source TrackSource
+	// Resolution hint of video tracks.
+	Width, Height int
+	// Muted is set when the publisher has muted the track locally.
+	Muted bool
+}
+
+func (m TrackMeta) matches(t *inboundTrack) bool {
+	return (m.MID != "" && m.MID == t.mid) ||
+		(m.TrackID != "" && m.TrackID == t.remoteID)
+}
+
+// SourcePolicy controls how tracks of a source are forwarded.
+type SourcePolicy struct {
+	// Priority of the source. Subscriber queues of higher priority
+	// tracks are deeper, so they are the last to drop packets under
+	// congestion.
+	Priority int
+	// MaxBitrate in bits per second which the publisher is asked to
+	// stay below via REMB. Zero leaves the bitrate alone.
+	MaxBitrate uint64
+}
+
+var DefaultSourcePolicies = map[TrackSource]SourcePolicy{
+	SourceMicrophone:  {Priority: 3},
+	SourceScreenAudio: {Priority: 3},
+	SourceScreen:      {Priority: 2, MaxBitrate: 2_500_000},
+	SourceCamera:      {Priority: 1, MaxBitrate: 1_500_000},
+}
+
+const (
+	baseQueueSize = 32
+	rembInterval  = time.Second
+	// Tracks a peer may announce ahead of publishing them.
+	maxPendingMeta = 16
+)
+
+func (n *SFU) policy(source TrackSource) SourcePolicy {
+	if p, ok := n.Policies[source]; ok {
+		return p
+	}
+	return SourcePolicy{Priority: 1}
+}
+
+func (p SourcePolicy) queueSize() int {
+	return baseQueueSize * max(p.Priority, 1)
+}
+
+// limitBitrate asks the publisher of track to respect the bitrate
+// policy of its source.
+func (n *SFU) limitBitrate(track *inboundTrack) {
+	bitrate := n.policy(track.Source()).MaxBitrate
+	if bitrate == 0 || track.owner == nil {
+		return
+	}
+	err := track.owner.WriteRTCP([]rtcp.Packet{
+		&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(bitrate),
+			SSRCs:   []uint32{track.ssrc},
+		},
+	})
+	if err != nil {
+		log.Println("Error sending REMB:", err)
+	}
+}
+
+// AnnounceTrack attaches meta to a track of peer. Tracks which have
+// not arrived yet get the metadata once they start. It returns the
+// id of the matched track, or an empty string if it is pending.
+func (n *SFU) AnnounceTrack(peer *webrtc.PeerConnection, meta TrackMeta) (string, error) {
+	if meta.Source != "" && !meta.Source.Valid() {
+		return "", ErrInvalidSource
+	}
+	n.mu.Lock()
+	peerID, exists := n.peers[peer]
+	if !exists {
+		n.mu.Unlock()
+		return "", ErrPeerNotRegistered
+	}
+	var track *inboundTrack
+	for _, t := range n.inboundTracks {
+		if t.owner == peer && meta.matches(t) {
+			track = t
+			break
+		}
+	}
+	if track == nil {
+		err := n.addPendingMeta(peer, meta)
+		n.mu.Unlock()
+		return "", err
+	}
+	n.mu.Unlock()
+
+	sourceChanged := meta.Source != "" && meta.Source != track.Source()
+	if sourceChanged && n.Authorizer != nil &&
+		!n.Authorizer.CanPublish(peerID, meta.Source) {
+		if err := n.Unpublish(track.id); err != nil {
+			return "", err
+		}
+		return "", ErrNotPermitted
+	}
+	track.apply(meta)
+	if sourceChanged {
+		n.limitBitrate(track)
+	}
+	n.notifyTrackInfo(track)
+	return track.id, nil
+}
+
+// apply takes over the publisher-reported fields of meta.
+func (t *inboundTrack) apply(meta TrackMeta) {
+	if meta.Source != "" {
+		t.source.Store(meta.Source)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.width, t.height = meta.Width, meta.Height
+	t.publisherMuted = meta.Muted
+}
+
+// addPendingMeta keeps meta until its track arrives, replacing earlier
+// metadata of the same track. n.mu must be held.
+func (n *SFU) addPendingMeta(peer *webrtc.PeerConnection, meta TrackMeta) error {
+	pending := n.pendingMeta[peer]
+	for i, m := range pending {
+		if m.MID == meta.MID && m.TrackID == meta.TrackID {
+			pending[i] = meta
+			return nil
+		}
+	}
+	if len(pending) >= maxPendingMeta {
+		return ErrTooManyPending
+	}
+	n.pendingMeta[peer] = append(pending, meta)
+	return nil
+}
+
+// takePendingMeta returns and forgets pending metadata of peer
+// matching track.
+func (n *SFU) takePendingMeta(peer *webrtc.PeerConnection, track *inboundTrack) (TrackMeta, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	pending := n.pendingMeta[peer]
+	for i, meta := range pending {
+		if meta.matches(track) {
+			n.pendingMeta[peer] = append(pending[:i], pending[i+1:]...)
+			return meta, true
+		}
+	}
+	return TrackMeta{}, false
+}
+
+// TracksBySource returns the ids of all inbound tracks of source.
+func (n *SFU) TracksBySource(source TrackSource) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ids := []string{}
+	for id, track := range n.inboundTracks {
+		if track.Source() == source {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// TrackSource returns the source of trackID.
+func (n *SFU) TrackSource(trackID string) (TrackSource, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	track, exists := n.inboundTracks[trackID]
+	if !exists {
+		return "", ErrTrackNotFound
+	}
+	return track.Source(), nil
+}
+
+// mid returns the MID of the transceiver r belongs to.
+func mid(peer *webrtc.PeerConnection, r *webrtc.RTPReceiver) string {
+	for _, t := range peer.GetTransceivers() {
+		if t.Receiver() == r {
+			return t.Mid()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package sfu_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+func Test_PendingMeta(t *testing.T) {
+	s := sfu.NewSFU()
+	pc, err := s.API.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s.RegisterPeer("alice", pc)
+
+	announce := func(i int) error {
+		_, err := s.AnnounceTrack(pc, sfu.TrackMeta{
+			TrackID: fmt.Sprint("track", i),
+			Source:  sfu.SourceCamera,
+		})
+		return err
+	}
+	for i := 0; i < 16; i++ {
+		if err := announce(i); err != nil {
+			t.Fatalf("Announcing track %d: %v", i, err)
+		}
+	}
+	if err := announce(16); err != sfu.ErrTooManyPending {
+		t.Errorf("Got %v announcing too many tracks, want %v", err, sfu.ErrTooManyPending)
+	}
+	// Announcing a track again updates its metadata.
+	if err := announce(0); err != nil {
+		t.Errorf("Got %v announcing a track again", err)
+	}
+
+	// Pending metadata is dropped with the peer.
+	s.UnregisterPeer(pc)
+	s.RegisterPeer("alice", pc)
+	if err := announce(16); err != nil {
+		t.Errorf("Got %v after registering again", err)
+	}
+}
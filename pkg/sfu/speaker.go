@@ -0,0 +1,239 @@
+package sfu
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/svc"
+)
+
+const (
+	// Scores are updated at most once per speakerInterval.
+	speakerInterval = 300 * time.Millisecond
+	// Weight of the last interval in the smoothed score.
+	speakerSmoothing = 0.4
+	// Minimum score of a dominant speaker. Scores are loudness in dB
+	// above -127 dBov, so this is about -60 dBov.
+	speakerThreshold = 67
+	// Score by which another speaker has to be louder than the
+	// dominant speaker to take over.
+	speakerMargin = 6
+)
+
+// NewAPI returns an API for PeerConnections of the SFU, using
+// NewMediaEngine and the default interceptors.
+func NewAPI() *webrtc.API {
+	return webrtc.NewAPI(webrtc.WithMediaEngine(NewMediaEngine()))
+}
+
+// NewMediaEngine returns the default codecs with the RFC 6464 audio
+// level header extension on top, which is needed for active speaker
+// detection, and the dependency descriptor, which tells SVC layers
+// apart.
+func NewMediaEngine() *webrtc.MediaEngine {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		log.Println("Error registering codecs:", err)
+	}
+	err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		log.Println("Error registering audio level extension:", err)
+	}
+	err = m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: svc.DependencyDescriptorURI},
+		webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		log.Println("Error registering dependency descriptor extension:", err)
+	}
+	return m
+}
+
+// AudioLevelExtension returns the negotiated id of the audio level
+// header extension on r, or 0.
+func AudioLevelExtension(r *webrtc.RTPReceiver) uint8 {
+	return headerExtension(r, sdp.AudioLevelURI)
+}
+
+func headerExtension(r *webrtc.RTPReceiver, uri string) uint8 {
+	for _, ext := range r.GetParameters().HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// speakerDetector ranks the owners of audio tracks by their smoothed
+// loudness, per group.
+type speakerDetector struct {
+	tracks    map[string]*speakerTrack // by track id
+	dominant  map[string]string        // owner by group
+	evaluated time.Time
+	mu        sync.Mutex
+}
+
+type speakerTrack struct {
+	group, owner string
+	sum          int
+	count        int
+	score        float64
+}
+
+// speakerChange is a new dominant speaker of a group.
+type speakerChange struct {
+	group, owner string
+}
+
+// observeAudioLevel takes the audio level of packet into account for
+// the active speaker of the group of track.
+func (n *SFU) observeAudioLevel(track *inboundTrack, packet *rtp.Packet) {
+	raw := packet.GetExtension(track.audioLevel)
+	if raw == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(raw); err != nil {
+		return
+	}
+	d := &n.speakers
+	d.mu.Lock()
+	if d.tracks == nil {
+		d.tracks = make(map[string]*speakerTrack)
+		d.dominant = make(map[string]string)
+	}
+	t, exists := d.tracks[track.id]
+	if !exists {
+		t = &speakerTrack{group: track.speakerGroup, owner: track.ownerID}
+		d.tracks[track.id] = t
+	}
+	// The level is -dBov, 127 being silence.
+	t.sum += 127 - int(level.Level)
+	t.count++
+	var changes []speakerChange
+	if time.Since(d.evaluated) >= speakerInterval {
+		changes = d.evaluate()
+		d.evaluated = time.Now()
+	}
+	d.mu.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+	// This runs for every audio packet, the rest is up to the events
+	// goroutine.
+	n.events.push(func() {
+		n.updateAllForwarding()
+		if n.OnActiveSpeaker != nil {
+			for _, c := range changes {
+				n.OnActiveSpeaker(c.group, c.owner)
+			}
+		}
+	})
+}
+
+// evaluate updates the scores and returns the groups whose dominant
+// speaker changed. d.mu must be held.
+func (d *speakerDetector) evaluate() []speakerChange {
+	best := make(map[string]*speakerTrack)
+	scores := make(map[string]float64) // by group and owner
+	for _, t := range d.tracks {
+		level := 0.0
+		if t.count > 0 {
+			level = float64(t.sum) / float64(t.count)
+		}
+		// Tracks without packets are silent, e.g. with DTX.
+		t.score = t.score*(1-speakerSmoothing) + level*speakerSmoothing
+		t.sum, t.count = 0, 0
+		key := t.group + "\x00" + t.owner
+		scores[key] = max(scores[key], t.score)
+		if b, ok := best[t.group]; !ok || t.score > b.score {
+			best[t.group] = t
+		}
+	}
+	var changes []speakerChange
+	for group, b := range best {
+		current := d.dominant[group]
+		if b.owner == current || b.score < speakerThreshold {
+			continue
+		}
+		if current != "" && b.score < scores[group+"\x00"+current]+speakerMargin {
+			continue
+		}
+		d.dominant[group] = b.owner
+		changes = append(changes, speakerChange{group: group, owner: b.owner})
+	}
+	return changes
+}
+
+// speakerGroup returns the group of the peer or owner id.
+func (n *SFU) speakerGroup(id string) string {
+	if n.SpeakerGroup == nil {
+		return ""
+	}
+	return n.SpeakerGroup(id)
+}
+
+// removeSpeakerTrack forgets the audio levels of trackID. If its
+// owner was the dominant speaker, the next one takes over right away.
+func (n *SFU) removeSpeakerTrack(trackID string) {
+	d := &n.speakers
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, exists := d.tracks[trackID]
+	if !exists {
+		return
+	}
+	delete(d.tracks, trackID)
+	if d.dominant[t.group] != t.owner {
+		return
+	}
+	for _, other := range d.tracks {
+		if other.group == t.group && other.owner == t.owner {
+			return
+		}
+	}
+	delete(d.dominant, t.group)
+}
+
+// ActiveSpeakers returns the owners of audio tracks in group, loudest
+// first. Owners which have not been heard are left out.
+func (n *SFU) ActiveSpeakers(group string) []string {
+	d := &n.speakers
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	scores := make(map[string]float64)
+	for _, t := range d.tracks {
+		if t.group == group && t.score > 0 {
+			scores[t.owner] = max(scores[t.owner], t.score)
+		}
+	}
+	owners := make([]string, 0, len(scores))
+	for owner := range scores {
+		owners = append(owners, owner)
+	}
+	slices.SortFunc(owners, func(a, b string) int {
+		switch {
+		case scores[a] > scores[b]:
+			return -1
+		case scores[a] < scores[b]:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	return owners
+}
+
+// DominantSpeaker returns the current dominant speaker of group.
+func (n *SFU) DominantSpeaker(group string) (string, bool) {
+	d := &n.speakers
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	owner, ok := d.dominant[group]
+	return owner, ok
+}
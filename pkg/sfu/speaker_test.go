@@ -0,0 +1,129 @@
+package sfu_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+const audioLevelID = 1
+
+// speak publishes an Opus track of owner and returns a function
+// sending a packet with the given audio level in -dBov.
+func speak(t *testing.T, s *sfu.SFU, owner string) func(level uint8) {
+	t.Helper()
+	packets := make(chan *rtp.Packet, 16)
+	t.Cleanup(func() { close(packets) })
+	_, err := s.PublishTrack(sfu.LocalTrack{
+		ID:                  "audio",
+		StreamID:            owner,
+		Owner:               owner,
+		Codec:               webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		AudioLevelExtension: audioLevelID,
+	}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq uint16
+	return func(level uint8) {
+		ext, _ := rtp.AudioLevelExtension{Level: level, Voice: level < 127}.Marshal()
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq},
+			Payload: []byte{0xf8, 0xff, 0xfe},
+		}
+		seq++
+		if err := packet.SetExtension(audioLevelID, ext); err != nil {
+			t.Fatal(err)
+		}
+		packets <- packet
+	}
+}
+
+func Test_ActiveSpeaker(t *testing.T) {
+	s := sfu.NewSFU()
+	s.SpeakerGroup = func(string) string { return "room" }
+	changes := make(chan string, 16)
+	s.OnActiveSpeaker = func(group, owner string) {
+		if group != "room" {
+			t.Errorf("Unexpected group %q", group)
+		}
+		changes <- owner
+	}
+	alice := speak(t, s, "alice")
+	bob := speak(t, s, "bob")
+
+	talk := func(aliceLevel, bobLevel uint8, expected string) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			alice(aliceLevel)
+			bob(bobLevel)
+			select {
+			case owner := <-changes:
+				if owner != expected {
+					t.Fatalf("Expected %s to be the active speaker, got %s", expected, owner)
+				}
+				return
+			case <-deadline:
+				t.Fatalf("%s did not become the active speaker", expected)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+
+	talk(100, 30, "bob")
+	if speakers := s.ActiveSpeakers("room"); !slices.Equal(speakers, []string{"bob", "alice"}) {
+		t.Errorf("Unexpected speaker order %v", speakers)
+	}
+	talk(25, 127, "alice")
+	if owner, _ := s.DominantSpeaker("room"); owner != "alice" {
+		t.Errorf("Expected alice to be the dominant speaker, got %s", owner)
+	}
+}
+
+func Test_SlowActiveSpeakerCallback(t *testing.T) {
+	s := sfu.NewSFU()
+	called := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	s.OnActiveSpeaker = func(group, owner string) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-release
+	}
+	alice := speak(t, s, "alice")
+	packets, err := s.SubscribeSink("recorder", "alice#audio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for waiting := true; waiting; {
+		alice(30)
+		select {
+		case <-packets:
+		case <-deadline:
+			t.Fatal("Audio was not forwarded")
+		}
+		select {
+		case <-called:
+			waiting = false
+		default:
+		}
+	}
+	// The callback is still blocked, audio must keep flowing.
+	for i := 0; i < 20; i++ {
+		alice(30)
+		select {
+		case <-packets:
+		case <-time.After(time.Second):
+			t.Fatal("Forwarding waited for OnActiveSpeaker")
+		}
+	}
+}
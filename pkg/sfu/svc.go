@@ -0,0 +1,145 @@
+package sfu
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/svc"
+)
+
+const (
+	// Highest spatial and temporal ids of SVC streams, plus one.
+	svcMaxLayers = 8
+	// Frame rates of temporal layers are measured over svcRateWindow.
+	svcRateWindow = time.Second
+)
+
+// svcLayers are the highest spatial and temporal layer ids forwarded.
+type svcLayers struct {
+	spatial, temporal int
+}
+
+var allLayers = svcLayers{svcMaxLayers - 1, svcMaxLayers - 1}
+
+// DependencyDescriptorExtension returns the negotiated id of the
+// dependency descriptor header extension on r, or 0.
+func DependencyDescriptorExtension(r *webrtc.RTPReceiver) uint8 {
+	return headerExtension(r, svc.DependencyDescriptorURI)
+}
+
+// scalable is the state of a video track which carries its layers
+// in one stream (SVC), described by the dependency descriptor or the
+// VP9 payload descriptor.
+type scalable struct {
+	// dependencyDescriptor is the id of the dependency descriptor
+	// header extension, or 0 to read VP9 payload descriptors.
+	dependencyDescriptor uint8
+	dd                   svc.DescriptorParser
+
+	sizes []svc.Size
+	// Highest temporal id seen, frames per temporal id in the
+	// current window and frame rates up to each temporal id.
+	temporal int
+	frames   [svcMaxLayers]int
+	rates    [svcMaxLayers]float64
+	window   time.Time
+	mu       sync.Mutex
+}
+
+// newScalable returns the SVC state of a track, or nil if the layers
+// of its packets cannot be told apart.
+func newScalable(mimeType string, dependencyDescriptor uint8) *scalable {
+	if dependencyDescriptor == 0 && !strings.EqualFold(mimeType, webrtc.MimeTypeVP9) {
+		return nil
+	}
+	return &scalable{dependencyDescriptor: dependencyDescriptor, window: time.Now()}
+}
+
+// observe returns the frame packet belongs to and measures the sizes
+// and frame rates of the layers.
+func (s *scalable) observe(packet *rtp.Packet) (svc.Frame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var f svc.Frame
+	var err error
+	if s.dependencyDescriptor != 0 {
+		ext := packet.GetExtension(s.dependencyDescriptor)
+		if ext == nil {
+			return f, false
+		}
+		f, err = s.dd.Parse(ext)
+	} else {
+		f, err = svc.ParseVP9(packet.Payload)
+	}
+	if err != nil || f.Spatial >= svcMaxLayers || f.Temporal >= svcMaxLayers {
+		return f, false
+	}
+	if len(f.Sizes) > 0 {
+		s.sizes = f.Sizes
+	}
+	if f.Start && f.Spatial == 0 {
+		s.frames[f.Temporal]++
+		s.temporal = max(s.temporal, f.Temporal)
+	}
+	if elapsed := time.Since(s.window); elapsed >= svcRateWindow {
+		frames := 0
+		for t := range s.frames {
+			frames += s.frames[t]
+			s.rates[t] = float64(frames) / elapsed.Seconds()
+			s.frames[t] = 0
+		}
+		s.window = time.Now()
+	}
+	return f, true
+}
+
+// selectLayers returns the lowest layers covering v: the smallest
+// spatial layer covering the viewport, or the largest one if none
+// does, and the lowest temporal layer reaching its frame rate. Layers
+// are not limited while their sizes or rates are unknown.
+func (s *scalable) selectLayers(v Viewport) svcLayers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	layers := allLayers
+	if len(s.sizes) > 0 {
+		layers.spatial = len(s.sizes) - 1
+		for i, size := range s.sizes {
+			if size.Width >= v.Width && size.Height >= v.Height {
+				layers.spatial = i
+				break
+			}
+		}
+	}
+	if v.FrameRate > 0 && s.rates[s.temporal] > 0 {
+		layers.temporal = s.temporal
+		for t := 0; t < s.temporal; t++ {
+			if s.rates[t] >= float64(v.FrameRate) {
+				layers.temporal = t
+				break
+			}
+		}
+	}
+	return layers
+}
+
+// takeFrame reports whether a packet of frame f of a scalable track is
+// forwarded to sub. Other layers are only selected at the start of a
+// picture, and higher spatial layers at keyframes. sub.mu must be
+// held.
+func (sub *subscription) takeFrame(f svc.Frame) bool {
+	if f.Start && f.Spatial == 0 {
+		target := sub.svcTarget
+		if target.spatial < sub.svc.spatial || f.Keyframe {
+			sub.svc.spatial = target.spatial
+		}
+		// Frames of a temporal layer only reference lower or equal
+		// layers, so going up is safe from the base layer on.
+		if target.temporal < sub.svc.temporal || f.Temporal == 0 {
+			sub.svc.temporal = target.temporal
+		}
+	}
+	return f.Spatial <= sub.svc.spatial && f.Temporal <= sub.svc.temporal
+}
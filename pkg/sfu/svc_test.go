@@ -0,0 +1,197 @@
+package sfu_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/svc"
+)
+
+// vp9Packet returns the single packet of layer sid of a VP9 L3T3
+// picture in non-flexible mode. Keyframes carry the scalability
+// structure.
+func vp9Packet(picture, sid, tid int, keyframe bool) *rtp.Packet {
+	b0 := byte(0x80 | 0x20 | 0x08 | 0x04) // I L B E
+	if !keyframe {
+		b0 |= 0x40 // P
+	}
+	ss := keyframe && sid == 0
+	if ss {
+		b0 |= 0x02 // V
+	}
+	payload := []byte{b0, 0x80 | byte(picture>>8), byte(picture), byte(tid<<5 | sid<<1), 0}
+	if ss {
+		payload = append(payload, 2<<5|0x10, // N_S = 2, Y
+			0x01, 0x40, 0x00, 0xb4, // 320x180
+			0x02, 0x80, 0x01, 0x68, // 640x360
+			0x05, 0x00, 0x02, 0xd0) // 1280x720
+	}
+	payload = append(payload, 0x83, 0x49, 0x83, 0x42, 0x00)
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: uint16(picture*3 + sid),
+			Timestamp:      uint32(picture * 3000),
+			Marker:         sid == 2,
+		},
+		Payload: payload,
+	}
+}
+
+// connect registers a PeerConnection of the SFU with id, created with
+// local, and returns it and the PeerConnection of the remote peer.
+func connect(t *testing.T, s *sfu.SFU, id string, local, remote *webrtc.API) (*webrtc.PeerConnection, *webrtc.PeerConnection) {
+	t.Helper()
+	localPC, err := local.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotePC, err := remote.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		localPC.Close()
+		remotePC.Close()
+	})
+	s.RegisterPeer(id, localPC)
+	return localPC, remotePC
+}
+
+// negotiate has offerer send an offer to answerer.
+func negotiate(t *testing.T, offerer, answerer *webrtc.PeerConnection) {
+	t.Helper()
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SVCLayers(t *testing.T) {
+	s := sfu.NewSFU()
+	packets := make(chan *rtp.Packet, 16)
+	defer close(packets)
+	trackID, err := s.PublishTrack(sfu.LocalTrack{
+		ID:       "video",
+		StreamID: "alice",
+		Owner:    "alice",
+		Codec: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0",
+		},
+	}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := connect(t, s, "viewer", s.API, sfu.NewAPI())
+	type received struct {
+		spatial int
+		marker  bool
+	}
+	frames := make(chan received, 64)
+	remote.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			p, _, err := tr.ReadRTP()
+			if err != nil {
+				return
+			}
+			f, err := svc.ParseVP9(p.Payload)
+			if err != nil {
+				t.Error("Failed to parse forwarded packet:", err)
+				return
+			}
+			frames <- received{f.Spatial, p.Marker}
+		}
+	})
+	if err := s.Subscribe(local, trackID); err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, local, remote)
+
+	picture := 0
+	send := func(keyframe bool) {
+		for sid := 0; sid < 3; sid++ {
+			packets <- vp9Packet(picture, sid, 0, keyframe)
+		}
+		picture++
+	}
+	// expect sends pictures until the viewer receives want.
+	expect := func(want []received) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		var got []received
+		for {
+			select {
+			case r := <-frames:
+				if r.spatial == 0 {
+					got = got[:0]
+				}
+				got = append(got, r)
+				if len(got) == len(want) && r.marker {
+					if !slices.Equal(got, want) {
+						t.Fatalf("Got layers %v, want %v", got, want)
+					}
+					return
+				}
+			case <-time.After(50 * time.Millisecond):
+				send(false)
+			case <-deadline:
+				t.Fatalf("Got layers %v, want %v", got, want)
+			}
+		}
+	}
+
+	all := []received{{0, false}, {1, false}, {2, true}}
+	send(true)
+	expect(all)
+
+	// Only the base layer covers 320x180; it now ends the picture.
+	err = s.SetViewport(local, trackID, sfu.Viewport{Width: 320, Height: 180, Visible: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect([]received{{0, true}})
+
+	// Going up waits for a keyframe.
+	err = s.SetViewport(local, trackID, sfu.Viewport{Width: 1280, Height: 720, Visible: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		send(false)
+		select {
+		case r := <-frames:
+			if r != (received{0, true}) {
+				t.Fatalf("Got layer %v before a keyframe", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No packet received")
+		}
+	}
+	send(true)
+	expect(all)
+}
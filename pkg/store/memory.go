@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a Store which keeps everything in memory, so state is lost
+// on restart.
+type Memory struct {
+	users       map[string]User
+	sessions    map[string]Session
+	rooms       map[string]Room
+	memberships map[string]map[string]Membership // room -> user
+	chat        map[string][]ChatMessage         // by room
+	nextChatID  int64
+	mu          sync.RWMutex
+}
+
+var _ Store = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:       make(map[string]User),
+		sessions:    make(map[string]Session),
+		rooms:       make(map[string]Room),
+		memberships: make(map[string]map[string]Membership),
+		chat:        make(map[string][]ChatMessage),
+	}
+}
+
+func (m *Memory) PutUser(_ context.Context, u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.users[u.Name]; ok {
+		u.CreatedAt = existing.CreatedAt
+	}
+	m.users[u.Name] = u
+	return nil
+}
+
+func (m *Memory) User(_ context.Context, name string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[name]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *Memory) CreateSession(_ context.Context, s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *Memory) EndSession(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	s.EndedAt = at
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *Memory) Sessions(_ context.Context, user string) ([]Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sessions := []Session{}
+	for _, s := range m.sessions {
+		if s.User == user {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions, nil
+}
+
+func (m *Memory) PutRoom(_ context.Context, r Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.rooms[r.Name]; ok {
+		r.CreatedAt = existing.CreatedAt
+	}
+	r.MemberPermissions = slices.Clone(r.MemberPermissions)
+	m.rooms[r.Name] = r
+	return nil
+}
+
+func (m *Memory) Room(_ context.Context, name string) (Room, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.rooms[name]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *Memory) Rooms(_ context.Context) ([]Room, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rooms := make([]Room, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms, nil
+}
+
+func (m *Memory) PutMembership(_ context.Context, ms Membership) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members, ok := m.memberships[ms.Room]
+	if !ok {
+		members = make(map[string]Membership)
+		m.memberships[ms.Room] = members
+	}
+	ms.Permissions = slices.Clone(ms.Permissions)
+	members[ms.User] = ms
+	return nil
+}
+
+func (m *Memory) Memberships(_ context.Context, room string) ([]Membership, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	memberships := make([]Membership, 0, len(m.memberships[room]))
+	for _, ms := range m.memberships[room] {
+		memberships = append(memberships, ms)
+	}
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].User < memberships[j].User })
+	return memberships, nil
+}
+
+func (m *Memory) AddChatMessage(_ context.Context, msg ChatMessage) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextChatID++
+	msg.ID = m.nextChatID
+	m.chat[msg.Room] = append(m.chat[msg.Room], msg)
+	return msg.ID, nil
+}
+
+func (m *Memory) ChatHistory(_ context.Context, room string, limit int) ([]ChatMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history := m.chat[room]
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return append([]ChatMessage{}, history...), nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
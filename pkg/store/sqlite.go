@@ -0,0 +1,313 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations upgrade the schema by one version each. The version of a
+// database is kept in its user_version. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE users (
+		name       TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL,
+		last_seen  INTEGER NOT NULL
+	);
+	CREATE TABLE sessions (
+		id         TEXT PRIMARY KEY,
+		user       TEXT NOT NULL,
+		room       TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		ended_at   INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX sessions_user ON sessions (user, started_at);
+	CREATE TABLE rooms (
+		name               TEXT PRIMARY KEY,
+		member_permissions BLOB,
+		max_screen_shares  INTEGER NOT NULL,
+		created_at         INTEGER NOT NULL
+	);
+	CREATE TABLE memberships (
+		room        TEXT NOT NULL,
+		user        TEXT NOT NULL,
+		role        TEXT NOT NULL,
+		permissions BLOB,
+		banned      INTEGER NOT NULL DEFAULT 0,
+		ban_reason  TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (room, user)
+	);
+	CREATE TABLE chat_messages (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		room    TEXT NOT NULL,
+		sender  TEXT NOT NULL,
+		text    TEXT NOT NULL,
+		sent_at INTEGER NOT NULL
+	);
+	CREATE INDEX chat_messages_room ON chat_messages (room, id);`,
+	`ALTER TABLE rooms ADD COLUMN audio_only INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// SQLite is a Store in an embedded SQLite database.
+type SQLite struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLite)(nil)
+
+// OpenSQLite opens or creates the database at path and migrates it to
+// the current schema.
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; queue writers here instead
+	// of failing with SQLITE_BUSY. It also keeps :memory: databases
+	// on a single connection.
+	db.SetMaxOpenConns(1)
+	s := &SQLite{db: db}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Version returns the schema version of the database.
+func (s *SQLite) Version(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func (s *SQLite) migrate(ctx context.Context) error {
+	version, err := s.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d",
+			version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, migrations[version])
+		if err == nil {
+			// PRAGMA does not take parameters.
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Times are stored as Unix nanoseconds, the zero time as 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (s *SQLite) PutUser(ctx context.Context, u User) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (name, created_at, last_seen) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_seen = excluded.last_seen`,
+		u.Name, unixNano(u.CreatedAt), unixNano(u.LastSeen))
+	return err
+}
+
+func (s *SQLite) User(ctx context.Context, name string) (User, error) {
+	var createdAt, lastSeen int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT created_at, last_seen FROM users WHERE name = ?`, name,
+	).Scan(&createdAt, &lastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		Name:      name,
+		CreatedAt: fromUnixNano(createdAt),
+		LastSeen:  fromUnixNano(lastSeen),
+	}, nil
+}
+
+func (s *SQLite) CreateSession(ctx context.Context, ses Session) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO sessions (id, user, room, started_at, ended_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		ses.ID, ses.User, ses.Room, unixNano(ses.StartedAt), unixNano(ses.EndedAt))
+	return err
+}
+
+func (s *SQLite) EndSession(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE sessions SET ended_at = ? WHERE id = ?`, unixNano(at), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) Sessions(ctx context.Context, user string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, room, started_at, ended_at FROM sessions
+		WHERE user = ? ORDER BY started_at`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		ses := Session{User: user}
+		var startedAt, endedAt int64
+		if err := rows.Scan(&ses.ID, &ses.Room, &startedAt, &endedAt); err != nil {
+			return nil, err
+		}
+		ses.StartedAt, ses.EndedAt = fromUnixNano(startedAt), fromUnixNano(endedAt)
+		sessions = append(sessions, ses)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLite) PutRoom(ctx context.Context, r Room) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO rooms (name, member_permissions, max_screen_shares, audio_only, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			member_permissions = excluded.member_permissions,
+			max_screen_shares = excluded.max_screen_shares,
+			audio_only = excluded.audio_only`,
+		r.Name, []byte(r.MemberPermissions), r.MaxScreenShares, r.AudioOnly, unixNano(r.CreatedAt))
+	return err
+}
+
+func (s *SQLite) Room(ctx context.Context, name string) (Room, error) {
+	rows, err := s.queryRooms(ctx, `WHERE name = ?`, name)
+	if err != nil {
+		return Room{}, err
+	}
+	if len(rows) == 0 {
+		return Room{}, ErrNotFound
+	}
+	return rows[0], nil
+}
+
+func (s *SQLite) Rooms(ctx context.Context) ([]Room, error) {
+	return s.queryRooms(ctx, `ORDER BY name`)
+}
+
+func (s *SQLite) queryRooms(ctx context.Context, clause string, args ...any) ([]Room, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT name, member_permissions, max_screen_shares, audio_only, created_at FROM rooms `+clause,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := []Room{}
+	for rows.Next() {
+		var (
+			r         Room
+			createdAt int64
+		)
+		err := rows.Scan(&r.Name, (*[]byte)(&r.MemberPermissions), &r.MaxScreenShares, &r.AudioOnly,
+			&createdAt)
+		if err != nil {
+			return nil, err
+		}
+		r.CreatedAt = fromUnixNano(createdAt)
+		rooms = append(rooms, r)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *SQLite) PutMembership(ctx context.Context, m Membership) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO memberships (room, user, role, permissions, banned, ban_reason)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		m.Room, m.User, m.Role, []byte(m.Permissions), m.Banned, m.BanReason)
+	return err
+}
+
+func (s *SQLite) Memberships(ctx context.Context, room string) ([]Membership, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT user, role, permissions, banned, ban_reason FROM memberships
+		WHERE room = ? ORDER BY user`, room)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memberships := []Membership{}
+	for rows.Next() {
+		m := Membership{Room: room}
+		if err := rows.Scan(&m.User, &m.Role, (*[]byte)(&m.Permissions), &m.Banned, &m.BanReason); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+func (s *SQLite) AddChatMessage(ctx context.Context, m ChatMessage) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO chat_messages (room, sender, text, sent_at) VALUES (?, ?, ?, ?)`,
+		m.Room, m.From, m.Text, unixNano(m.SentAt))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLite) ChatHistory(ctx context.Context, room string, limit int) ([]ChatMessage, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, sender, text, sent_at FROM (
+			SELECT * FROM chat_messages WHERE room = ? ORDER BY id DESC LIMIT ?
+		) ORDER BY id`, room, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []ChatMessage{}
+	for rows.Next() {
+		m := ChatMessage{Room: room}
+		var sentAt int64
+		if err := rows.Scan(&m.ID, &m.From, &m.Text, &sentAt); err != nil {
+			return nil, err
+		}
+		m.SentAt = fromUnixNano(sentAt)
+		history = append(history, m)
+	}
+	return history, rows.Err()
+}
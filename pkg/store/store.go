@@ -0,0 +1,85 @@
+// Package store persists the state of Raven which outlives a
+// connection: users, their sessions, rooms with their memberships,
+// and chat history.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type User struct {
+	Name      string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// Session is a connection of a user to a room. EndedAt is zero while
+// the session is active.
+type Session struct {
+	ID        string
+	User      string
+	Room      string
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// Room holds the settings of a room. MemberPermissions is encoded by
+// the caller; nil keeps the defaults.
+type Room struct {
+	Name              string
+	MemberPermissions json.RawMessage
+	MaxScreenShares   int
+	AudioOnly         bool
+	CreatedAt         time.Time
+}
+
+// Membership is what a room knows about a user. Permissions is
+// encoded by the caller; nil means the permissions of the role apply.
+type Membership struct {
+	Room        string
+	User        string
+	Role        string
+	Permissions json.RawMessage
+	Banned      bool
+	BanReason   string
+}
+
+type ChatMessage struct {
+	ID     int64
+	Room   string
+	From   string
+	Text   string
+	SentAt time.Time
+}
+
+// Store is implemented by the backends. Put methods insert or replace.
+type Store interface {
+	// PutUser keeps CreatedAt of an existing user.
+	PutUser(ctx context.Context, u User) error
+	User(ctx context.Context, name string) (User, error)
+
+	CreateSession(ctx context.Context, s Session) error
+	EndSession(ctx context.Context, id string, at time.Time) error
+	// Sessions returns the sessions of user, oldest first.
+	Sessions(ctx context.Context, user string) ([]Session, error)
+
+	// PutRoom keeps CreatedAt of an existing room.
+	PutRoom(ctx context.Context, r Room) error
+	Room(ctx context.Context, name string) (Room, error)
+	Rooms(ctx context.Context) ([]Room, error)
+	PutMembership(ctx context.Context, m Membership) error
+	Memberships(ctx context.Context, room string) ([]Membership, error)
+
+	// AddChatMessage stores m and returns its ID.
+	AddChatMessage(ctx context.Context, m ChatMessage) (int64, error)
+	// ChatHistory returns the last limit messages of room, oldest
+	// first.
+	ChatHistory(ctx context.Context, room string, limit int) ([]ChatMessage, error)
+
+	Close() error
+}
@@ -0,0 +1,141 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/store"
+)
+
+func Test_Stores(t *testing.T) {
+	stores := map[string]func(t *testing.T) store.Store{
+		"memory": func(t *testing.T) store.Store { return store.NewMemory() },
+		"sqlite": func(t *testing.T) store.Store {
+			s, err := store.OpenSQLite(filepath.Join(t.TempDir(), "raven.db"))
+			if err != nil {
+				t.Fatal("Failed to open database:", err)
+			}
+			return s
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			testStore(t, s)
+		})
+	}
+}
+
+func testStore(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	start := time.Unix(1700000000, 0)
+
+	if _, err := s.User(ctx, "alice"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing user, got %v", err)
+	}
+	s.PutUser(ctx, store.User{Name: "alice", CreatedAt: start, LastSeen: start})
+	s.PutUser(ctx, store.User{Name: "alice", CreatedAt: start.Add(time.Hour), LastSeen: start.Add(time.Hour)})
+	u, err := s.User(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.CreatedAt.Equal(start) || !u.LastSeen.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected CreatedAt to be kept and LastSeen updated, got %+v", u)
+	}
+
+	s.CreateSession(ctx, store.Session{ID: "2", User: "alice", Room: "lobby", StartedAt: start.Add(time.Minute)})
+	s.CreateSession(ctx, store.Session{ID: "1", User: "alice", Room: "lobby", StartedAt: start})
+	if err := s.EndSession(ctx, "1", start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EndSession(ctx, "missing", start); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound ending a missing session, got %v", err)
+	}
+	sessions, err := s.Sessions(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "1" || !sessions[0].EndedAt.Equal(start.Add(time.Second)) ||
+		!sessions[1].EndedAt.IsZero() {
+		t.Errorf("Unexpected sessions %+v", sessions)
+	}
+
+	perms := json.RawMessage(`{"can_chat":true}`)
+	s.PutRoom(ctx, store.Room{Name: "lobby", MaxScreenShares: 1, CreatedAt: start})
+	s.PutRoom(ctx, store.Room{Name: "lobby", MemberPermissions: perms, MaxScreenShares: 2, AudioOnly: true})
+	r, err := s.Room(ctx, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.MemberPermissions) != string(perms) || r.MaxScreenShares != 2 || !r.AudioOnly ||
+		!r.CreatedAt.Equal(start) {
+		t.Errorf("Unexpected room %+v", r)
+	}
+	if rooms, _ := s.Rooms(ctx); len(rooms) != 1 {
+		t.Errorf("Expected one room, got %+v", rooms)
+	}
+
+	s.PutMembership(ctx, store.Membership{Room: "lobby", User: "bob", Role: "member"})
+	s.PutMembership(ctx, store.Membership{Room: "lobby", User: "alice", Role: "owner", Permissions: perms})
+	s.PutMembership(ctx, store.Membership{Room: "lobby", User: "bob", Role: "member", Banned: true, BanReason: "spam"})
+	memberships, err := s.Memberships(ctx, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships) != 2 || memberships[0].User != "alice" ||
+		string(memberships[0].Permissions) != string(perms) ||
+		!memberships[1].Banned || memberships[1].BanReason != "spam" || memberships[1].Permissions != nil {
+		t.Errorf("Unexpected memberships %+v", memberships)
+	}
+
+	for i, text := range []string{"one", "two", "three"} {
+		_, err := s.AddChatMessage(ctx, store.ChatMessage{
+			Room: "lobby", From: "alice", Text: text, SentAt: start.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.AddChatMessage(ctx, store.ChatMessage{Room: "other", From: "bob", Text: "elsewhere"})
+	history, err := s.ChatHistory(ctx, "lobby", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Text != "two" || history[1].Text != "three" ||
+		history[0].ID >= history[1].ID || !history[1].SentAt.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Unexpected chat history %+v", history)
+	}
+}
+
+func Test_SQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "raven.db")
+	s, err := store.OpenSQLite(path)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	version, err := s.Version(ctx)
+	if err != nil || version == 0 {
+		t.Fatalf("Expected a migrated database, got version %d: %v", version, err)
+	}
+	s.PutUser(ctx, store.User{Name: "alice"})
+	s.Close()
+
+	// Reopening keeps the data and does not migrate again.
+	s, err = store.OpenSQLite(path)
+	if err != nil {
+		t.Fatal("Failed to reopen database:", err)
+	}
+	defer s.Close()
+	if again, _ := s.Version(ctx); again != version {
+		t.Errorf("Expected version %d after reopening, got %d", version, again)
+	}
+	if _, err := s.User(ctx, "alice"); err != nil {
+		t.Error("User did not survive reopening:", err)
+	}
+}
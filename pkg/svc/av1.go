@@ -0,0 +1,129 @@
+package svc
+
+// obuSequenceHeader is the type of the OBU (AV1 bitstream
+// specification, section 6.2.2) which starts coded video sequences.
+const obuSequenceHeader = 1
+
+// ParseAV1 reads the aggregation header at the start of an AV1
+// payload (AV1 RTP specification, section 4.4) and the header of its
+// first OBU. Keyframe is set on the first packet of a coded video
+// sequence, and on packets starting with a sequence header, whose
+// maximum frame size is then the size. Spatial and Temporal are only
+// known from the OBU extension header; streams without one are
+// described by the dependency descriptor instead.
+func ParseAV1(payload []byte) (Frame, error) {
+	if len(payload) < 2 {
+		return Frame{}, ErrShortDescriptor
+	}
+	aggregation := payload[0]
+	f := Frame{
+		Start:    aggregation&0x80 == 0, // Z
+		End:      aggregation&0x40 == 0, // Y
+		Keyframe: aggregation&0x08 != 0, // N
+	}
+	if !f.Start {
+		// The first OBU continues the one of the previous packet.
+		return f, nil
+	}
+	obu := payload[1:]
+	if aggregation&0x30 != 0x10 {
+		// Unless W is 1, the length of the first OBU precedes it.
+		size, n := leb128(obu)
+		if n == 0 || size > len(obu)-n {
+			return Frame{}, ErrShortDescriptor
+		}
+		obu = obu[n : n+size]
+	}
+	if len(obu) == 0 {
+		return Frame{}, ErrShortDescriptor
+	}
+	header, body := obu[0], obu[1:]
+	if header&0x04 != 0 {
+		// obu_extension_header()
+		if len(body) == 0 {
+			return Frame{}, ErrShortDescriptor
+		}
+		f.Temporal = int(body[0] >> 5)
+		f.Spatial = int(body[0] >> 3 & 0x03)
+		body = body[1:]
+	}
+	if header&0x02 != 0 {
+		// obu_size, which RTP packetizers should have dropped.
+		size, n := leb128(body)
+		if n == 0 {
+			return Frame{}, ErrShortDescriptor
+		}
+		body = body[n:]
+		body = body[:min(size, len(body))]
+	}
+	if header>>3&0x0f == obuSequenceHeader {
+		f.Keyframe = true
+		if size, ok := readSequenceHeader(body); ok {
+			f.Sizes = []Size{size}
+		}
+	}
+	return f, nil
+}
+
+// readSequenceHeader reads sequence_header_obu() up to the maximum
+// frame size.
+func readSequenceHeader(data []byte) (Size, bool) {
+	r := bitReader{data: data}
+	r.bits(3) // seq_profile
+	r.bit()   // still_picture
+	if r.bit() {
+		// reduced_still_picture_header
+		r.bits(5) // seq_level_idx[0]
+	} else {
+		decoderModelInfo := false
+		bufferDelayLength := 0
+		if r.bit() {
+			// timing_info()
+			r.bits(32) // num_units_in_display_tick
+			r.bits(32) // time_scale
+			if r.bit() {
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			if decoderModelInfo = r.bit(); decoderModelInfo {
+				// decoder_model_info()
+				bufferDelayLength = r.bits(5) + 1
+				r.bits(32) // num_units_in_decoding_tick
+				r.bits(5)  // buffer_removal_time_length_minus_1
+				r.bits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.bit()
+		for i := r.bits(5); i >= 0 && r.err == nil; i-- {
+			r.bits(12) // operating_point_idc
+			if r.bits(5) > 7 {
+				r.bit() // seq_tier
+			}
+			if decoderModelInfo && r.bit() {
+				// operating_parameters_info()
+				r.bits(bufferDelayLength) // decoder_buffer_delay
+				r.bits(bufferDelayLength) // encoder_buffer_delay
+				r.bit()                   // low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.bit() {
+				r.bits(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+	widthBits := r.bits(4) + 1
+	heightBits := r.bits(4) + 1
+	size := Size{Width: r.bits(widthBits) + 1, Height: r.bits(heightBits) + 1}
+	return size, r.err == nil
+}
+
+// leb128 reads an unsigned LEB128 value, and returns it and the number
+// of bytes read, or 0 if b is too short.
+func leb128(b []byte) (int, int) {
+	v := 0
+	for i := 0; i < len(b) && i < 8; i++ {
+		v |= int(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,199 @@
+package svc
+
+// DependencyDescriptorURI is the header extension carrying the AV1
+// dependency descriptor. Despite its name it is used with other
+// codecs too, e.g. VP8 and VP9 in some browsers.
+const DependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+
+// DescriptorParser reads the dependency descriptors of a stream
+// (AV1 RTP specification, appendix A). Most descriptors only refer
+// to a frame template by id; the templates are sent along with
+// keyframes, so the parser keeps the last structure it saw.
+type DescriptorParser struct {
+	structure *structure
+}
+
+// structure is a template dependency structure.
+type structure struct {
+	idOffset  int
+	dtCnt     int
+	templates []template
+	sizes     []Size
+}
+
+type template struct {
+	spatial, temporal int
+	// fdiffs is the number of frames the template depends on.
+	fdiffs int
+}
+
+// Parse reads the dependency descriptor ext, the payload of the
+// header extension.
+func (p *DescriptorParser) Parse(ext []byte) (Frame, error) {
+	if len(ext) < 3 {
+		return Frame{}, ErrShortDescriptor
+	}
+	r := bitReader{data: ext}
+	var f Frame
+	f.Start = r.bit()
+	f.End = r.bit()
+	templateID := r.bits(6)
+	r.bits(16) // frame_number
+
+	var structurePresent, activeTargets, customDTIs, customFdiffs bool
+	if len(ext) > 3 {
+		structurePresent = r.bit()
+		activeTargets = r.bit()
+		customDTIs = r.bit()
+		customFdiffs = r.bit()
+		r.bit() // custom_chains_flag; the chains come last
+	}
+	s := p.structure
+	if structurePresent {
+		var err error
+		if s, err = readStructure(&r); err != nil {
+			return Frame{}, err
+		}
+		f.Sizes = s.sizes
+	}
+	if s == nil {
+		return Frame{}, ErrNoStructure
+	}
+	if activeTargets {
+		r.bits(s.dtCnt)
+	}
+
+	index := (templateID + 64 - s.idOffset) % 64
+	if index >= len(s.templates) {
+		return Frame{}, ErrUnknownTemplate
+	}
+	t := s.templates[index]
+	f.Spatial, f.Temporal = t.spatial, t.temporal
+	fdiffs := t.fdiffs
+	if customDTIs {
+		r.bits(2 * s.dtCnt)
+	}
+	if customFdiffs {
+		fdiffs = 0
+		for size := r.bits(2); size != 0; size = r.bits(2) {
+			r.bits(4 * size)
+			fdiffs++
+		}
+	}
+	if r.err != nil {
+		return Frame{}, r.err
+	}
+	f.Keyframe = fdiffs == 0
+	// Only keep a structure which was read completely.
+	p.structure = s
+	return f, nil
+}
+
+// readStructure reads template_dependency_structure().
+func readStructure(r *bitReader) (*structure, error) {
+	s := &structure{
+		idOffset: r.bits(6),
+		dtCnt:    r.bits(5) + 1,
+	}
+
+	// template_layers()
+	spatial, temporal := 0, 0
+	for {
+		s.templates = append(s.templates, template{spatial: spatial, temporal: temporal})
+		next := r.bits(2)
+		if next == 3 || r.err != nil {
+			break
+		}
+		switch next {
+		case 1:
+			temporal++
+		case 2:
+			temporal = 0
+			spatial++
+		}
+		if len(s.templates) > 64 {
+			return nil, ErrUnknownTemplate
+		}
+	}
+	maxSpatial := spatial
+
+	// template_dtis()
+	r.bits(2 * s.dtCnt * len(s.templates))
+
+	// template_fdiffs()
+	for i := range s.templates {
+		for r.bit() {
+			r.bits(4)
+			s.templates[i].fdiffs++
+		}
+	}
+
+	// template_chains()
+	chains := r.ns(s.dtCnt + 1)
+	if chains > 0 {
+		for i := 0; i < s.dtCnt; i++ {
+			r.ns(chains)
+		}
+		r.bits(4 * chains * len(s.templates))
+	}
+
+	// decode_target_layers() is derived, then render_resolutions().
+	if r.bit() {
+		for i := 0; i <= maxSpatial; i++ {
+			width := r.bits(16) + 1
+			height := r.bits(16) + 1
+			s.sizes = append(s.sizes, Size{width, height})
+		}
+	}
+	return s, r.err
+}
+
+// bitReader reads big-endian bit fields. Reading past the end sets
+// err and returns zeros.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func (r *bitReader) bits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if r.pos >= 8*len(r.data) {
+			r.err = ErrShortDescriptor
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) bit() bool {
+	return r.bits(1) == 1
+}
+
+// uvlc reads a variable length unsigned value (AV1 bitstream
+// specification, section 4.10.3).
+func (r *bitReader) uvlc() int {
+	zeros := 0
+	for !r.bit() && r.err == nil && zeros < 32 {
+		zeros++
+	}
+	return r.bits(zeros) + 1<<zeros - 1
+}
+
+// ns reads a non-symmetric unsigned value below n.
+func (r *bitReader) ns(n int) int {
+	w := 0
+	for x := n; x != 0; x >>= 1 {
+		w++
+	}
+	m := 1<<w - n
+	v := r.bits(w - 1)
+	if v < m {
+		return v
+	}
+	return v<<1 - m + r.bits(1)
+}
@@ -0,0 +1,61 @@
+// Package svc tells the layers of scalable video coding (SVC) streams
+// apart, for an SFU to forward a subset of them. It reads the VP9
+// payload descriptor and the AV1 dependency descriptor header
+// extension, which carry the spatial and temporal layer of the frame
+// a packet belongs to, and the AV1 aggregation header.
+package svc
+
+import (
+	"errors"
+
+	"github.com/pion/rtp/codecs"
+)
+
+var (
+	ErrShortDescriptor = errors.New("svc: descriptor too short")
+	// ErrNoStructure is returned for dependency descriptors referring
+	// to a template before any template structure was received.
+	ErrNoStructure     = errors.New("svc: no template structure")
+	ErrUnknownTemplate = errors.New("svc: unknown frame template")
+)
+
+// Size is the resolution of a spatial layer.
+type Size struct {
+	Width, Height int
+}
+
+// Frame describes the frame an RTP packet belongs to.
+type Frame struct {
+	Spatial, Temporal int
+	// Start and End are set on the first and last packet of the frame.
+	Start, End bool
+	// Keyframe is set if the frame does not reference earlier
+	// pictures. Upper spatial layers of a keyframe may still depend
+	// on the lower ones.
+	Keyframe bool
+	// Sizes of the spatial layers, lowest first, if the packet
+	// carries them. Encoders send them along with keyframes.
+	Sizes []Size
+}
+
+// ParseVP9 reads the VP9 payload descriptor at the start of payload
+// (RFC 9628).
+func ParseVP9(payload []byte) (Frame, error) {
+	var vp9 codecs.VP9Packet
+	if _, err := vp9.Unmarshal(payload); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{
+		Spatial:  int(vp9.SID),
+		Temporal: int(vp9.TID),
+		Start:    vp9.B,
+		End:      vp9.E,
+		Keyframe: !vp9.P,
+	}
+	if vp9.V && vp9.Y {
+		for i := range vp9.Width {
+			f.Sizes = append(f.Sizes, Size{int(vp9.Width[i]), int(vp9.Height[i])})
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,378 @@
+package svc_test
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/ravenbox/raven-prototype/pkg/svc"
+)
+
+// readPackets reads a fixture of RTP packets, one hex encoded packet
+// per line.
+func readPackets(t *testing.T, name string) []*rtp.Packet {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal("Failed to open fixture:", err)
+	}
+	defer f.Close()
+	var packets []*rtp.Packet
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil {
+			t.Fatal("Failed to decode fixture:", err)
+		}
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(raw); err != nil {
+			t.Fatal("Failed to parse fixture packet:", err)
+		}
+		packets = append(packets, p)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal("Failed to read fixture:", err)
+	}
+	return packets
+}
+
+// The generators below build streams the way encoders lay them out,
+// field by field, on top of the fixtures in testdata.
+
+// bitWriter writes big-endian bit fields.
+type bitWriter struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (w *bitWriter) put(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>i&1 == 1 {
+			w.data[len(w.data)-1] |= 1 << (7 - w.pos%8)
+		}
+		w.pos++
+	}
+}
+
+// vp9L3T3 returns the packets of a VP9 L3T3 stream in non-flexible
+// mode, one packet per layer frame. Pictures have temporal ids 0 2 1 2
+// 0; the first one is a keyframe with the scalability structure
+// 320x180, 640x360, 1280x720.
+func vp9L3T3() []*rtp.Packet {
+	var packets []*rtp.Packet
+	for picture, tid := range []int{0, 2, 1, 2, 0} {
+		for sid := 0; sid < 3; sid++ {
+			b0 := byte(0x80 | 0x20 | 0x08 | 0x04) // I L B E
+			if picture != 0 {
+				b0 |= 0x40 // P
+			}
+			ss := picture == 0 && sid == 0
+			if ss {
+				b0 |= 0x02 // V
+			}
+			if sid == 2 {
+				b0 |= 0x01 // Z
+			}
+			// TID U SID D, then TL0PICIDX.
+			layer := byte(tid<<5 | sid<<1)
+			if tid > 0 {
+				layer |= 0x10
+			}
+			if sid > 0 {
+				layer |= 0x01
+			}
+			payload := []byte{b0, 0x80 | byte(picture>>8), byte(picture), layer, byte(picture / 4)}
+			if ss {
+				payload = append(payload, 2<<5|0x10|0x08, // N_S = 2, Y, G
+					0x01, 0x40, 0x00, 0xb4, // 320x180
+					0x02, 0x80, 0x01, 0x68, // 640x360
+					0x05, 0x00, 0x02, 0xd0, // 1280x720
+					4,       // N_G
+					1<<2, 4, // TID 0, R 1
+					2<<5|0x10|1<<2, 1,
+					1<<5|0x10|1<<2, 2,
+					2<<5|0x10|1<<2, 1)
+			}
+			payload = append(payload, 0x83, 0x49, 0x83, 0x42, 0x00)
+			packets = append(packets, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    98,
+					SequenceNumber: uint16(4000 + len(packets)),
+					Timestamp:      uint32(90000 + picture*3000),
+					SSRC:           0x1a2b3c4d,
+					Marker:         sid == 2,
+				},
+				Payload: payload,
+			})
+		}
+	}
+	return packets
+}
+
+// ddExtension is the ID of the dependency descriptor in av1L2T2 and
+// testdata/av1_l2t2.hex.
+const ddExtension = 12
+
+// av1L2T2 returns the packets of an AV1 L2T2 stream with the
+// dependency descriptor. The first packet carries the template
+// structure with 320x180 and 640x360; the last one has custom frame
+// diffs.
+func av1L2T2(t *testing.T) []*rtp.Packet {
+	t.Helper()
+	structure := func(w *bitWriter) {
+		w.put(0, 6) // template_id_offset
+		w.put(3, 5) // dt_cnt_minus_one
+		// template_layers(): S0T0 S0T0 S0T1 S1T0 S1T0 S1T1
+		for _, next := range []int{0, 1, 2, 0, 1, 3} {
+			w.put(next, 2)
+		}
+		layers := [][2]int{{0, 0}, {0, 0}, {0, 1}, {1, 0}, {1, 0}, {1, 1}}
+		targets := [][2]int{{0, 0}, {0, 1}, {1, 0}, {1, 1}}
+		// template_dtis()
+		for _, l := range layers {
+			for _, dt := range targets {
+				dti := 0
+				if l[0] <= dt[0] && l[1] <= dt[1] {
+					dti = 2
+				}
+				w.put(dti, 2)
+			}
+		}
+		// template_fdiffs()
+		for _, fdiffs := range [][]int{{}, {4}, {2}, {1}, {1, 4}, {2, 1}} {
+			for _, fdiff := range fdiffs {
+				w.put(1, 1)
+				w.put(fdiff-1, 4)
+			}
+			w.put(0, 1)
+		}
+		// template_chains(): 2 chains
+		w.put(2, 2)
+		for _, chain := range []int{0, 0, 1, 1} {
+			w.put(chain, 1)
+		}
+		for i := 0; i < len(layers)*2; i++ {
+			w.put(i%3, 4)
+		}
+		// render_resolutions()
+		w.put(1, 1)
+		w.put(319, 16)
+		w.put(179, 16)
+		w.put(639, 16)
+		w.put(359, 16)
+	}
+
+	var packets []*rtp.Packet
+	// Template ids of the spatial layers of each picture.
+	for picture, templates := range [][]int{{0, 3}, {2, 5}, {1, 4}, {2, 5}} {
+		for sid, templateID := range templates {
+			w := &bitWriter{}
+			w.put(1, 1) // start_of_frame
+			w.put(1, 1) // end_of_frame
+			w.put(templateID, 6)
+			w.put(100+len(packets), 16) // frame_number
+			switch {
+			case picture == 0 && sid == 0:
+				w.put(0b10000, 5) // template_dependency_structure_present_flag
+				structure(w)
+			case picture == 3 && sid == 1:
+				w.put(0b00010, 5) // custom_fdiffs_flag
+				w.put(1, 2)
+				w.put(0, 4)
+				w.put(1, 2)
+				w.put(1, 4)
+				w.put(0, 2)
+			}
+			p := &rtp.Packet{
+				Header: rtp.Header{
+					Version:          2,
+					PayloadType:      45,
+					SequenceNumber:   uint16(4000 + len(packets)),
+					Timestamp:        uint32(90000 + picture*3000),
+					SSRC:             0x1a2b3c4d,
+					Marker:           sid == 1,
+					Extension:        true,
+					ExtensionProfile: 0x1000,
+				},
+				Payload: []byte{0x10, 0x32, 0x00},
+			}
+			if err := p.SetExtension(ddExtension, w.data); err != nil {
+				t.Fatal(err)
+			}
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+type layer struct {
+	spatial, temporal int
+	keyframe          bool
+}
+
+func Test_ParseVP9(t *testing.T) {
+	checkVP9L3T3(t, readPackets(t, "testdata/vp9_l3t3.hex"))
+}
+
+func Test_ParseVP9Generated(t *testing.T) {
+	checkVP9L3T3(t, vp9L3T3())
+}
+
+// checkVP9L3T3 parses the packets of the stream of vp9L3T3.
+func checkVP9L3T3(t *testing.T, packets []*rtp.Packet) {
+	t.Helper()
+	var want []layer
+	for i, tid := range []int{0, 2, 1, 2, 0} {
+		for sid := 0; sid < 3; sid++ {
+			want = append(want, layer{spatial: sid, temporal: tid, keyframe: i == 0})
+		}
+	}
+	if len(packets) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(packets), len(want))
+	}
+	for i, p := range packets {
+		f, err := svc.ParseVP9(p.Payload)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		got := layer{spatial: f.Spatial, temporal: f.Temporal, keyframe: f.Keyframe}
+		if got != want[i] {
+			t.Errorf("packet %d: got %+v, want %+v", i, got, want[i])
+		}
+		if !f.Start || !f.End {
+			t.Errorf("packet %d: got start %v end %v, want whole frames", i, f.Start, f.End)
+		}
+		var sizes []svc.Size
+		if i == 0 {
+			sizes = []svc.Size{{320, 180}, {640, 360}, {1280, 720}}
+		}
+		if !slices.Equal(f.Sizes, sizes) {
+			t.Errorf("packet %d: got sizes %v, want %v", i, f.Sizes, sizes)
+		}
+	}
+}
+
+func Test_ParseDependencyDescriptor(t *testing.T) {
+	checkAV1L2T2(t, readPackets(t, "testdata/av1_l2t2.hex"))
+}
+
+func Test_ParseDependencyDescriptorGenerated(t *testing.T) {
+	checkAV1L2T2(t, av1L2T2(t))
+}
+
+// checkAV1L2T2 parses the dependency descriptors of the stream of
+// av1L2T2.
+func checkAV1L2T2(t *testing.T, packets []*rtp.Packet) {
+	t.Helper()
+	want := []layer{
+		{0, 0, true}, {1, 0, false},
+		{0, 1, false}, {1, 1, false},
+		{0, 0, false}, {1, 0, false},
+		{0, 1, false}, {1, 1, false},
+	}
+	if len(packets) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(packets), len(want))
+	}
+
+	var parser svc.DescriptorParser
+	if _, err := parser.Parse(packets[1].GetExtension(ddExtension)); err != svc.ErrNoStructure {
+		t.Errorf("got %v before the structure, want %v", err, svc.ErrNoStructure)
+	}
+	for i, p := range packets {
+		f, err := parser.Parse(p.GetExtension(ddExtension))
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		got := layer{spatial: f.Spatial, temporal: f.Temporal, keyframe: f.Keyframe}
+		if got != want[i] {
+			t.Errorf("packet %d: got %+v, want %+v", i, got, want[i])
+		}
+		var sizes []svc.Size
+		if i == 0 {
+			sizes = []svc.Size{{320, 180}, {640, 360}}
+		}
+		if !slices.Equal(f.Sizes, sizes) {
+			t.Errorf("packet %d: got sizes %v, want %v", i, f.Sizes, sizes)
+		}
+	}
+
+	if _, err := parser.Parse([]byte{0xc0, 0x00}); err != svc.ErrShortDescriptor {
+		t.Errorf("got %v for a short descriptor, want %v", err, svc.ErrShortDescriptor)
+	}
+	// Template 9 is beyond the 6 templates of the structure.
+	if _, err := parser.Parse([]byte{0xc9, 0x00, 0x01}); err != svc.ErrUnknownTemplate {
+		t.Errorf("got %v for an unknown template, want %v", err, svc.ErrUnknownTemplate)
+	}
+}
+
+func Test_ParseAV1(t *testing.T) {
+	// A sequence header of a 640x480 stream: profile 0, level 4.0,
+	// 10 and 9 bits of maximum width and height.
+	sequenceHeader := []byte{0x00, 0x00, 0x00, 0x42, 0x62, 0x7f, 0xef, 0x90}
+	frame := []byte{0x30, 0x10, 0x00} // OBU_FRAME
+	concat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    svc.Frame
+	}{
+		{
+			name: "keyframe",
+			// N, two OBUs, the first of 9 bytes.
+			payload: concat([]byte{0x28, 0x09, 0x08}, sequenceHeader, frame),
+			want:    svc.Frame{Start: true, End: true, Keyframe: true, Sizes: []svc.Size{{640, 480}}},
+		},
+		{
+			name:    "delta frame",
+			payload: concat([]byte{0x10}, frame),
+			want:    svc.Frame{Start: true, End: true},
+		},
+		{
+			name:    "fragment",
+			payload: []byte{0xd0, 0x01, 0x02},
+			want:    svc.Frame{},
+		},
+		{
+			name: "sequence header with extension and size",
+			// Temporal layer 1 of spatial layer 1.
+			payload: concat([]byte{0x10, 0x0e, 0x28, 0x08}, sequenceHeader),
+			want: svc.Frame{Spatial: 1, Temporal: 1, Start: true, End: true, Keyframe: true,
+				Sizes: []svc.Size{{640, 480}}},
+		},
+	} {
+		f, err := svc.ParseAV1(tc.payload)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if f.Spatial != tc.want.Spatial || f.Temporal != tc.want.Temporal ||
+			f.Start != tc.want.Start || f.End != tc.want.End || f.Keyframe != tc.want.Keyframe ||
+			!slices.Equal(f.Sizes, tc.want.Sizes) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, f, tc.want)
+		}
+	}
+
+	for _, payload := range [][]byte{{0x10}, {0x00, 0x05, 0x30}, {0x10, 0x34}} {
+		if _, err := svc.ParseAV1(payload); err != svc.ErrShortDescriptor {
+			t.Errorf("got %v for %x, want %v", err, payload, svc.ErrShortDescriptor)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "time"
+
+// CPUTime is not supported on this platform and always returns zero.
+func CPUTime() time.Duration {
+	return 0
+}
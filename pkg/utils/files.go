@@ -0,0 +1,17 @@
+package utils
+
+import "strings"
+
+// SanitizeFileName replaces all characters of s which are not safe
+// in file names.
+func SanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,342 @@
+// Package wish implements the HTTP based WebRTC ingestion (WHIP) and
+// egress (WHEP) protocols on top of sfu.SFU.
+package wish
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+const (
+	contentTypeSDP     = "application/sdp"
+	contentTypeSDPFrag = "application/trickle-ice-sdpfrag"
+
+	// Maximum size of an offer or a trickle request.
+	maxBodySize = 64 * 1024
+
+	// Time allowed to gather the candidates of an answer.
+	gatherTimeout = 10 * time.Second
+)
+
+var (
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrSessionNotFound   = errors.New("session not found")
+	ErrICERestart        = errors.New("ice restart not supported")
+	ErrGatheringTimeout  = errors.New("timed out gathering candidates")
+	ErrUnsupportedFormat = errors.New("unsupported content type")
+	ErrNoTracks          = errors.New("no tracks to watch")
+)
+
+// Authorize decides whether r may create a session. It returns the id
+// the session's PeerConnection is registered with in the SFU; if it is
+// empty a random id is used.
+type Authorize func(r *http.Request) (peerID string, err error)
+
+// BearerToken authorizes requests carrying token in their
+// Authorization header.
+func BearerToken(token string) Authorize {
+	return func(r *http.Request) (string, error) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return "", ErrUnauthorized
+		}
+		return "", nil
+	}
+}
+
+// sessions holds the PeerConnections created by POST requests. A
+// session is addressed by its random id, which the client learns from
+// the Location header, so knowing the id is enough to trickle
+// candidates or to tear the session down.
+type sessions struct {
+	prefix string // of generated peer ids
+	m      map[string]*session
+	mu     sync.Mutex
+}
+
+type session struct {
+	pc  *webrtc.PeerConnection
+	sfu *sfu.SFU
+}
+
+func newSessions(prefix string) sessions {
+	return sessions{
+		prefix: prefix,
+		m:      make(map[string]*session),
+	}
+}
+
+// create registers a new PeerConnection with n. The session is torn
+// down once the connection fails or is closed.
+func (s *sessions) create(n *sfu.SFU, peerID string, config webrtc.Configuration) (string, *webrtc.PeerConnection, error) {
+	id := newSessionID()
+	if peerID == "" {
+		peerID = s.prefix + id
+	}
+	pc, err := n.API.NewPeerConnection(config)
+	if err != nil {
+		return "", nil, err
+	}
+	s.mu.Lock()
+	s.m[id] = &session{pc: pc, sfu: n}
+	s.mu.Unlock()
+	n.RegisterPeer(peerID, pc)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.remove(id)
+		}
+	})
+	return id, pc, nil
+}
+
+// remove tears down session id and reports whether it existed.
+func (s *sessions) remove(id string) bool {
+	s.mu.Lock()
+	sess, exists := s.m[id]
+	delete(s.m, id)
+	s.mu.Unlock()
+	if !exists {
+		return false
+	}
+	sess.sfu.UnregisterPeer(sess.pc)
+	if err := sess.pc.Close(); err != nil {
+		log.Println("error:", err)
+	}
+	return true
+}
+
+func (s *sessions) get(id string) (*webrtc.PeerConnection, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.m[id]
+	if !ok {
+		return nil, false
+	}
+	return sess.pc, true
+}
+
+// Close tears down all sessions.
+func (s *sessions) Close() {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.m))
+	for id := range s.m {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.remove(id)
+	}
+}
+
+// serve routes the requests shared by WHIP and WHEP: POST to the
+// endpoint creates a session using create, PATCH and DELETE on
+// /{id} address an existing session.
+func (s *sessions) serve(w http.ResponseWriter, r *http.Request, authorize Authorize,
+	create func(r *http.Request, peerID, offer string) (id, answer string, err error)) {
+	id := strings.Trim(r.URL.Path, "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		peerID := ""
+		if authorize != nil {
+			var err error
+			if peerID, err = authorize(r); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		offer, err := readBody(r, contentTypeSDP)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		id, answer, err := create(r, peerID, offer)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeSDP)
+		w.Header().Set("Location", location(r, id))
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	case id == "":
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case strings.Contains(id, "/"):
+		http.NotFound(w, r)
+	case r.Method == http.MethodPatch:
+		err := s.trickle(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		if !s.remove(id) {
+			http.Error(w, ErrSessionNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", http.MethodPatch+", "+http.MethodDelete)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func setOffer(pc *webrtc.PeerConnection, offer string) error {
+	return pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+}
+
+// answer returns the answer to the offer set on pc once all of its
+// candidates have been gathered, as the protocols do not trickle
+// candidates from the server.
+func answer(pc *webrtc.PeerConnection) (string, error) {
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		return "", ErrGatheringTimeout
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// trickle adds the candidates of an SDP fragment to session id.
+func (s *sessions) trickle(r *http.Request, id string) error {
+	pc, ok := s.get(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	frag, err := readBody(r, contentTypeSDPFrag)
+	if err != nil {
+		return err
+	}
+	ufrag, candidates := parseSDPFrag(frag)
+	if ufrag != "" && ufrag != remoteUfrag(pc) {
+		return ErrICERestart
+	}
+	for _, c := range candidates {
+		if err := pc.AddICECandidate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSDPFrag returns the ICE username fragment and the candidates
+// of an application/trickle-ice-sdpfrag body.
+func parseSDPFrag(frag string) (ufrag string, candidates []webrtc.ICECandidateInit) {
+	var mid *string
+	scanner := bufio.NewScanner(strings.NewReader(frag))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "m="):
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+		}
+	}
+	return ufrag, candidates
+}
+
+// remoteUfrag returns the ICE username fragment of the offer pc was
+// created with.
+func remoteUfrag(pc *webrtc.PeerConnection) string {
+	desc := pc.RemoteDescription()
+	if desc == nil {
+		return ""
+	}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return ""
+	}
+	if ufrag, ok := parsed.Attribute("ice-ufrag"); ok {
+		return ufrag
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if ufrag, ok := m.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
+
+func readBody(r *http.Request, contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != contentType {
+		return "", ErrUnsupportedFormat
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// location returns the URL path of session id, relative to the path
+// the request was sent to, so that it holds behind http.StripPrefix.
+func location(r *http.Request, id string) string {
+	path := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		path = u.Path
+	}
+	return strings.TrimSuffix(path, "/") + "/" + id
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrNoTracks),
+		errors.Is(err, sfu.ErrTrackNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sfu.ErrNotPermitted):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrICERestart):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrGatheringTimeout):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,115 @@
+package wish
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// WHEP lets WHEP players watch tracks of the SFU without joining a
+// room. Every session is a recvonly PeerConnection registered with the
+// SFU and subscribed to the tracks selected when it is created; tracks
+// published later are not added, as WHEP has no way to renegotiate.
+//
+//	POST /       offer in, answer out, Location of the session
+//	PATCH /{id}  trickle candidates (application/trickle-ice-sdpfrag)
+//	DELETE /{id} end the session
+type WHEP struct {
+	SFU *sfu.SFU
+	// Config is used for the PeerConnections of new sessions.
+	Config webrtc.Configuration
+	// Authorize is consulted for every new session. A nil Authorize
+	// allows everyone to watch.
+	Authorize Authorize
+	// Tracks selects the tracks of a new session. By default these are
+	// the tracks given by the track query parameters, e.g.
+	// /?track=stream%23video&track=stream%23audio, or all tracks.
+	Tracks func(r *http.Request) ([]string, error)
+
+	sessions
+}
+
+func NewWHEP(s *sfu.SFU) *WHEP {
+	return &WHEP{
+		SFU:      s,
+		sessions: newSessions("whep-"),
+	}
+}
+
+func (h *WHEP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, h.Authorize, h.watch)
+}
+
+func (h *WHEP) tracks(r *http.Request) ([]string, error) {
+	if h.Tracks != nil {
+		return h.Tracks(r)
+	}
+	if tracks := r.URL.Query()["track"]; len(tracks) > 0 {
+		return tracks, nil
+	}
+	return h.SFU.Tracks(), nil
+}
+
+// watch creates a session which forwards the selected tracks.
+func (h *WHEP) watch(r *http.Request, peerID, offer string) (string, string, error) {
+	tracks, err := h.tracks(r)
+	if err != nil {
+		return "", "", err
+	}
+	if len(tracks) == 0 {
+		return "", "", ErrNoTracks
+	}
+	id, pc, err := h.create(h.SFU, peerID, h.Config)
+	if err != nil {
+		return "", "", err
+	}
+	err = setOffer(pc, offer)
+	if err == nil {
+		err = h.subscribe(pc, tracks)
+	}
+	if err != nil {
+		h.remove(id)
+		return "", "", err
+	}
+	answer, err := answer(pc)
+	if err != nil {
+		h.remove(id)
+		return "", "", err
+	}
+	return id, answer, nil
+}
+
+// subscribe attaches tracks to the transceivers offered by the player.
+// Tracks for which no transceiver of their kind is left are skipped,
+// the player did not ask for them.
+func (h *WHEP) subscribe(pc *webrtc.PeerConnection, tracks []string) error {
+	free := make(map[webrtc.RTPCodecType]int)
+	for _, t := range pc.GetTransceivers() {
+		if t.Sender() == nil {
+			free[t.Kind()]++
+		}
+	}
+	subscribed := 0
+	for _, trackID := range tracks {
+		info, err := h.SFU.TrackInfo(trackID)
+		if err != nil {
+			return err
+		}
+		kind := webrtc.NewRTPCodecType(info.Kind)
+		if free[kind] == 0 {
+			log.Printf("Track %s skipped: no %s transceiver offered\n", trackID, info.Kind)
+			continue
+		}
+		if err := h.SFU.Subscribe(pc, trackID); err != nil {
+			return err
+		}
+		free[kind]--
+		subscribed++
+	}
+	if subscribed == 0 {
+		return ErrNoTracks
+	}
+	return nil
+}
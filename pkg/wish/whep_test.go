@@ -0,0 +1,106 @@
+package wish_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/wish"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func Test_WHEP(t *testing.T) {
+	s := sfu.NewSFU()
+	packets := make(chan *rtp.Packet)
+	defer close(packets)
+	trackID, err := s.PublishTrack(sfu.LocalTrack{
+		ID:       "video",
+		StreamID: "camera",
+		Owner:    "test",
+		Codec:    webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whep := wish.NewWHEP(s)
+	defer whep.Close()
+	srv := httptest.NewServer(whep)
+	defer srv.Close()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		_, err = pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := make(chan string, 1)
+	pc.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		received <- tr.StreamID() + "#" + tr.ID()
+	})
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := request(t, http.MethodPost, srv.URL+"/?track=missing", "application/sdp", offer.SDP)
+	expectStatus(t, resp, http.StatusNotFound)
+
+	resp = request(t, http.MethodPost, srv.URL+"/?track=camera%23video", "application/sdp", offer.SDP)
+	expectStatus(t, resp, http.StatusCreated)
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs := s.Subscriptions()[trackID]; len(subs) != 1 {
+		t.Fatalf("Expected one subscriber, got %v", subs)
+	}
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for seq := uint16(0); ; seq++ {
+		select {
+		case id := <-received:
+			if id != trackID {
+				t.Errorf("Expected to receive %s, got %s", trackID, id)
+			}
+		case <-ticker.C:
+			packets <- &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 1800},
+				Payload: []byte{0x10, 0, 0, 0},
+			}
+			continue
+		case <-timeout:
+			t.Fatal("Timed out waiting for the track")
+		}
+		break
+	}
+
+	resp = request(t, http.MethodDelete, srv.URL+resp.Header.Get("Location"), "", "")
+	expectStatus(t, resp, http.StatusOK)
+	if subs := s.Subscriptions()[trackID]; len(subs) != 0 {
+		t.Errorf("Expected no subscribers after DELETE, got %v", subs)
+	}
+}
@@ -0,0 +1,56 @@
+package wish
+
+import (
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+// WHIP accepts broadcasts from WHIP clients such as OBS or GStreamer.
+// Every session is a PeerConnection registered with the SFU, so its
+// tracks are published like those of any other peer.
+//
+//	POST /       offer in, answer out, Location of the session
+//	PATCH /{id}  trickle candidates (application/trickle-ice-sdpfrag)
+//	DELETE /{id} end the session
+type WHIP struct {
+	SFU *sfu.SFU
+	// Config is used for the PeerConnections of new sessions.
+	Config webrtc.Configuration
+	// Authorize is consulted for every new session. A nil Authorize
+	// allows everyone to publish.
+	Authorize Authorize
+
+	sessions
+}
+
+func NewWHIP(s *sfu.SFU) *WHIP {
+	return &WHIP{
+		SFU:      s,
+		sessions: newSessions("whip-"),
+	}
+}
+
+func (h *WHIP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, h.Authorize, h.publish)
+}
+
+// publish creates a session receiving the tracks of offer.
+func (h *WHIP) publish(_ *http.Request, peerID, offer string) (string, string, error) {
+	id, pc, err := h.create(h.SFU, peerID, h.Config)
+	if err != nil {
+		return "", "", err
+	}
+	err = setOffer(pc, offer)
+	if err != nil {
+		h.remove(id)
+		return "", "", err
+	}
+	answer, err := answer(pc)
+	if err != nil {
+		h.remove(id)
+		return "", "", err
+	}
+	return id, answer, nil
+}
@@ -0,0 +1,159 @@
+package wish_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/wish"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+func request(t *testing.T, method, url, contentType, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func expectStatus(t *testing.T, resp *http.Response, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: expected status %d, got %d: %s",
+			resp.Request.Method, resp.Request.URL, status, resp.StatusCode, body)
+	}
+}
+
+func waitTracks(t *testing.T, s *sfu.SFU, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Tracks()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d tracks, got %v", n, s.Tracks())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_WHIP(t *testing.T) {
+	s := sfu.NewSFU()
+	whip := wish.NewWHIP(s)
+	whip.Authorize = wish.BearerToken("secret")
+	defer whip.Close()
+	srv := httptest.NewServer(http.StripPrefix("/whip", whip))
+	defer srv.Close()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal("Failed to create webrtc PeerConnection:", err)
+	}
+	defer pc.Close()
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "obs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := request(t, http.MethodPost, srv.URL+"/whip", "text/plain", offer.SDP)
+	expectStatus(t, resp, http.StatusUnsupportedMediaType)
+	resp = request(t, http.MethodGet, srv.URL+"/whip", "", "")
+	expectStatus(t, resp, http.StatusMethodNotAllowed)
+
+	resp = request(t, http.MethodPost, srv.URL+"/whip", "application/sdp", offer.SDP)
+	expectStatus(t, resp, http.StatusCreated)
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/whip/") {
+		t.Fatalf("Expected a session below /whip/, got %q", location)
+	}
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				track.WriteSample(media.Sample{Data: []byte{0x10, 0, 0, 0}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+	waitTracks(t, s, 1)
+	if owner, _ := s.TrackOwner("obs#video"); !strings.HasPrefix(owner, "whip-") {
+		t.Errorf("Expected the track to be owned by a whip session, got %q", owner)
+	}
+
+	desc, err := pc.LocalDescription().Unmarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufrag, _ := desc.MediaDescriptions[0].Attribute("ice-ufrag")
+	frag := "a=ice-ufrag:" + ufrag + "\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1 1 udp 2130706431 192.0.2.1 9 typ host\r\n"
+	resp = request(t, http.MethodPatch, srv.URL+location, "application/trickle-ice-sdpfrag", frag)
+	expectStatus(t, resp, http.StatusNoContent)
+	restart := strings.Replace(frag, ufrag, "restart", 1)
+	resp = request(t, http.MethodPatch, srv.URL+location, "application/trickle-ice-sdpfrag", restart)
+	expectStatus(t, resp, http.StatusNotImplemented)
+
+	resp = request(t, http.MethodDelete, srv.URL+location, "", "")
+	expectStatus(t, resp, http.StatusOK)
+	waitTracks(t, s, 0)
+	resp = request(t, http.MethodDelete, srv.URL+location, "", "")
+	expectStatus(t, resp, http.StatusNotFound)
+}
+
+func Test_WHIPUnauthorized(t *testing.T) {
+	whip := wish.NewWHIP(sfu.NewSFU())
+	whip.Authorize = wish.BearerToken("other")
+	srv := httptest.NewServer(whip)
+	defer srv.Close()
+
+	resp := request(t, http.MethodPost, srv.URL, "application/sdp", "v=0\r\n")
+	expectStatus(t, resp, http.StatusUnauthorized)
+}
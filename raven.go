@@ -2,14 +2,19 @@ package raven
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v4"
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+	"github.com/ravenbox/raven-prototype/pkg/cascade"
 	"github.com/ravenbox/raven-prototype/pkg/negotiation"
+	"github.com/ravenbox/raven-prototype/pkg/recording"
 	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/store"
 
 	"github.com/gorilla/websocket"
 )
@@ -24,10 +29,15 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer. Must fit an SDP.
+	maxMessageSize = 64 * 1024
+
+	// Messages queued for a user before it is disconnected as too slow.
+	sendQueueSize = 256
 )
 
+var errNameTaken = errors.New("name already taken")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -35,61 +45,261 @@ var upgrader = websocket.Upgrader{
 
 type Raven struct {
 	SFU *sfu.SFU
+	// Recorder records rooms on request. Recording is disabled if nil.
+	Recorder *recording.Recorder
+	// NegotiatorOptions returns extra options for the negotiators of
+	// users in room, e.g. to prefer specific codecs.
+	NegotiatorOptions func(room string) []negotiation.Option
+	// Store persists users, rooms and chat. NewRaven sets an
+	// in-memory store.
+	Store store.Store
+	// CaptureDir holds the rtpcapture files which the admin API may
+	// replay. Replay is disabled if empty.
+	CaptureDir string
+	// NodeID names this node on the bus of ConnectBus, so that users
+	// of other nodes may have their PeerConnection hosted here.
+	NodeID string
+	// TrustPeer reports whether a peer of the SFU which is not a user,
+	// such as a WHIP or WHEP session authorized by its own handler,
+	// may publish and subscribe to any track. Such peers are refused
+	// if it is nil.
+	TrustPeer func(peerID string) bool
 
-	users map[string]*user
-	mu    sync.Mutex
+	node        *cascade.Node // set by JoinCluster
+	bus         bus.Bus       // set by ConnectBus
+	users       map[string]*user
+	rooms       map[string]*room
+	remotePeers map[string]*remotePeer // by user of another node
+	// Rooms of the tracks announced by onTrackInfo, by track id.
+	trackRooms map[string]string
+	trusted    map[string]int // peer id -> count, see withTrust
+	mu         sync.Mutex
 }
 
 func NewRaven(sfu *sfu.SFU) *Raven {
-	return &Raven{
-		SFU:   sfu,
-		users: make(map[string]*user),
+	ra := &Raven{
+		SFU:         sfu,
+		Store:       store.NewMemory(),
+		users:       make(map[string]*user),
+		rooms:       make(map[string]*room),
+		remotePeers: make(map[string]*remotePeer),
+		trackRooms:  make(map[string]string),
+		trusted:     make(map[string]int),
 	}
+	sfu.Authorizer = roomAuthorizer{ra}
+	sfu.OnTrackInfo = ra.onTrackInfo
+	sfu.OnTrackEnded = ra.onTrackEnded
+	sfu.SpeakerGroup = ra.speakerGroup
+	sfu.OnActiveSpeaker = ra.onActiveSpeaker
+	sfu.OnForwarding = ra.onForwarding
+	return ra
 }
 
+// UserRegisterRequest is the JSON body of the POST websocket
+// handshake. Browsers can only open websockets with GET, so it is
+// also read from the query, e.g. /?name=alice&room=lobby. AudioOnly
+// makes a new room a voice channel.
 type UserRegisterRequest struct {
-	Name string `json:"name"`
+	Name      string `json:"name"`
+	Room      string `json:"room"`
+	AudioOnly bool   `json:"audio_only"`
 }
 
 func (ra *Raven) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+	var regReq UserRegisterRequest
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&regReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The upgrader only accepts GET handshakes.
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+	case http.MethodGet:
+		q := r.URL.Query()
+		regReq = UserRegisterRequest{
+			Name:      q.Get("name"),
+			Room:      q.Get("room"),
+			AudioOnly: q.Get("audio_only") == "true",
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	var regReq UserRegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&regReq); err != nil {
+	if regReq.Name == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if regReq.Room == "" {
+		regReq.Room = defaultRoom
+	}
+	loaded, exists := ra.room(regReq.Room)
+	if !exists {
+		loaded = ra.loadRoom(regReq.Room, regReq.AudioOnly)
+	}
+	if loaded.isBanned(regReq.Name) {
+		http.Error(w, errBanned.Error(), http.StatusForbidden)
+		return
+	}
+	if _, taken := ra.user(regReq.Name); taken {
+		http.Error(w, errNameTaken.Error(), http.StatusConflict)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Error upgrading http to ws:", err)
 		return
 	}
-	sendCh := make(chan WebsocketMessagePayload, 32)
+	sendCh := make(chan WebsocketMessagePayload, sendQueueSize)
 	u := &user{
+		name:     regReq.Name,
+		raven:    ra,
 		ws:       conn,
 		wsSendCh: sendCh,
+		done:     make(chan struct{}),
 	}
 	ra.mu.Lock()
+	if _, taken := ra.users[regReq.Name]; taken {
+		// Taken while upgrading.
+		ra.mu.Unlock()
+		closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, errNameTaken.Error())
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
 	ra.users[regReq.Name] = u
+	rm, exists := ra.rooms[regReq.Room]
+	if !exists {
+		rm = loaded
+		ra.rooms[regReq.Room] = rm
+	}
+	u.room = rm
+	node := ra.node
 	ra.mu.Unlock()
+	rm.join(u)
+	if node != nil {
+		node.Join(rm.name, u.name)
+	}
+	ra.broadcast(rm.name, msgPresence{User: u.name, Online: true})
+
+	ra.startSession(u)
 
 	go u.readWs()
 	go u.writeWs()
+	u.sendTrackInfos()
+	u.sendActiveSpeaker()
+	u.sendChatHistory()
+}
+
+// removeUser detaches u from its room and from the SFU.
+func (ra *Raven) removeUser(u *user) {
+	ra.mu.Lock()
+	left := ra.users[u.name] == u
+	if left {
+		delete(ra.users, u.name)
+	}
+	u.room.leave(u)
+	if u.room.empty() && ra.rooms[u.room.name] == u.room {
+		delete(ra.rooms, u.room.name)
+	}
+	node := ra.node
+	ra.mu.Unlock()
+
+	if left && node != nil {
+		node.Leave(u.room.name, u.name)
+	}
+	if left {
+		ra.broadcast(u.room.name, msgPresence{User: u.name, Online: false})
+	}
+	ra.endSession(u)
+
+	if pc := u.peer(); pc != nil {
+		ra.SFU.UnregisterPeer(pc)
+	}
+	if u.relay != nil {
+		u.closeRemotePeer()
+	}
+}
+
+// user looks up a connected user by name.
+func (ra *Raven) user(name string) (*user, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	u, ok := ra.users[name]
+	return u, ok
 }
 
 type user struct {
-	ws       *websocket.Conn
-	wsSendCh chan WebsocketMessagePayload
+	name    string
+	raven   *Raven
+	room    *room
+	session string // id in the store
 
+	ws        *websocket.Conn
+	wsSendCh  chan WebsocketMessagePayload
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// webrtc is only written by the goroutine reading the websocket;
+	// others read it with peer().
 	webrtc     *webrtc.PeerConnection
 	negotiator *negotiation.Negotiator
 	signaler   negotiation.ChanSignaler
+	mu         sync.Mutex // guards webrtc and relayNode
+	// relay carries the signals of a PeerConnection hosted on
+	// relayNode, see createRemotePeer. They are only written by the
+	// goroutine reading the websocket.
+	relay     *negotiation.BusSignaler
+	relayNode string
+	// unsubscribeHost stops the messages of relayNode for the user.
+	unsubscribeHost func()
+}
+
+// peer returns the user's PeerConnection, or nil until it is created.
+func (u *user) peer() *webrtc.PeerConnection {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.webrtc
+}
+
+// close disconnects the user's websocket and PeerConnection.
+func (u *user) close() {
+	u.closeOnce.Do(func() {
+		close(u.done)
+		u.ws.Close()
+		if pc := u.peer(); pc != nil {
+			pc.Close()
+		}
+	})
+}
+
+// send queues msg for the user's websocket unless it is closed. It
+// never blocks: a user whose queue is full is disconnected, rather
+// than holding up everyone sending to the room.
+func (u *user) send(msg WebsocketMessagePayload) {
+	select {
+	case <-u.done:
+		return
+	default:
+	}
+	select {
+	case u.wsSendCh <- msg:
+	default:
+		log.Printf("error: send queue of %s is full, disconnecting\n", u.name)
+		go u.close()
+	}
+}
+
+func (u *user) sendError(err error) {
+	u.send(msgError{Message: err.Error()})
 }
 
 func (u *user) readWs() {
-	defer u.ws.Close()
+	defer u.raven.removeUser(u)
+	defer u.close()
 	u.ws.SetReadLimit(maxMessageSize)
 	u.ws.SetReadDeadline(time.Now().Add(pongWait))
 	u.ws.SetPongHandler(func(string) error {
@@ -113,13 +323,34 @@ func (u *user) readWs() {
 }
 
 func (u *user) writeWs() {
+	// A failed write ends the session, readWs then cleans up.
+	defer u.close()
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
 	readFrom := u.wsSendCh
-	for msg := range readFrom {
+	for {
+		var msg WebsocketMessagePayload
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+			u.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := u.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		case m, ok := <-readFrom:
+			if !ok {
+				return
+			}
+			msg = m
+		}
 		wsMsg, err := EncodeWebsocketMessage(msg)
 		if err != nil {
 			log.Println("error:", err)
 			continue
 		}
+		u.ws.SetWriteDeadline(time.Now().Add(writeWait))
 		err = u.ws.WriteJSON(wsMsg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -137,31 +368,113 @@ func (u *user) route(msg WebsocketMessage) error {
 	if err := Match(msg, u.wsGetSignal); err != nil {
 		return err
 	}
+	if err := Match(msg, u.wsPublishTrack); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capSubscribe, u.wsSubscribe)); err != nil {
+		return err
+	}
+	if err := Match(msg, u.wsUnsubscribe); err != nil {
+		return err
+	}
+	if err := Match(msg, u.wsSetForwarding); err != nil {
+		return err
+	}
+	if err := Match(msg, u.wsViewport); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capChat, u.wsChat)); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsMuteTrack)); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsUnpublishTrack)); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsKick)); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsBan)); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsStartRecording)); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsStopRecording)); err != nil {
+		return err
+	}
+	if err := Match(msg, u.wsSetRole); err != nil {
+		return err
+	}
+	if err := Match(msg, guard(u, capModerate, u.wsSetPermissions)); err != nil {
+		return err
+	}
 	return nil
 }
 
-type msgCreateWebRTCPeer struct{}
+// msgCreateWebRTCPeer creates the user's PeerConnection. With InBand,
+// signals go over a DataChannel of it once open, see
+// negotiation.DataChannelSignaler, so the client must do the same.
+// Node has the node of the bus with that NodeID host it instead.
+type msgCreateWebRTCPeer struct {
+	InBand bool   `json:"in_band"`
+	Node   string `json:"node"`
+}
 
 func (msgCreateWebRTCPeer) MessageType() string { return "create_webrtc_peer" }
 
-func (u *user) wsCreateWebRTCPeer(_ msgCreateWebRTCPeer) {
+func (u *user) wsCreateWebRTCPeer(msg msgCreateWebRTCPeer) {
+	if u.signaler == nil {
+		u.signaler = negotiation.NewChanSignaler(u.wsSendCh,
+			func(sb negotiation.SignalBody) WebsocketMessagePayload {
+				return msgSignal(sb)
+			})
+	}
+	if msg.Node != "" && msg.Node != u.raven.NodeID {
+		if u.webrtc == nil && u.relay == nil {
+			if err := u.createRemotePeer(msg.Node, msg.InBand); err != nil {
+				u.sendError(err)
+			}
+		}
+		return
+	}
+	if u.relay != nil {
+		return
+	}
 	if u.webrtc == nil {
-		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		api := u.raven.SFU.API
+		if u.room.audioOnly {
+			api = u.raven.SFU.AudioAPI
+		}
+		pc, err := api.NewPeerConnection(webrtc.Configuration{})
 		if err != nil {
 			log.Println("error:", err)
 			return
 		}
+		u.mu.Lock()
 		u.webrtc = pc
-	}
-	if u.signaler == nil {
-		u.signaler = negotiation.NewChanSignaler(u.wsSendCh,
-			func(sb negotiation.SignalBody) WebsocketMessagePayload {
-				return msgSignal(sb)
-			})
+		u.mu.Unlock()
+		u.raven.SFU.RegisterPeer(u.name, pc)
 	}
 	if u.negotiator == nil {
-		neg := negotiation.NewRegisteredNegotiator(
-			u.webrtc, u.signaler, negotiation.Polite)
+		opts := []negotiation.Option{
+			negotiation.Polite,
+			negotiation.Direction(sfu.Direction),
+		}
+		if u.raven.NegotiatorOptions != nil {
+			opts = append(opts, u.raven.NegotiatorOptions(u.room.name)...)
+		}
+		var signaler negotiation.Signaler = u.signaler
+		if msg.InBand {
+			dcSignaler, err := negotiation.NewDataChannelSignaler(u.webrtc, u.signaler)
+			if err != nil {
+				log.Println("error:", err)
+				return
+			}
+			signaler = dcSignaler
+		}
+		neg := negotiation.NewRegisteredNegotiator(u.webrtc, signaler, opts...)
 		u.negotiator = neg
 	}
 }
@@ -0,0 +1,931 @@
+package raven_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ravenbox/raven-prototype"
+	"github.com/ravenbox/raven-prototype/pkg/bus"
+	"github.com/ravenbox/raven-prototype/pkg/cascade"
+	"github.com/ravenbox/raven-prototype/pkg/client"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+	"github.com/ravenbox/raven-prototype/pkg/store"
+	"github.com/ravenbox/raven-prototype/pkg/wish"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+func newServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(raven.NewRaven(sfu.NewSFU()))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, ctx context.Context, url, name, room string) *client.Client {
+	t.Helper()
+	c, err := client.Dial(ctx, url, name, room)
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func byOwner(owner string, source sfu.TrackSource) func(sfu.TrackInfo) bool {
+	return func(info sfu.TrackInfo) bool {
+		return info.Owner == owner && info.Source == source
+	}
+}
+
+func Test_PublishSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	alice := dial(t, ctx, url, "alice", "e2e")
+	bob := dial(t, ctx, url, "bob", "e2e")
+
+	video, err := alice.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+		&client.CounterFrames{Size: 500, Duration: 33 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish video:", err)
+	}
+	defer video.Stop()
+	audio, err := alice.Publish(ctx, client.Opus, "audio", sfu.SourceMicrophone,
+		&client.CounterFrames{Size: 80, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish audio:", err)
+	}
+	defer audio.Stop()
+
+	for _, source := range []sfu.TrackSource{sfu.SourceCamera, sfu.SourceMicrophone} {
+		info, err := bob.WaitTrack(ctx, byOwner("alice", source))
+		if err != nil {
+			t.Fatalf("Track of source %s not announced: %v", source, err)
+		}
+		tr, err := bob.Subscribe(ctx, info.ID)
+		if err != nil {
+			t.Fatalf("Failed to subscribe to %s: %v", info.ID, err)
+		}
+		r := client.Receive(tr)
+		if err := r.WaitPackets(ctx, 30); err != nil {
+			t.Fatalf("Did not receive packets of %s: %v", info.ID, err)
+		}
+		stats := r.Stats()
+		t.Logf("%s: %+v", info.ID, stats)
+		if stats.Frames == 0 || stats.Reordered > 0 {
+			t.Errorf("%s: unexpected frames, got %+v", info.ID, stats)
+		}
+	}
+}
+
+func Test_InBandSignaling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	alice := dial(t, ctx, url, "alice", "inband")
+	bob := dial(t, ctx, url, "bob", "inband")
+	// The first negotiation goes through the websocket.
+	for _, c := range []*client.Client{alice, bob} {
+		for !c.InBand() {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("Signals of %s never went in-band", c.Name)
+			}
+		}
+	}
+
+	video, err := alice.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+		&client.CounterFrames{Size: 500, Duration: 33 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish video:", err)
+	}
+	defer video.Stop()
+	info, err := bob.WaitTrack(ctx, byOwner("alice", sfu.SourceCamera))
+	if err != nil {
+		t.Fatal("Track not announced:", err)
+	}
+	tr, err := bob.Subscribe(ctx, info.ID)
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	if err := client.Receive(tr).WaitPackets(ctx, 30); err != nil {
+		t.Fatal("Did not receive packets:", err)
+	}
+}
+
+func Test_SubscribeNotPermitted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	// The first user owns the room.
+	alice := dial(t, ctx, url, "alice", "webinar")
+	err := alice.Send("set_permissions", map[string]any{
+		"permissions": map[string]bool{"can_publish_audio": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := dial(t, ctx, url, "bob", "webinar")
+
+	audio, err := alice.Publish(ctx, client.Opus, "audio", sfu.SourceMicrophone,
+		&client.CounterFrames{Size: 80, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish audio:", err)
+	}
+	defer audio.Stop()
+
+	info, err := bob.WaitTrack(ctx, byOwner("alice", sfu.SourceMicrophone))
+	if err != nil {
+		t.Fatal("Track not announced:", err)
+	}
+	if _, err := bob.Subscribe(ctx, info.ID); err == nil {
+		t.Fatal("Expected subscribing to be refused")
+	}
+}
+
+// newNode starts a server which is node id of the cluster of dir.
+func newNode(t *testing.T, id string, dir cascade.Directory) string {
+	t.Helper()
+	s := sfu.NewSFU()
+	ra := raven.NewRaven(s)
+	ra.TrustPeer = func(peerID string) bool { return strings.HasPrefix(peerID, "whep-") }
+	whep := wish.NewWHEP(s)
+	t.Cleanup(whep.Close)
+	whepSrv := httptest.NewServer(whep)
+	t.Cleanup(whepSrv.Close)
+	node := cascade.NewNode(id, whepSrv.URL, s, dir)
+	t.Cleanup(node.Close)
+	ra.JoinCluster(node)
+	srv := httptest.NewServer(ra)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func Test_Cascade(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir := cascade.NewMemoryDirectory()
+	url1 := newNode(t, "node1", dir)
+	url2 := newNode(t, "node2", dir)
+
+	alice := dial(t, ctx, url1, "alice", "cluster")
+	bob := dial(t, ctx, url2, "bob", "cluster")
+	if members := dir.Members("cluster"); len(members) != 2 {
+		t.Errorf("Expected 2 members in the directory, got %v", members)
+	}
+
+	video, err := alice.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+		&client.CounterFrames{Size: 500, Duration: 33 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish video:", err)
+	}
+	info, err := bob.WaitTrack(ctx, byOwner("alice", sfu.SourceCamera))
+	if err != nil {
+		t.Fatal("Track of another node not announced:", err)
+	}
+	tr, err := bob.Subscribe(ctx, info.ID)
+	if err != nil {
+		t.Fatalf("Failed to subscribe to %s: %v", info.ID, err)
+	}
+	r := client.Receive(tr)
+	if err := r.WaitPackets(ctx, 30); err != nil {
+		t.Fatalf("Did not receive relayed packets of %s: %v", info.ID, err)
+	}
+
+	defer video.Stop()
+
+	// The track ends on all nodes once its publisher leaves.
+	alice.Close()
+	for {
+		_, announced := dir.Track(info.ID)
+		if !announced && len(bob.Tracks()) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("Track did not end on the other node")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func Test_StoreSurvivesRestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	st, err := store.OpenSQLite(filepath.Join(t.TempDir(), "raven.db"))
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer st.Close()
+	start := func() (string, func()) {
+		ra := raven.NewRaven(sfu.NewSFU())
+		ra.Store = st
+		srv := httptest.NewServer(ra)
+		return "ws" + strings.TrimPrefix(srv.URL, "http"), srv.Close
+	}
+
+	url, stop := start()
+	alice := dial(t, ctx, url, "alice", "persist")
+	alice.Send("ban", map[string]string{"user": "bob", "reason": "spam"})
+	alice.Send("chat", map[string]string{"text": "hello"})
+	for {
+		history, _ := st.ChatHistory(ctx, "persist", 1)
+		if len(history) == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("Chat message was not stored")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	alice.Close()
+	stop()
+
+	url, stop = start()
+	defer stop()
+	if _, err := client.Dial(ctx, url, "bob", "persist"); err == nil {
+		t.Error("Expected the ban to survive the restart")
+	}
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url+"?name=carol&room=persist", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg raven.WebsocketMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal("Did not receive the chat history:", err)
+		}
+		if msg.Type != "chat_history" {
+			continue
+		}
+		var history struct {
+			Messages []struct{ From, Text string }
+		}
+		json.Unmarshal(msg.Payload, &history)
+		if len(history.Messages) != 1 || history.Messages[0].Text != "hello" {
+			t.Errorf("Unexpected chat history %+v", history)
+		}
+		break
+	}
+}
+
+func Test_BusChat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	b := bus.NewLocal()
+	defer b.Close()
+	start := func() string {
+		ra := raven.NewRaven(sfu.NewSFU())
+		if err := ra.ConnectBus(b); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(ra)
+		t.Cleanup(srv.Close)
+		return "ws" + strings.TrimPrefix(srv.URL, "http")
+	}
+	url1, url2 := start(), start()
+
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url2+"?name=bob&room=bus", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	alice := dial(t, ctx, url1, "alice", "bus")
+	alice.Send("chat", map[string]string{"text": "hello"})
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var aliceOnline bool
+	for {
+		var msg raven.WebsocketMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal("Did not receive the chat message of the other node:", err)
+		}
+		switch msg.Type {
+		case "presence":
+			var presence struct {
+				User   string
+				Online bool
+			}
+			json.Unmarshal(msg.Payload, &presence)
+			if presence.User == "alice" {
+				aliceOnline = presence.Online
+			}
+		case "chat":
+			var chat struct{ From, Text string }
+			json.Unmarshal(msg.Payload, &chat)
+			if chat.From != "alice" || chat.Text != "hello" {
+				t.Errorf("Unexpected chat message %+v", chat)
+			}
+			if !aliceOnline {
+				t.Error("Expected alice to be announced before her message")
+			}
+			return
+		}
+	}
+}
+
+func Test_BusPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	b := bus.NewLocal()
+	// Closed after the servers.
+	t.Cleanup(func() { b.Close() })
+	start := func(id string) (*raven.Raven, string) {
+		ra := raven.NewRaven(sfu.NewSFU())
+		ra.NodeID = id
+		if err := ra.ConnectBus(b); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(ra)
+		t.Cleanup(srv.Close)
+		return ra, "ws" + strings.TrimPrefix(srv.URL, "http")
+	}
+	ra1, url1 := start("node1")
+	ra2, url2 := start("node2")
+	// waitFor polls cond until it holds.
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatal("Timed out waiting for", what)
+			}
+		}
+	}
+
+	// The websocket is on node1, the PeerConnection on node2.
+	alice, err := client.Dial(ctx, url1, "alice", "bus", client.PeerNode("node2"))
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer alice.Close()
+	waitFor("the PeerConnection to connect", func() bool {
+		return alice.PeerConn.ConnectionState() == webrtc.PeerConnectionStateConnected
+	})
+	waitFor("in-band signals", alice.InBand)
+	if _, ok := ra1.SFU.Peer("alice"); ok {
+		t.Error("Expected no PeerConnection on the node of the websocket")
+	}
+	pc, ok := ra2.SFU.Peer("alice")
+	if !ok {
+		t.Fatal("Expected the PeerConnection on node2")
+	}
+	if state := pc.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+		t.Errorf("Got state %s on node2, want connected", state)
+	}
+
+	// Media commands of alice go to node2, and her tracks are
+	// announced to the room on every node.
+	bob := dial(t, ctx, url2, "bob", "bus")
+	video, err := alice.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+		&client.CounterFrames{Size: 500, Duration: 33 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish:", err)
+	}
+	defer video.Stop()
+	info, err := bob.WaitTrack(ctx, byOwner("alice", sfu.SourceCamera))
+	if err != nil {
+		t.Fatal("Track of the hosted PeerConnection not announced:", err)
+	}
+	tr, err := bob.Subscribe(ctx, info.ID)
+	if err != nil {
+		t.Fatal("Failed to subscribe to the hosted PeerConnection:", err)
+	}
+	if err := client.Receive(tr).WaitPackets(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	bobVideo, err := bob.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+		&client.CounterFrames{Size: 500, Duration: 33 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish:", err)
+	}
+	defer bobVideo.Stop()
+	info, err = alice.WaitTrack(ctx, byOwner("bob", sfu.SourceCamera))
+	if err != nil {
+		t.Fatal("Track of node2 not announced:", err)
+	}
+	tr, err = alice.Subscribe(ctx, info.ID)
+	if err != nil {
+		t.Fatal("Failed to subscribe from the hosted PeerConnection:", err)
+	}
+	if err := client.Receive(tr).WaitPackets(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.Close()
+	waitFor("the PeerConnection to close", func() bool {
+		_, ok := ra2.SFU.Peer("alice")
+		return !ok
+	})
+}
+
+func Test_LastN(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	viewer := dial(t, ctx, url, "viewer", "gallery")
+	receivers := make(map[string]*client.Receiver)
+	for _, name := range []string{"alice", "bob"} {
+		c := dial(t, ctx, url, name, "gallery")
+		video, err := c.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+			&client.CounterFrames{Size: 500, Duration: 20 * time.Millisecond})
+		if err != nil {
+			t.Fatal("Failed to publish video:", err)
+		}
+		defer video.Stop()
+		info, err := viewer.WaitTrack(ctx, byOwner(name, sfu.SourceCamera))
+		if err != nil {
+			t.Fatal("Track not announced:", err)
+		}
+		tr, err := viewer.Subscribe(ctx, info.ID)
+		if err != nil {
+			t.Fatalf("Failed to subscribe to %s: %v", info.ID, err)
+		}
+		receivers[name] = client.Receive(tr)
+		if err := receivers[name].WaitPackets(ctx, 10); err != nil {
+			t.Fatalf("Did not receive packets of %s: %v", info.ID, err)
+		}
+	}
+
+	// Only the pinned video is forwarded.
+	viewer.Send("set_forwarding", map[string]any{"last_n": 1, "pinned": []string{"bob"}})
+	time.Sleep(200 * time.Millisecond)
+	paused := receivers["alice"].Stats().Packets
+	forwarded := receivers["bob"].Stats().Packets
+	time.Sleep(500 * time.Millisecond)
+	if n := receivers["alice"].Stats().Packets; n != paused {
+		t.Errorf("Expected the video of alice to be paused, received %d more packets", n-paused)
+	}
+	if n := receivers["bob"].Stats().Packets; n < forwarded+10 {
+		t.Errorf("Expected the video of bob to be forwarded, received %d more packets", n-forwarded)
+	}
+
+	viewer.Send("set_forwarding", map[string]any{"last_n": 0})
+	if err := receivers["alice"].WaitPackets(ctx, paused+10); err != nil {
+		t.Fatal("Video of alice was not resumed:", err)
+	}
+	// Packets skipped while paused do not show up as a gap.
+	if stats := receivers["alice"].Stats(); stats.Lost > 0 {
+		t.Errorf("Expected no sequence gap after resuming, got %+v", stats)
+	}
+}
+
+func Test_Viewport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	alice := dial(t, ctx, url, "alice", "simulcast")
+	viewer := dial(t, ctx, url, "viewer", "simulcast")
+	layers, err := alice.PublishSimulcast(ctx, client.VP8, "video", sfu.SourceCamera, []client.Layer{
+		{RID: "q", Frames: &client.CounterFrames{Size: 100, Duration: 20 * time.Millisecond}},
+		{RID: "f", Frames: &client.CounterFrames{Size: 1000, Duration: 20 * time.Millisecond}},
+	})
+	if err != nil {
+		t.Fatal("Failed to publish video:", err)
+	}
+	for _, l := range layers {
+		defer l.Stop()
+	}
+	if _, err := viewer.WaitTrack(ctx, func(info sfu.TrackInfo) bool {
+		return info.Owner == "alice" && len(info.Layers) == 2
+	}); err != nil {
+		t.Fatal("Simulcast track not announced:", err)
+	}
+	// The full resolution tells the sizes of the layers.
+	alice.Send("publish_track", map[string]any{
+		"track_id": "video", "source": sfu.SourceCamera, "width": 1280, "height": 720,
+	})
+	info, err := viewer.WaitTrack(ctx, func(info sfu.TrackInfo) bool {
+		return info.Owner == "alice" && info.Width == 1280
+	})
+	if err != nil {
+		t.Fatal("Resolution not announced:", err)
+	}
+	tr, err := viewer.Subscribe(ctx, info.ID)
+	if err != nil {
+		t.Fatalf("Failed to subscribe to %s: %v", info.ID, err)
+	}
+	sizes := make(chan int, 1024)
+	gaps := make(chan uint16, 1024)
+	go func() {
+		var last uint16
+		for i := 0; ; i++ {
+			packet, _, err := tr.ReadRTP()
+			if err != nil {
+				return
+			}
+			if i > 0 && packet.SequenceNumber != last+1 {
+				gaps <- packet.SequenceNumber - last
+			}
+			last = packet.SequenceNumber
+			select {
+			case sizes <- len(packet.Payload):
+			default:
+			}
+		}
+	}()
+	waitSize := func(small bool) {
+		t.Helper()
+		for {
+			select {
+			case size := <-sizes:
+				if (size < 500) == small {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("Did not switch layers, small: %v", small)
+			}
+		}
+	}
+	viewport := func(width, height int, visible bool) {
+		viewer.Send("viewport", map[string]any{"tracks": []map[string]any{{
+			"id": info.ID, "width": width, "height": height, "visible": visible,
+		}}})
+	}
+
+	viewport(320, 180, true)
+	waitSize(true)
+	viewport(1280, 720, true)
+	waitSize(false)
+	viewport(320, 180, true)
+	waitSize(true)
+	select {
+	case gap := <-gaps:
+		t.Errorf("Expected continuous sequence numbers across layer switches, got a gap of %d", gap)
+	default:
+	}
+
+	viewport(320, 180, false)
+	time.Sleep(200 * time.Millisecond)
+	for len(sizes) > 0 {
+		<-sizes
+	}
+	select {
+	case <-sizes:
+		t.Error("Expected video which is not visible to be paused")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func Test_AudioOnlyRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	// The mode is chosen by whoever creates the room.
+	alice := dial(t, ctx, url+"?audio_only=true", "alice", "voice")
+	bob := dial(t, ctx, url, "bob", "voice")
+
+	// Video is negotiated but not published.
+	video, err := alice.Publish(ctx, client.VP8, "video", sfu.SourceCamera,
+		&client.CounterFrames{Size: 800, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish video:", err)
+	}
+	defer video.Stop()
+	audio, err := alice.Publish(ctx, client.Opus, "audio", sfu.SourceMicrophone,
+		&client.CounterFrames{Size: 80, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish audio:", err)
+	}
+	defer audio.Stop()
+
+	info, err := bob.WaitTrack(ctx, byOwner("alice", sfu.SourceMicrophone))
+	if err != nil {
+		t.Fatal("Track not announced:", err)
+	}
+	tr, err := bob.Subscribe(ctx, info.ID)
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	if err := client.Receive(tr).WaitPackets(ctx, 10); err != nil {
+		t.Fatal("No audio received:", err)
+	}
+
+	// Subscribers are offered Opus with DTX, preceded by RED, and no
+	// video.
+	offer := bob.PeerConn.RemoteDescription().SDP
+	for _, want := range []string{"red/48000/2", "usedtx=1"} {
+		if !strings.Contains(offer, want) {
+			t.Errorf("Offer lacks %q:\n%s", want, offer)
+		}
+	}
+	for _, info := range bob.Tracks() {
+		if info.Source == sfu.SourceCamera {
+			t.Errorf("Video of an audio-only room announced: %+v", info)
+		}
+	}
+	if strings.Contains(offer, "m=video") {
+		t.Errorf("Offer of an audio-only room has video:\n%s", offer)
+	}
+}
+
+func Test_RegisterPost(t *testing.T) {
+	ra := raven.NewRaven(sfu.NewSFU())
+	srv := httptest.NewServer(ra)
+	defer srv.Close()
+	admin := httptest.NewServer(raven.NewAdmin(ra, adminToken))
+	defer admin.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body := `{"name": "alice", "room": "voice", "audio_only": true}`
+	req, err := http.NewRequest("POST", srv.URL+"/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	var rooms []raven.AdminRoom
+	for i := 0; len(rooms) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		adminDo(t, admin.URL, adminToken, "GET", "/rooms", nil, &rooms)
+	}
+	want := []raven.AdminRoom{{Name: "voice", Users: []string{"alice"}, AudioOnly: true}}
+	if len(rooms) != 1 || rooms[0].Name != want[0].Name || !slices.Equal(rooms[0].Users, want[0].Users) ||
+		!rooms[0].AudioOnly {
+		t.Errorf("Got rooms %+v, want %+v", rooms, want)
+	}
+}
+
+func Test_Kick(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	alice := dial(t, ctx, url, "alice", "moderated")
+	bob, _, err := websocket.DefaultDialer.DialContext(ctx, url+"?name=bob&room=moderated", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	alice.Send("kick", map[string]string{"user": "nobody"})
+	for len(alice.Errors()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Kicking a user who is not in the room was not refused")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err := alice.Errors()[0]; !strings.Contains(err.Error(), "not in room") {
+		t.Errorf("Got error %v", err)
+	}
+
+	alice.Send("kick", map[string]string{"user": "bob", "reason": "spam"})
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg raven.WebsocketMessage
+		err := bob.ReadJSON(&msg)
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			if closeErr.Code != 4000 || closeErr.Text != "spam" {
+				t.Errorf("Got close %d %q, want 4000 \"spam\"", closeErr.Code, closeErr.Text)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal("Kicked user was not closed:", err)
+		}
+		if msg.Type == "moderation" && strings.Contains(string(msg.Payload), "nobody") {
+			t.Error("Kick of a user who is not in the room was announced")
+		}
+	}
+}
+
+func Test_NameTaken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	first, _, err := websocket.DefaultDialer.DialContext(ctx, url+"?name=alice&room=taken", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, resp, err := websocket.DefaultDialer.DialContext(ctx, url+"?name=alice&room=taken", nil)
+	if err == nil {
+		second.Close()
+		t.Fatal("Second user with the same name was accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Got %v, want 409", resp)
+	}
+
+	first.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var msg raven.WebsocketMessage
+	var netErr net.Error
+	if err := first.ReadJSON(&msg); err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Error("First user was disconnected:", err)
+	}
+}
+
+func Test_SubscribeOtherRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir := cascade.NewMemoryDirectory()
+	url1 := newNode(t, "node1", dir)
+	url2 := newNode(t, "node2", dir)
+
+	alice := dial(t, ctx, url1, "alice", "a")
+	audio, err := alice.Publish(ctx, client.Opus, "audio", sfu.SourceMicrophone,
+		&client.CounterFrames{Size: 80, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish audio:", err)
+	}
+	defer audio.Stop()
+	info, err := alice.WaitTrack(ctx, byOwner("alice", sfu.SourceMicrophone))
+	if err != nil {
+		t.Fatal("Track not announced:", err)
+	}
+
+	// Neither on the same node nor on another one is the track of
+	// room a available to room b.
+	for _, url := range []string{url1, url2} {
+		bob := dial(t, ctx, url, "bob", "b")
+		_, err := bob.Subscribe(ctx, info.ID)
+		if err == nil || !strings.Contains(err.Error(), "not permitted") {
+			t.Errorf("Got %v subscribing to a track of another room, want not permitted", err)
+		}
+		bob.Close()
+	}
+}
+
+func Test_ScreenShareLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	alice := dial(t, ctx, url, "alice", "screens")
+	bob := dial(t, ctx, url, "bob", "screens")
+	carol := dial(t, ctx, url, "carol", "screens")
+	share := func(c *client.Client) {
+		t.Helper()
+		screen, err := c.Publish(ctx, client.VP8, "screen", sfu.SourceScreen,
+			&client.CounterFrames{Size: 500, Duration: 33 * time.Millisecond})
+		if err != nil {
+			t.Fatal("Failed to publish screen:", err)
+		}
+		t.Cleanup(func() { screen.Stop() })
+	}
+
+	share(alice)
+	if _, err := carol.WaitTrack(ctx, byOwner("alice", sfu.SourceScreen)); err != nil {
+		t.Fatal("First screen share not announced:", err)
+	}
+	// Only one screen share is allowed at a time by default. Bob's
+	// audio, published after the second share, shows that the share
+	// had its chance to arrive.
+	share(bob)
+	audio, err := bob.Publish(ctx, client.Opus, "audio", sfu.SourceMicrophone,
+		&client.CounterFrames{Size: 80, Duration: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to publish audio:", err)
+	}
+	defer audio.Stop()
+	if _, err := carol.WaitTrack(ctx, byOwner("bob", sfu.SourceMicrophone)); err != nil {
+		t.Fatal("Audio not announced:", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, info := range carol.Tracks() {
+		if byOwner("bob", sfu.SourceScreen)(info) {
+			t.Fatal("Second screen share was published")
+		}
+	}
+}
+
+func Test_SlowUser(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	url := newServer(t)
+
+	alice, _, err := websocket.DefaultDialer.DialContext(ctx, url+"?name=alice&room=slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	// bob never reads, so his queue fills up once the socket buffers do.
+	bob, _, err := websocket.DefaultDialer.DialContext(ctx, url+"?name=bob&room=slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	text := strings.Repeat("x", 32*1024)
+	alice.SetReadDeadline(time.Now().Add(15 * time.Second))
+	for {
+		err := alice.WriteJSON(raven.WebsocketMessage{
+			Type:    "chat",
+			Payload: json.RawMessage(`{"text":"` + text + `"}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every message must come back to alice however far behind
+		// bob is, until he is disconnected.
+		for chat := false; !chat; {
+			var msg raven.WebsocketMessage
+			if err := alice.ReadJSON(&msg); err != nil {
+				t.Fatal("Broadcast was held up by a slow user:", err)
+			}
+			switch msg.Type {
+			case "chat":
+				chat = true
+			case "presence":
+				var presence struct {
+					User   string
+					Online bool
+				}
+				json.Unmarshal(msg.Payload, &presence)
+				if presence.User == "bob" && !presence.Online {
+					return
+				}
+			}
+		}
+	}
+}
+
+// onceAuthorizer allows each peer to publish a single track.
+type onceAuthorizer struct {
+	published map[string]bool
+	mu        sync.Mutex
+}
+
+func (a *onceAuthorizer) CanPublish(peerID string, _ sfu.TrackSource) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	allowed := !a.published[peerID]
+	a.published[peerID] = true
+	return allowed
+}
+
+func (a *onceAuthorizer) CanSubscribe(string, string) bool { return true }
+
+func Test_SimulcastAuthorizedOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	s := sfu.NewSFU()
+	srv := httptest.NewServer(raven.NewRaven(s))
+	t.Cleanup(srv.Close)
+	// Only the first layer of a simulcast track is authorized, a
+	// refusal of the others would end the track.
+	s.Authorizer = &onceAuthorizer{published: make(map[string]bool)}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	alice := dial(t, ctx, url, "alice", "simulcast")
+	layers, err := alice.PublishSimulcast(ctx, client.VP8, "video", sfu.SourceCamera, []client.Layer{
+		{RID: "q", Frames: &client.CounterFrames{Size: 100, Duration: 20 * time.Millisecond}},
+		{RID: "f", Frames: &client.CounterFrames{Size: 1000, Duration: 20 * time.Millisecond}},
+	})
+	if err != nil {
+		t.Fatal("Failed to publish video:", err)
+	}
+	for _, l := range layers {
+		defer l.Stop()
+	}
+	if _, err := alice.WaitTrack(ctx, func(info sfu.TrackInfo) bool {
+		return info.Owner == "alice" && len(info.Layers) == 2
+	}); err != nil {
+		t.Fatal("Both layers not published:", err)
+	}
+}
@@ -0,0 +1,96 @@
+package raven
+
+import (
+	"errors"
+	"log"
+
+	"github.com/ravenbox/raven-prototype/pkg/recording"
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+)
+
+var (
+	errRecordingDisabled = errors.New("recording is disabled")
+	errRoomNotFound      = errors.New("room not found")
+)
+
+type msgStartRecording struct{}
+
+func (msgStartRecording) MessageType() string { return "start_recording" }
+
+type msgStopRecording struct{}
+
+func (msgStopRecording) MessageType() string { return "stop_recording" }
+
+// msgRecording announces that recording of the room started or stopped.
+type msgRecording struct {
+	Active bool   `json:"active"`
+	By     string `json:"by,omitempty"`
+}
+
+func (msgRecording) MessageType() string { return "recording" }
+
+func (u *user) wsStartRecording(_ msgStartRecording) {
+	if err := u.raven.startRecording(u.room, u.name); err != nil {
+		u.sendError(err)
+	}
+}
+
+func (u *user) wsStopRecording(_ msgStopRecording) {
+	if _, err := u.raven.stopRecording(u.room, u.name); err != nil {
+		u.sendError(err)
+	}
+}
+
+// room looks up a room by name.
+func (ra *Raven) room(name string) (*room, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	r, ok := ra.rooms[name]
+	return r, ok
+}
+
+// startRecording records all current and future tracks of r.
+func (ra *Raven) startRecording(r *room, by string) error {
+	if ra.Recorder == nil {
+		return errRecordingDisabled
+	}
+	session, err := ra.Recorder.Start(r.name)
+	if err != nil {
+		return err
+	}
+	for _, info := range ra.SFU.TrackInfos() {
+		if owner, ok := ra.ownerRoom(info); ok && owner == r {
+			ra.recordTrack(session, info)
+		}
+	}
+	r.broadcast(msgRecording{Active: true, By: by})
+	return nil
+}
+
+func (ra *Raven) stopRecording(r *room, by string) (recording.Manifest, error) {
+	if ra.Recorder == nil {
+		return recording.Manifest{}, errRecordingDisabled
+	}
+	m, err := ra.Recorder.Stop(r.name)
+	if errors.Is(err, recording.ErrNotRecording) {
+		return m, err
+	}
+	r.broadcast(msgRecording{Active: false, By: by})
+	return m, err
+}
+
+// recordTrackInfo adds a track to the recording of its room, if any.
+func (ra *Raven) recordTrackInfo(r *room, info sfu.TrackInfo) {
+	if ra.Recorder == nil {
+		return
+	}
+	if session, ok := ra.Recorder.Session(r.name); ok {
+		ra.recordTrack(session, info)
+	}
+}
+
+func (ra *Raven) recordTrack(session *recording.Session, info sfu.TrackInfo) {
+	if err := session.AddTrack(info); err != nil {
+		log.Printf("Error recording track %s: %v\n", info.ID, err)
+	}
+}
@@ -0,0 +1,176 @@
+package raven
+
+import (
+	"sync"
+
+	"github.com/ravenbox/raven-prototype/pkg/store"
+	"github.com/ravenbox/raven-prototype/pkg/utils"
+)
+
+const (
+	defaultRoom = "default"
+
+	// Number of screen shares allowed at a time in a room.
+	defaultMaxScreenShares = 1
+)
+
+type room struct {
+	name   string
+	users  map[string]*user
+	roles  map[string]Role
+	banned map[string]string // name -> reason
+
+	// memberPermissions apply to members without explicit permissions.
+	memberPermissions Permissions
+	userPermissions   map[string]Permissions
+
+	maxScreenShares int
+	// audioOnly rooms are voice channels. The PeerConnections of their
+	// users prefer Opus DTX and RED, skip the video interceptors, and
+	// video cannot be published.
+	audioOnly bool
+
+	// store persists the state above, if set.
+	store store.Store
+
+	mu sync.RWMutex
+}
+
+func newRoom(name string) *room {
+	return &room{
+		name:              name,
+		users:             make(map[string]*user),
+		roles:             make(map[string]Role),
+		banned:            make(map[string]string),
+		memberPermissions: memberPermissions,
+		userPermissions:   make(map[string]Permissions),
+		maxScreenShares:   defaultMaxScreenShares,
+	}
+}
+
+// join adds u to the room. The first user joining an unowned room
+// becomes its owner.
+func (r *room) join(u *user) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[u.name] = u
+	if _, exists := r.roles[u.name]; exists {
+		return
+	}
+	role := RoleMember
+	if !r.hasOwner() {
+		role = RoleOwner
+	}
+	r.roles[u.name] = role
+	r.saveMember(u.name)
+}
+
+func (r *room) hasOwner() bool {
+	for _, role := range r.roles {
+		if role == RoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *room) leave(u *user) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[u.name] == u {
+		delete(r.users, u.name)
+	}
+}
+
+func (r *room) userNames() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return utils.MapKeys(r.users)
+}
+
+// empty reports whether the room has no users and holds no state
+// worth keeping, such as bans.
+func (r *room) empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.users) == 0 && len(r.banned) == 0
+}
+
+func (r *room) role(name string) Role {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if role, ok := r.roles[name]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+func (r *room) setRole(name string, role Role) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roles[name] = role
+	r.saveMember(name)
+}
+
+// permissions resolves the permissions of the user called name.
+// Explicit permissions take precedence over those implied by the role.
+func (r *room) permissions(name string) Permissions {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if p, ok := r.userPermissions[name]; ok {
+		return p
+	}
+	switch r.roles[name] {
+	case RoleOwner, RoleModerator:
+		return fullPermissions
+	default:
+		return r.memberPermissions
+	}
+}
+
+func (r *room) setPermissions(name string, p Permissions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.userPermissions[name] = p
+	r.saveMember(name)
+}
+
+func (r *room) setMemberPermissions(p Permissions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.memberPermissions = p
+	r.saveSettings()
+}
+
+func (r *room) ban(name, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.banned[name] = reason
+	r.saveMember(name)
+}
+
+func (r *room) isBanned(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, banned := r.banned[name]
+	return banned
+}
+
+// broadcast queues msg for every user in the room.
+func (r *room) broadcast(msg WebsocketMessagePayload) {
+	for _, u := range r.members() {
+		u.send(msg)
+	}
+}
+
+// members returns the users in the room, so that they are sent to
+// without holding r.mu.
+func (r *room) members() []*user {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]*user, 0, len(r.users))
+	for _, u := range r.users {
+		users = append(users, u)
+	}
+	return users
+}
@@ -0,0 +1,32 @@
+package raven
+
+// msgActiveSpeaker tells the users of a room who is talking.
+type msgActiveSpeaker struct {
+	User string `json:"user"`
+}
+
+func (msgActiveSpeaker) MessageType() string { return "active_speaker" }
+
+// speakerGroup puts the audio of users into the active speaker group
+// of their room.
+func (ra *Raven) speakerGroup(owner string) string {
+	g, ok := ra.grant(owner)
+	if !ok {
+		return ""
+	}
+	return g.room
+}
+
+func (ra *Raven) onActiveSpeaker(room, owner string) {
+	if room == "" {
+		return
+	}
+	ra.broadcast(room, msgActiveSpeaker{User: owner})
+}
+
+// sendActiveSpeaker tells u who is talking in its room, if anyone.
+func (u *user) sendActiveSpeaker() {
+	if owner, ok := u.raven.SFU.DominantSpeaker(u.room.name); ok {
+		u.send(msgActiveSpeaker{User: owner})
+	}
+}
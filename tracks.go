@@ -0,0 +1,139 @@
+package raven
+
+import (
+	"github.com/ravenbox/raven-prototype/pkg/sfu"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// msgPublishTrack annotates a track the user publishes, linked by
+// MID or track ID. It may be sent before or after the track starts.
+type msgPublishTrack struct {
+	MID     string          `json:"mid"`
+	TrackID string          `json:"track_id"`
+	Source  sfu.TrackSource `json:"source"`
+	Width   int             `json:"width"`
+	Height  int             `json:"height"`
+	Muted   bool            `json:"muted"`
+}
+
+func (msgPublishTrack) MessageType() string { return "publish_track" }
+
+func (u *user) wsPublishTrack(msg msgPublishTrack) {
+	if u.relay != nil {
+		u.command(msg)
+		return
+	}
+	if u.webrtc == nil {
+		u.sendError(sfu.ErrPeerNotRegistered)
+		return
+	}
+	if err := u.raven.publishTrack(u.webrtc, msg); err != nil {
+		u.sendError(err)
+	}
+}
+
+func (ra *Raven) publishTrack(pc *webrtc.PeerConnection, msg msgPublishTrack) error {
+	_, err := ra.SFU.AnnounceTrack(pc, sfu.TrackMeta{
+		MID:     msg.MID,
+		TrackID: msg.TrackID,
+		Source:  msg.Source,
+		Width:   msg.Width,
+		Height:  msg.Height,
+		Muted:   msg.Muted,
+	})
+	return err
+}
+
+// msgTrackInfo pushes the current TrackInfo of a track in the room.
+type msgTrackInfo sfu.TrackInfo
+
+func (msgTrackInfo) MessageType() string { return "track_info" }
+
+type msgTrackEnded struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+func (msgTrackEnded) MessageType() string { return "track_ended" }
+
+// ownerRoom returns the room of the user publishing info.
+func (ra *Raven) ownerRoom(info sfu.TrackInfo) (*room, bool) {
+	owner, ok := ra.user(info.Owner)
+	if !ok {
+		return nil, false
+	}
+	return owner.room, true
+}
+
+// trackRoom returns the name of the room trackID is published in:
+// the room of its owner, or for tracks of other nodes the room of
+// their Directory entry.
+func (ra *Raven) trackRoom(trackID string) (string, bool) {
+	if info, err := ra.SFU.TrackInfo(trackID); err == nil {
+		if g, ok := ra.grant(info.Owner); ok {
+			return g.room, true
+		}
+	}
+	if node, ok := ra.clusterNode(); ok {
+		if entry, ok := node.Directory.Track(trackID); ok && entry.Room != "" {
+			return entry.Room, true
+		}
+	}
+	return "", false
+}
+
+// onTrackInfo announces info to the room of its owner, on every node
+// of the bus: the PeerConnections of its users may be hosted on any.
+func (ra *Raven) onTrackInfo(info sfu.TrackInfo) {
+	g, ok := ra.grant(info.Owner)
+	if !ok {
+		return
+	}
+	ra.mu.Lock()
+	ra.trackRooms[info.ID] = g.room
+	ra.mu.Unlock()
+	ra.broadcast(g.room, msgTrackInfo(info))
+	if r, ok := ra.ownerRoom(info); ok {
+		ra.recordTrackInfo(r, info)
+	}
+}
+
+func (ra *Raven) onTrackEnded(info sfu.TrackInfo) {
+	// The owner may be gone already.
+	ra.mu.Lock()
+	room, announced := ra.trackRooms[info.ID]
+	delete(ra.trackRooms, info.ID)
+	ra.mu.Unlock()
+	if announced {
+		ra.broadcast(room, msgTrackEnded{ID: info.ID, Owner: info.Owner})
+	}
+}
+
+// sendTrackInfos tells u about all tracks currently published in
+// its room.
+func (u *user) sendTrackInfos() {
+	for _, info := range u.raven.SFU.TrackInfos() {
+		if r, ok := u.raven.ownerRoom(info); ok && r == u.room {
+			u.send(msgTrackInfo(info))
+		}
+	}
+	u.sendRemoteTrackInfos()
+}
+
+// RoomTracks returns the ids of the tracks published in room.
+func (ra *Raven) RoomTracks(room string) []string {
+	ra.mu.Lock()
+	r, exists := ra.rooms[room]
+	ra.mu.Unlock()
+	if !exists {
+		return nil
+	}
+	var tracks []string
+	for _, info := range ra.SFU.TrackInfos() {
+		if owner, ok := ra.ownerRoom(info); ok && owner == r {
+			tracks = append(tracks, info.ID)
+		}
+	}
+	return tracks
+}
@@ -17,7 +17,7 @@ func EncodeWebsocketMessage(payload WebsocketMessagePayload) (WebsocketMessage,
 	}
 	return WebsocketMessage{
 		Type:    payload.MessageType(),
-		Payload: nil,
+		Payload: buf.Bytes(),
 	}, nil
 }
 
@@ -31,8 +31,10 @@ func Match[T WebsocketMessagePayload](m WebsocketMessage, fn func(T)) error {
 		return nil
 	}
 	var parsed T
-	if err := json.Unmarshal(m.Payload, &parsed); err != nil {
-		return err
+	if len(m.Payload) > 0 {
+		if err := json.Unmarshal(m.Payload, &parsed); err != nil {
+			return err
+		}
 	}
 	fn(parsed)
 	return nil